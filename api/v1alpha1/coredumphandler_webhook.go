@@ -0,0 +1,291 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// Default values applied by the defaulting webhook. They must be consistent with kubebuilder:default markers in CoreDumpHandlerSpec.
+const (
+	DefaultCrioEndPoint  = "unix:///run/containerd/containerd.sock"
+	DefaultHostDir       = "/mnt/core-dump-handler"
+	DefaultHandlerImage  = "quay.io/icdh/core-dump-handler:v8.10.0"
+	DefaultUploaderImage = "ghcr.io/ibm/core-dump-operator/core-dump-uploader:v0.0.1"
+
+	DefaultFilenameTemplate = "{uuid}-dump-{timestamp}-{hostname}-{exe_name}-{pid}-{signal}"
+	DefaultLogLength        = int32(500)
+	DefaultLogLevel         = "Warn"
+	DefaultCrioImageCmd     = "images"
+	DefaultTimeout          = int32(600)
+	DefaultCompression      = true
+	DefaultSuidDumpable     = int32(2)
+)
+
+// ManagedAgentEnvNames are environment variables of the agent container that the operator sets from the spec
+var ManagedAgentEnvNames = []string{
+	"COMP_FILENAME_TEMPLATE", "COMP_LOG_LENGTH", "COMP_LOG_LEVEL", "COMP_IGNORE_CRIO", "COMP_CRIO_IMAGE_CMD",
+	"COMP_TIMEOUT", "COMP_COMPRESSION", "COMP_CORE_EVENTS", "COMP_CORE_EVENT_DIR", "DEPLOY_CRIO_CONFIG",
+	"CRIO_ENDPOINT", "HOST_DIR", "CORE_DIR", "EVENT_DIR", "SUID_DUMPABLE", "DEPLOY_CRIO_EXE", "USE_INOTIFY",
+}
+
+// log is for logging in this package.
+var coredumphandlerlog = logf.Log.WithName("coredumphandler-resource")
+
+// SetupWebhookWithManager registers the defaulting and validating webhooks for CoreDumpHandler
+func (r *CoreDumpHandler) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithDefaulter(&CoreDumpHandlerDefaulter{}).
+		WithValidator(&CoreDumpHandlerValidator{Client: mgr.GetClient()}).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-charts-ibm-com-v1alpha1-coredumphandler,mutating=true,failurePolicy=fail,sideEffects=None,groups=charts.ibm.com,resources=coredumphandlers,verbs=create;update,versions=v1alpha1,name=mcoredumphandler.kb.io,admissionReviewVersions=v1
+
+// CoreDumpHandlerDefaulter fills empty fields of CoreDumpHandlerSpec
+type CoreDumpHandlerDefaulter struct{}
+
+var _ webhook.CustomDefaulter = &CoreDumpHandlerDefaulter{}
+
+// Default implements webhook.CustomDefaulter
+func (d *CoreDumpHandlerDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	cdu, ok := obj.(*CoreDumpHandler)
+	if !ok {
+		return fmt.Errorf("expected a CoreDumpHandler but got a %T", obj)
+	}
+	coredumphandlerlog.Info("default", "namespace", cdu.Namespace, "name", cdu.Name)
+	cdu.Spec.Default()
+	return nil
+}
+
+// Default fills empty fields with default values
+func (s *CoreDumpHandlerSpec) Default() {
+	if s.CrioEndPoint == "" {
+		s.CrioEndPoint = DefaultCrioEndPoint
+	}
+	if s.HostDir == "" {
+		s.HostDir = DefaultHostDir
+	}
+	if s.HandlerImage == "" {
+		s.HandlerImage = DefaultHandlerImage
+	}
+	if s.UploaderImage == "" {
+		s.UploaderImage = DefaultUploaderImage
+	}
+	s.Composer.Default()
+}
+
+// Default fills empty fields with default values
+func (c *ComposerSpec) Default() {
+	if c.FilenameTemplate == "" {
+		c.FilenameTemplate = DefaultFilenameTemplate
+	}
+	if c.LogLength == nil {
+		logLength := DefaultLogLength
+		c.LogLength = &logLength
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = DefaultLogLevel
+	}
+	if c.CrioImageCmd == "" {
+		c.CrioImageCmd = DefaultCrioImageCmd
+	}
+	if c.Timeout == nil {
+		timeout := DefaultTimeout
+		c.Timeout = &timeout
+	}
+	if c.Compression == nil {
+		compression := DefaultCompression
+		c.Compression = &compression
+	}
+	if c.SuidDumpable == nil {
+		suidDumpable := DefaultSuidDumpable
+		c.SuidDumpable = &suidDumpable
+	}
+}
+
+//+kubebuilder:webhook:path=/validate-charts-ibm-com-v1alpha1-coredumphandler,mutating=false,failurePolicy=fail,sideEffects=None,groups=charts.ibm.com,resources=coredumphandlers,verbs=create;update,versions=v1alpha1,name=vcoredumphandler.kb.io,admissionReviewVersions=v1
+
+// CoreDumpHandlerValidator rejects malformed CoreDumpHandlers and conflicts with other CoreDumpHandlers
+type CoreDumpHandlerValidator struct {
+	Client client.Reader
+}
+
+var _ webhook.CustomValidator = &CoreDumpHandlerValidator{}
+
+// ValidateCreate implements webhook.CustomValidator
+func (v *CoreDumpHandlerValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	cdu, ok := obj.(*CoreDumpHandler)
+	if !ok {
+		return nil, fmt.Errorf("expected a CoreDumpHandler but got a %T", obj)
+	}
+	coredumphandlerlog.Info("validate create", "namespace", cdu.Namespace, "name", cdu.Name)
+	return nil, v.validate(ctx, cdu)
+}
+
+// ValidateUpdate implements webhook.CustomValidator
+func (v *CoreDumpHandlerValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	cdu, ok := newObj.(*CoreDumpHandler)
+	if !ok {
+		return nil, fmt.Errorf("expected a CoreDumpHandler but got a %T", newObj)
+	}
+	coredumphandlerlog.Info("validate update", "namespace", cdu.Namespace, "name", cdu.Name)
+	if cdu.GetDeletionTimestamp() != nil {
+		// do not block finalizer removal
+		return nil, nil
+	}
+	return nil, v.validate(ctx, cdu)
+}
+
+// ValidateDelete implements webhook.CustomValidator
+func (v *CoreDumpHandlerValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *CoreDumpHandlerValidator) validate(ctx context.Context, cdu *CoreDumpHandler) error {
+	allErrs := cdu.Spec.Validate(field.NewPath("spec"))
+	if len(allErrs) == 0 && v.Client != nil {
+		conflict, err := v.findConflict(ctx, cdu)
+		if err != nil {
+			return apierrors.NewInternalError(err)
+		}
+		if conflict != nil {
+			allErrs = append(allErrs, field.Duplicate(field.NewPath("spec", "hostDir"),
+				fmt.Sprintf("%v is used by %v/%v on overlapping nodes", cdu.Spec.HostDir, conflict.Namespace, conflict.Name)))
+		}
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(schema.GroupKind{Group: GroupVersion.Group, Kind: "CoreDumpHandler"}, cdu.Name, allErrs)
+}
+
+// Validate checks fields that the CRD schema cannot express
+func (s *CoreDumpHandlerSpec) Validate(fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if !filepath.IsAbs(s.HostDir) {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("hostDir"), s.HostDir, "must be an absolute path"))
+	} else if filepath.Clean(s.HostDir) != s.HostDir {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("hostDir"), s.HostDir, fmt.Sprintf("must be normalized (%v)", filepath.Clean(s.HostDir))))
+	} else if s.HostDir == "/" {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("hostDir"), s.HostDir, "must not be the root directory"))
+	}
+	if s.ArchiveDir != "" {
+		if !filepath.IsAbs(s.ArchiveDir) || filepath.Clean(s.ArchiveDir) != s.ArchiveDir || s.ArchiveDir == "/" {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("archiveDir"), s.ArchiveDir, "must be a normalized absolute path other than the root directory"))
+		} else if rel, err := filepath.Rel(s.HostDir, s.ArchiveDir); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("archiveDir"), s.ArchiveDir, "must not be under hostDir"))
+		}
+	}
+	if s.ArchiveQuota != nil {
+		if s.ArchiveDir == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Child("archiveDir"), "archiveQuota requires archiveDir"))
+		}
+		if s.ArchiveQuota.Sign() < 0 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("archiveQuota"), s.ArchiveQuota.String(), "must not be negative"))
+		}
+	}
+
+	if u, err := url.Parse(s.CrioEndPoint); err != nil {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("crioEndPoint"), s.CrioEndPoint, err.Error()))
+	} else if u.Scheme != "unix" || u.Host != "" || !filepath.IsAbs(u.Path) {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("crioEndPoint"), s.CrioEndPoint, "must be a unix:// URL with an absolute socket path"))
+	}
+
+	if s.OpenShift && s.ServiceAccount == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("serviceAccount"), "openShift requires a service account to grant securityContextConstraints"))
+	}
+
+	for key, value := range s.NamespaceLabelSelector {
+		keyPath := fldPath.Child("namespaceLabelSelector").Key(key)
+		for _, msg := range validation.IsQualifiedName(key) {
+			allErrs = append(allErrs, field.Invalid(keyPath, key, msg))
+		}
+		for _, msg := range validation.IsValidLabelValue(value) {
+			allErrs = append(allErrs, field.Invalid(keyPath, value, msg))
+		}
+	}
+	if s.NamespaceSelector != nil {
+		if len(s.NamespaceLabelSelector) > 0 {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("namespaceLabelSelector"), "must not be set with namespaceSelector"))
+		}
+		allErrs = append(allErrs, metav1validation.ValidateLabelSelector(s.NamespaceSelector,
+			metav1validation.LabelSelectorValidationOptions{}, fldPath.Child("namespaceSelector"))...)
+	}
+	allErrs = append(allErrs, s.Composer.Validate(fldPath.Child("composer"))...)
+	return allErrs
+}
+
+// Validate checks fields that the CRD schema cannot express
+func (c *ComposerSpec) Validate(fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	names := make(map[string]bool)
+	for i, env := range c.ExtraEnv {
+		namePath := fldPath.Child("extraEnv").Index(i).Child("name")
+		for _, msg := range validation.IsEnvVarName(env.Name) {
+			allErrs = append(allErrs, field.Invalid(namePath, env.Name, msg))
+		}
+		for _, managed := range ManagedAgentEnvNames {
+			if env.Name == managed {
+				allErrs = append(allErrs, field.Forbidden(namePath, fmt.Sprintf("%v is managed by the operator, use typed fields in composer", env.Name)))
+			}
+		}
+		if names[env.Name] {
+			allErrs = append(allErrs, field.Duplicate(namePath, env.Name))
+		}
+		names[env.Name] = true
+	}
+	return allErrs
+}
+
+// findConflict returns another CoreDumpHandler that uses the same hostDir on overlapping nodes
+func (v *CoreDumpHandlerValidator) findConflict(ctx context.Context, cdu *CoreDumpHandler) (*CoreDumpHandler, error) {
+	var list CoreDumpHandlerList
+	if err := v.Client.List(ctx, &list); err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		other := &list.Items[i]
+		if other.Namespace == cdu.Namespace && other.Name == cdu.Name {
+			continue
+		}
+		if other.GetDeletionTimestamp() != nil || filepath.Clean(other.Spec.HostDir) != cdu.Spec.HostDir {
+			continue
+		}
+		if NodeSelectorsOverlap(cdu.Spec.NodeSelector, other.Spec.NodeSelector) {
+			return other, nil
+		}
+	}
+	return nil, nil
+}
+
+// NodeSelectorsOverlap returns false only if a node can never match both selectors, i.e., they require different values for a key.
+// Affinity and tolerations are not considered, so the result is conservative.
+func NodeSelectorsOverlap(a map[string]string, b map[string]string) bool {
+	for key, value := range a {
+		if other, ok := b[key]; ok && other != value {
+			return false
+		}
+	}
+	return true
+}
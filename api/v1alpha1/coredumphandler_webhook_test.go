@@ -0,0 +1,167 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package v1alpha1
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestCoreDumpHandler(namespace string, name string) *CoreDumpHandler {
+	cdu := &CoreDumpHandler{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       CoreDumpHandlerSpec{ServiceAccount: "sa", OpenShift: true},
+	}
+	cdu.Spec.Default()
+	return cdu
+}
+
+func TestDefault(t *testing.T) {
+	cdu := &CoreDumpHandler{Spec: CoreDumpHandlerSpec{HostDir: "/var/core-dump-handler"}}
+	assert.Equal(t, nil, (&CoreDumpHandlerDefaulter{}).Default(context.TODO(), cdu))
+	assert.Equal(t, DefaultCrioEndPoint, cdu.Spec.CrioEndPoint)
+	assert.Equal(t, "/var/core-dump-handler", cdu.Spec.HostDir)
+	assert.Equal(t, DefaultHandlerImage, cdu.Spec.HandlerImage)
+	assert.Equal(t, DefaultUploaderImage, cdu.Spec.UploaderImage)
+	assert.Equal(t, DefaultFilenameTemplate, cdu.Spec.Composer.FilenameTemplate)
+	assert.Equal(t, DefaultLogLength, *cdu.Spec.Composer.LogLength)
+	assert.Equal(t, DefaultTimeout, *cdu.Spec.Composer.Timeout)
+	assert.Equal(t, DefaultCompression, *cdu.Spec.Composer.Compression)
+	assert.Equal(t, DefaultSuidDumpable, *cdu.Spec.Composer.SuidDumpable)
+
+	compression := false
+	cdu.Spec.Composer.Compression = &compression
+	cdu.Spec.Default()
+	assert.Equal(t, false, *cdu.Spec.Composer.Compression)
+}
+
+func TestValidate(t *testing.T) {
+	fldPath := field.NewPath("spec")
+	valid := newTestCoreDumpHandler("ns", "a").Spec
+	valid.NamespaceLabelSelector = map[string]string{"example.com/core-dump-handler": "enabled"}
+	assert.Equal(t, 0, len(valid.Validate(fldPath)))
+
+	for _, hostDir := range []string{"mnt/core-dump-handler", "/mnt/../core-dump-handler", "/mnt/core-dump-handler/", "/"} {
+		spec := valid
+		spec.HostDir = hostDir
+		assert.NotEqual(t, 0, len(spec.Validate(fldPath)), "hostDir=%v", hostDir)
+	}
+	for _, archiveDir := range []string{"mnt/nfs", "/mnt/nfs/", "/", valid.HostDir, valid.HostDir + "/archive"} {
+		spec := valid
+		spec.ArchiveDir = archiveDir
+		assert.NotEqual(t, 0, len(spec.Validate(fldPath)), "archiveDir=%v", archiveDir)
+	}
+	spec := valid
+	spec.ArchiveDir = valid.HostDir + "-archive"
+	assert.Equal(t, 0, len(spec.Validate(fldPath)))
+	quota := resource.MustParse("10Gi")
+	spec.ArchiveQuota = &quota
+	assert.Equal(t, 0, len(spec.Validate(fldPath)))
+	negative := resource.MustParse("-1Gi")
+	spec.ArchiveQuota = &negative
+	assert.NotEqual(t, 0, len(spec.Validate(fldPath)))
+	spec = valid
+	spec.ArchiveQuota = &quota
+	assert.NotEqual(t, 0, len(spec.Validate(fldPath)))
+	for _, endpoint := range []string{"/run/containerd/containerd.sock", "tcp://localhost:1234", "unix://host/run/crio.sock", "unix://run/crio.sock"} {
+		spec := valid
+		spec.CrioEndPoint = endpoint
+		assert.NotEqual(t, 0, len(spec.Validate(fldPath)), "crioEndPoint=%v", endpoint)
+	}
+	spec = valid
+	spec.ServiceAccount = ""
+	assert.NotEqual(t, 0, len(spec.Validate(fldPath)))
+	spec.OpenShift = false
+	assert.Equal(t, 0, len(spec.Validate(fldPath)))
+
+	spec = valid
+	spec.Composer.ExtraEnv = []corev1.EnvVar{{Name: "RUST_BACKTRACE", Value: "1"}}
+	assert.Equal(t, 0, len(spec.Validate(fldPath)))
+	for _, extraEnv := range [][]corev1.EnvVar{
+		{{Name: "COMP_LOG_LENGTH", Value: "1"}},
+		{{Name: "1INVALID", Value: "1"}},
+		{{Name: "A", Value: "1"}, {Name: "A", Value: "2"}},
+	} {
+		spec := valid
+		spec.Composer.ExtraEnv = extraEnv
+		assert.NotEqual(t, 0, len(spec.Validate(fldPath)), "extraEnv=%v", extraEnv)
+	}
+
+	spec = valid
+	spec.NamespaceLabelSelector = nil
+	spec.NamespaceSelector = &metav1.LabelSelector{
+		MatchLabels: map[string]string{"core-dump-handler": "enabled"},
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "tier", Operator: metav1.LabelSelectorOpIn, Values: []string{"dev", "test"}},
+			{Key: "restricted", Operator: metav1.LabelSelectorOpDoesNotExist},
+		},
+	}
+	assert.Equal(t, 0, len(spec.Validate(fldPath)))
+	spec.NamespaceLabelSelector = map[string]string{"core-dump-handler": "enabled"}
+	assert.NotEqual(t, 0, len(spec.Validate(fldPath)))
+	spec.NamespaceLabelSelector = nil
+	spec.NamespaceSelector = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+		{Key: "tier", Operator: metav1.LabelSelectorOpIn},
+	}}
+	assert.NotEqual(t, 0, len(spec.Validate(fldPath)))
+
+	for key, value := range map[string]string{"-invalid": "enabled", "a=b": "enabled", "valid": "in valid", "valid2": "a,b"} {
+		spec := valid
+		spec.NamespaceLabelSelector = map[string]string{key: value}
+		assert.NotEqual(t, 0, len(spec.Validate(fldPath)), "key=%v, value=%v", key, value)
+	}
+}
+
+func TestGetNamespaceSelector(t *testing.T) {
+	spec := CoreDumpHandlerSpec{}
+	assert.Equal(t, (*metav1.LabelSelector)(nil), spec.GetNamespaceSelector())
+	spec.NamespaceLabelSelector = map[string]string{"a": "b", "c": "d"}
+	assert.Equal(t, &metav1.LabelSelector{MatchLabels: map[string]string{"a": "b", "c": "d"}}, spec.GetNamespaceSelector())
+	spec.NamespaceLabelSelector = nil
+	spec.NamespaceSelector = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+		{Key: "a", Operator: metav1.LabelSelectorOpExists},
+	}}
+	assert.Equal(t, spec.NamespaceSelector, spec.GetNamespaceSelector())
+}
+
+func TestValidateConflict(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.Equal(t, nil, AddToScheme(scheme))
+	existing := newTestCoreDumpHandler("ns1", "a")
+	existing.Spec.NodeSelector = map[string]string{"zone": "a"}
+	v := &CoreDumpHandlerValidator{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(existing).Build()}
+
+	// update of itself
+	_, err := v.ValidateUpdate(context.TODO(), existing, existing)
+	assert.Equal(t, nil, err)
+
+	// same hostDir on overlapping nodes
+	cdu := newTestCoreDumpHandler("ns2", "a")
+	_, err = v.ValidateCreate(context.TODO(), cdu)
+	assert.NotEqual(t, nil, err)
+	cdu.Spec.NodeSelector = map[string]string{"zone": "a", "arch": "amd64"}
+	_, err = v.ValidateCreate(context.TODO(), cdu)
+	assert.NotEqual(t, nil, err)
+
+	// same hostDir on disjoint nodes
+	cdu.Spec.NodeSelector = map[string]string{"zone": "b"}
+	_, err = v.ValidateCreate(context.TODO(), cdu)
+	assert.Equal(t, nil, err)
+
+	// different hostDir
+	cdu.Spec.NodeSelector = nil
+	cdu.Spec.HostDir = "/var/core-dump-handler"
+	_, err = v.ValidateCreate(context.TODO(), cdu)
+	assert.Equal(t, nil, err)
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
@@ -27,6 +28,13 @@ type CoreDumpHandlerSpec struct {
 	//+kubebuilder:default="/mnt/core-dump-handler"
 	HostDir string `json:"hostDir,omitempty"`
 
+	// ArchiveDir is a directory path in the host filesystem such as an NFS mount where secrets with type=fs write core dumps.
+	// The fs destination is disabled if empty.
+	ArchiveDir string `json:"archiveDir,omitempty"`
+
+	// ArchiveQuota is the maximum total size of files that each namespace can write under archiveDir. It is unlimited if empty.
+	ArchiveQuota *resource.Quantity `json:"archiveQuota,omitempty"`
+
 	// HandlerImage is the image for core-dump-handler to collect core dumps and runtime informations
 	//+kubebuilder:default="quay.io/icdh/core-dump-handler:v8.10.0"
 	HandlerImage string `json:"handlerImage,omitempty"`
@@ -44,9 +52,14 @@ type CoreDumpHandlerSpec struct {
 	// NodeSelector restricts nodes that can run core dump daemonsets
 	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
 
-	// NamespaceLabelSelector restricts namespaces that collect core dumps
+	// NamespaceLabelSelector restricts namespaces that collect core dumps.
+	// Deprecated: use NamespaceSelector. It is converted to namespaceSelector.matchLabels and thus all labels must match.
 	NamespaceLabelSelector map[string]string `json:"namespaceLabelSelector,omitempty"`
 
+	// NamespaceSelector restricts namespaces that collect core dumps with Kubernetes label selector semantics.
+	// An empty selector matches all namespaces.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
 	// OpenShift specifies to handle securityContextConstraints
 	OpenShift bool `json:"openShift,omitempty"`
 
@@ -58,14 +71,112 @@ type CoreDumpHandlerSpec struct {
 
 	// Affinity adds scheduling affinity
 	Affinity *AffinityApplyConfiguration `json:"affinity,omitempty"`
+
+	// Composer configures core-dump-composer and core-dump-agent in handlerImage containers
+	//+kubebuilder:default={}
+	Composer ComposerSpec `json:"composer,omitempty"`
+}
+
+// ComposerSpec defines settings of core-dump-composer and core-dump-agent
+type ComposerSpec struct {
+	// FilenameTemplate is the template of generated zip file names (COMP_FILENAME_TEMPLATE)
+	//+kubebuilder:default="{uuid}-dump-{timestamp}-{hostname}-{exe_name}-{pid}-{signal}"
+	//+kubebuilder:validation:MinLength=1
+	FilenameTemplate string `json:"filenameTemplate,omitempty"`
+
+	// LogLength is the number of log lines captured from a crashed container (COMP_LOG_LENGTH)
+	//+kubebuilder:default=500
+	//+kubebuilder:validation:Minimum=0
+	LogLength *int32 `json:"logLength,omitempty"`
+
+	// LogLevel is the log level of core-dump-composer (COMP_LOG_LEVEL)
+	//+kubebuilder:default="Warn"
+	//+kubebuilder:validation:Enum=Error;Warn;Info;Debug
+	LogLevel string `json:"logLevel,omitempty"`
+
+	// IgnoreCrio skips collecting runtime information from crictl (COMP_IGNORE_CRIO)
+	IgnoreCrio bool `json:"ignoreCrio,omitempty"`
+
+	// CrioImageCmd is the crictl subcommand to list images (COMP_CRIO_IMAGE_CMD)
+	//+kubebuilder:default="images"
+	//+kubebuilder:validation:Enum=images;img
+	CrioImageCmd string `json:"crioImageCmd,omitempty"`
+
+	// Timeout is the timeout in seconds for core-dump-composer to collect a core dump (COMP_TIMEOUT)
+	//+kubebuilder:default=600
+	//+kubebuilder:validation:Minimum=1
+	Timeout *int32 `json:"timeout,omitempty"`
+
+	// Compression enables compression of zip files (COMP_COMPRESSION)
+	//+kubebuilder:default=true
+	Compression *bool `json:"compression,omitempty"`
+
+	// CoreEvents generates event files at every core dump (COMP_CORE_EVENTS)
+	CoreEvents bool `json:"coreEvents,omitempty"`
+
+	// DeployCrioConfig deploys a crictl configuration to the host (DEPLOY_CRIO_CONFIG)
+	DeployCrioConfig bool `json:"deployCrioConfig,omitempty"`
+
+	// DeployCrioExe deploys a crictl binary to the host (DEPLOY_CRIO_EXE)
+	DeployCrioExe bool `json:"deployCrioExe,omitempty"`
+
+	// SuidDumpable is the value for fs.suid_dumpable of the host (SUID_DUMPABLE)
+	//+kubebuilder:default=2
+	//+kubebuilder:validation:Enum=0;1;2
+	SuidDumpable *int32 `json:"suidDumpable,omitempty"`
+
+	// UseInotify makes core-dump-agent watch zip files with inotify instead of a periodic scan (USE_INOTIFY)
+	UseInotify bool `json:"useInotify,omitempty"`
+
+	// ExtraEnv adds environment variables to the agent container. Names that are managed by the operator are rejected.
+	ExtraEnv []corev1.EnvVar `json:"extraEnv,omitempty"`
 }
 
+// Condition types reported in CoreDumpHandlerStatus.Conditions
+const (
+	// ConditionReady is true when the daemonset is fully rolled out and no reconcile error is observed
+	ConditionReady = "Ready"
+	// ConditionDaemonSetAvailable is true when every scheduled node runs an up-to-date and available pod
+	ConditionDaemonSetAvailable = "DaemonSetAvailable"
+	// ConditionSccReady is true when the securityContextConstraints exist or are not required
+	ConditionSccReady = "SccReady"
+	// ConditionDegraded is true when the last reconcile failed
+	ConditionDegraded = "Degraded"
+)
+
 // CoreDumpHandlerStatus defines the observed state of CoreDumpHandler
 type CoreDumpHandlerStatus struct {
+	// Conditions represent the latest available observations of the handler
+	//+listType=map
+	//+listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// ObservedGeneration is the generation most recently reconciled
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// DesiredNumberScheduled is the number of nodes that should run the daemonset pod
+	DesiredNumberScheduled int32 `json:"desiredNumberScheduled,omitempty"`
+
+	// NumberReady is the number of nodes that run a ready daemonset pod
+	NumberReady int32 `json:"numberReady,omitempty"`
+
+	// UpdatedNumberScheduled is the number of nodes that run an up-to-date daemonset pod
+	UpdatedNumberScheduled int32 `json:"updatedNumberScheduled,omitempty"`
+
+	// HandlerImage is the image of the agent container in the daemonset spec. It is empty if the daemonset does not exist
+	HandlerImage string `json:"handlerImage,omitempty"`
+
+	// UploaderImage is the image of the uploader container in the daemonset spec. It is empty if the daemonset does not exist
+	UploaderImage string `json:"uploaderImage,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Desired",type=integer,JSONPath=`.status.desiredNumberScheduled`
+//+kubebuilder:printcolumn:name="Nodes-Ready",type=integer,JSONPath=`.status.numberReady`
+//+kubebuilder:printcolumn:name="Up-to-date",type=integer,JSONPath=`.status.updatedNumberScheduled`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // CoreDumpHandler is the Schema for the CoreDumpHandlers API
 type CoreDumpHandler struct {
@@ -89,6 +200,21 @@ func init() {
 	SchemeBuilder.Register(&CoreDumpHandler{}, &CoreDumpHandlerList{})
 }
 
+// GetNamespaceSelector returns NamespaceSelector or converts deprecated NamespaceLabelSelector. It returns nil if both are unset.
+func (s *CoreDumpHandlerSpec) GetNamespaceSelector() *metav1.LabelSelector {
+	if s.NamespaceSelector != nil {
+		return s.NamespaceSelector.DeepCopy()
+	}
+	if len(s.NamespaceLabelSelector) > 0 {
+		selector := &metav1.LabelSelector{MatchLabels: make(map[string]string)}
+		for key, value := range s.NamespaceLabelSelector {
+			selector.MatchLabels[key] = value
+		}
+		return selector
+	}
+	return nil
+}
+
 type AffinityApplyConfiguration corev1apply.AffinityApplyConfiguration
 
 func (in *AffinityApplyConfiguration) DeepCopy() *AffinityApplyConfiguration {
@@ -12,6 +12,7 @@ package v1alpha1
 
 import (
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -21,13 +22,55 @@ func (in *AffinityApplyConfiguration) DeepCopyInto(out *AffinityApplyConfigurati
 	*out = *clone
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ComposerSpec) DeepCopyInto(out *ComposerSpec) {
+	*out = *in
+	if in.LogLength != nil {
+		in, out := &in.LogLength, &out.LogLength
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Compression != nil {
+		in, out := &in.Compression, &out.Compression
+		*out = new(bool)
+		**out = **in
+	}
+	if in.SuidDumpable != nil {
+		in, out := &in.SuidDumpable, &out.SuidDumpable
+		*out = new(int32)
+		**out = **in
+	}
+	if in.ExtraEnv != nil {
+		in, out := &in.ExtraEnv, &out.ExtraEnv
+		*out = make([]v1.EnvVar, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ComposerSpec.
+func (in *ComposerSpec) DeepCopy() *ComposerSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ComposerSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CoreDumpHandler) DeepCopyInto(out *CoreDumpHandler) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CoreDumpHandler.
@@ -83,6 +126,11 @@ func (in *CoreDumpHandlerList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CoreDumpHandlerSpec) DeepCopyInto(out *CoreDumpHandlerSpec) {
 	*out = *in
+	if in.ArchiveQuota != nil {
+		in, out := &in.ArchiveQuota, &out.ArchiveQuota
+		x := (*in).DeepCopy()
+		*out = &x
+	}
 	if in.NodeSelector != nil {
 		in, out := &in.NodeSelector, &out.NodeSelector
 		*out = make(map[string]string, len(*in))
@@ -97,6 +145,11 @@ func (in *CoreDumpHandlerSpec) DeepCopyInto(out *CoreDumpHandlerSpec) {
 			(*out)[key] = val
 		}
 	}
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Resource != nil {
 		in, out := &in.Resource, &out.Resource
 		*out = new(v1.ResourceRequirements)
@@ -113,6 +166,7 @@ func (in *CoreDumpHandlerSpec) DeepCopyInto(out *CoreDumpHandlerSpec) {
 		in, out := &in.Affinity, &out.Affinity
 		*out = (*in).DeepCopy()
 	}
+	in.Composer.DeepCopyInto(&out.Composer)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CoreDumpHandlerSpec.
@@ -128,6 +182,13 @@ func (in *CoreDumpHandlerSpec) DeepCopy() *CoreDumpHandlerSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CoreDumpHandlerStatus) DeepCopyInto(out *CoreDumpHandlerStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CoreDumpHandlerStatus.
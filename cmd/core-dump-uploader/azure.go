@@ -0,0 +1,184 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+const DestinationTypeAzure = "azure"
+
+// AzureDestinationSecret is configured with entries of core-dump-handler secrets with type=azure
+type AzureDestinationSecret struct {
+	Account   string
+	Container string
+	// SasToken or SharedKey authorizes requests. SasToken is preferred if both are set.
+	SasToken  string
+	SharedKey []byte
+	// Endpoint is https://<account>.blob.core.windows.net by default. Azurite uses http://<host>:10000/<account>.
+	Endpoint        string
+	CreateContainer bool
+}
+
+func NewAzureDestinationSecret(data map[string][]byte) (*AzureDestinationSecret, error) {
+	noEnt := make([]string, 0)
+	for _, ent := range []string{"account", "container"} {
+		if len(data[ent]) == 0 {
+			noEnt = append(noEnt, ent)
+		}
+	}
+	if len(noEnt) > 0 {
+		return nil, fmt.Errorf("failed: NewAzureDestinationSecret, malformed core-dump-handler secret, missing entries=%v", strings.Join(noEnt, ","))
+	}
+	c := &AzureDestinationSecret{
+		Account: string(data["account"]), Container: string(data["container"]),
+		SasToken: strings.TrimPrefix(string(data["sasToken"]), "?"), Endpoint: strings.TrimSuffix(string(data["endpoint"]), "/"),
+	}
+	if v, ok := data["sharedKey"]; ok && len(v) > 0 {
+		key, err := base64.StdEncoding.DecodeString(string(v))
+		if err != nil {
+			return nil, fmt.Errorf("failed: NewAzureDestinationSecret, malformed core-dump-handler secret, sharedKey must be base64-encoded, err=%v", err)
+		}
+		c.SharedKey = key
+	}
+	if c.SasToken == "" && c.SharedKey == nil {
+		return nil, fmt.Errorf("failed: NewAzureDestinationSecret, malformed core-dump-handler secret, sasToken or sharedKey is required")
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = fmt.Sprintf("https://%v.blob.core.windows.net", c.Account)
+	}
+	if _, err := url.Parse(c.Endpoint); err != nil {
+		return nil, fmt.Errorf("failed: NewAzureDestinationSecret, malformed core-dump-handler secret, endpoint=%v, err=%v", c.Endpoint, err)
+	}
+	if v, ok := data["createContainer"]; ok {
+		createContainer, err := strconv.ParseBool(string(v))
+		if err != nil {
+			return nil, fmt.Errorf("failed: NewAzureDestinationSecret, malformed core-dump-handler secret, cannot parse bool createContainer, %v", v)
+		}
+		c.CreateContainer = createContainer
+	}
+	return c, nil
+}
+
+// AzureBlobDestination uploads block blobs with azblob
+type AzureBlobDestination struct {
+	c         *AzureDestinationSecret
+	client    *azblob.Client
+	multipart MultipartConfig
+}
+
+// NewAzureDestinationFactory uploads files with azblob, which stages blocks of multipart.PartSize for files larger than 256 MiB
+func NewAzureDestinationFactory(multipart MultipartConfig, httpClient *http.Client) DestinationFactory {
+	return func(namespace string, data map[string][]byte) (Destination, error) {
+		c, err := NewAzureDestinationSecret(data)
+		if err != nil {
+			return nil, err
+		}
+		client, err := NewAzureClient(c, multipart, httpClient)
+		if err != nil {
+			return nil, err
+		}
+		return &AzureBlobDestination{c: c, client: client, multipart: multipart}, nil
+	}
+}
+
+// NewAzureClient authorizes requests with SasToken or SharedKey. azblob retries each request up to multipart.MaxAttempts times.
+func NewAzureClient(c *AzureDestinationSecret, multipart MultipartConfig, httpClient *http.Client) (*azblob.Client, error) {
+	// azcore retries 3 times if MaxRetries is 0
+	maxRetries := int32(multipart.MaxAttempts - 1)
+	if maxRetries <= 0 {
+		maxRetries = -1
+	}
+	opts := &azblob.ClientOptions{ClientOptions: azcore.ClientOptions{Transport: httpClient, Retry: policy.RetryOptions{MaxRetries: maxRetries}}}
+	if c.SasToken != "" {
+		client, err := azblob.NewClientWithNoCredential(c.Endpoint+"/?"+c.SasToken, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed: NewAzureClient, NewClientWithNoCredential, endpoint=%v, err=%v", c.Endpoint, err)
+		}
+		return client, nil
+	}
+	cred, err := azblob.NewSharedKeyCredential(c.Account, base64.StdEncoding.EncodeToString(c.SharedKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed: NewAzureClient, NewSharedKeyCredential, account=%v, err=%v", c.Account, err)
+	}
+	client, err := azblob.NewClientWithSharedKeyCredential(c.Endpoint+"/", cred, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed: NewAzureClient, NewClientWithSharedKeyCredential, endpoint=%v, err=%v", c.Endpoint, err)
+	}
+	return client, nil
+}
+
+// GetLocation does not contain SAS tokens for logging
+func (d *AzureBlobDestination) GetLocation(key string) string {
+	return d.c.Endpoint + "/" + d.c.Container + "/" + key
+}
+
+// Prepare creates the container if it does not exist and createContainer is true
+func (d *AzureBlobDestination) Prepare() error {
+	_, err := d.client.ServiceClient().NewContainerClient(d.c.Container).GetProperties(context.Background(), nil)
+	if err == nil {
+		return nil
+	}
+	if !bloberror.HasCode(err, bloberror.ContainerNotFound) || !d.c.CreateContainer {
+		return fmt.Errorf("failed: AzureBlobDestination.Prepare, GetProperties, container=%v, err=%v", d.c.Container, err)
+	}
+	_, err = d.client.CreateContainer(context.Background(), d.c.Container, nil)
+	if bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed: AzureBlobDestination.Prepare, CreateContainer, container=%v, err=%v", d.c.Container, err)
+	}
+	log.Printf("INFO: AzureBlobDestination.Prepare, created container=%v", d.c.Container)
+	return nil
+}
+
+// GetAzureMetadata converts keys to C# identifiers that Azure allows as metadata names
+func GetAzureMetadata(opts *ObjectOptions) map[string]*string {
+	ret := make(map[string]*string)
+	if opts == nil {
+		return ret
+	}
+	for key, value := range opts.Metadata {
+		v := value
+		ret[strings.ReplaceAll(key, "-", "_")] = &v
+	}
+	return ret
+}
+
+// Put uploads f with a single Put Blob if azblob can. Otherwise, it uploads blocks concurrently and commits them.
+// Azure discards uncommitted blocks of failed uploads after a week.
+func (d *AzureBlobDestination) Put(key string, f *os.File, opts *ObjectOptions) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed: AzureBlobDestination.Put, Stat, f.Name()=%v, err=%v", f.Name(), err)
+	}
+	concurrency := d.multipart.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	_, err = d.client.UploadFile(context.Background(), d.c.Container, key, f, &azblob.UploadFileOptions{
+		BlockSize: d.multipart.GetPartSize(stat.Size()), Concurrency: uint16(concurrency), Metadata: GetAzureMetadata(opts),
+	})
+	if err != nil {
+		return fmt.Errorf("failed: AzureBlobDestination.Put, UploadFile, container=%v, key=%v, err=%v", d.c.Container, key, err)
+	}
+	log.Printf("INFO: AzureBlobDestination.Put: %v->%v", f.Name(), d.GetLocation(key))
+	return nil
+}
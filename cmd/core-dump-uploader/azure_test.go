@@ -0,0 +1,215 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAzureAccount = "devstoreaccount1"
+
+var testAzureKey = []byte("0123456789abcdef0123456789abcdef")
+
+// FakeAzureServer implements a subset of Blob service APIs with Azurite-style URLs (/<account>/<container>/<blob>)
+type FakeAzureServer struct {
+	lock       sync.Mutex
+	server     *httptest.Server
+	containers map[string]bool
+	blobs      map[string][]byte
+	blocks     map[string]map[string][]byte
+	headers    map[string]http.Header
+	blockCalls int
+	authFails  int
+}
+
+func NewFakeAzureServer() *FakeAzureServer {
+	f := &FakeAzureServer{
+		containers: make(map[string]bool), blobs: make(map[string][]byte), blocks: make(map[string]map[string][]byte),
+		headers: make(map[string]http.Header),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.ServeHTTP))
+	return f
+}
+
+func (f *FakeAzureServer) Close() {
+	f.server.Close()
+}
+
+func writeAzureError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+}
+
+func (f *FakeAzureServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	query := r.URL.Query()
+	if query.Get("sig") == "" {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey "+testAzureAccount+":") {
+			f.authFails += 1
+			writeAzureError(w, http.StatusForbidden, "AuthenticationFailed")
+			return
+		}
+	}
+	body, _ := io.ReadAll(r.Body)
+	path := strings.TrimPrefix(r.URL.Path, "/"+testAzureAccount+"/")
+	container, _, _ := strings.Cut(path, "/")
+	switch {
+	case query.Get("restype") == "container" && r.Method == http.MethodGet:
+		if !f.containers[container] {
+			writeAzureError(w, http.StatusNotFound, "ContainerNotFound")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case query.Get("restype") == "container" && r.Method == http.MethodPut:
+		if f.containers[container] {
+			writeAzureError(w, http.StatusConflict, "ContainerAlreadyExists")
+			return
+		}
+		f.containers[container] = true
+		w.WriteHeader(http.StatusCreated)
+	case !f.containers[container]:
+		writeAzureError(w, http.StatusNotFound, "ContainerNotFound")
+	case query.Get("comp") == "block" && r.Method == http.MethodPut:
+		f.blockCalls += 1
+		if _, ok := f.blocks[path]; !ok {
+			f.blocks[path] = make(map[string][]byte)
+		}
+		f.blocks[path][query.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+	case query.Get("comp") == "blocklist" && r.Method == http.MethodPut:
+		var blockList struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.Unmarshal(body, &blockList); err != nil {
+			writeAzureError(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		var buf bytes.Buffer
+		for _, id := range blockList.Latest {
+			block, ok := f.blocks[path][id]
+			if !ok {
+				writeAzureError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			buf.Write(block)
+		}
+		delete(f.blocks, path)
+		f.blobs[path] = buf.Bytes()
+		f.headers[path] = r.Header.Clone()
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && r.Header.Get("x-ms-blob-type") == "BlockBlob":
+		f.blobs[path] = body
+		f.headers[path] = r.Header.Clone()
+		w.WriteHeader(http.StatusCreated)
+	default:
+		writeAzureError(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+func (f *FakeAzureServer) GetSecretData(container string) map[string][]byte {
+	return map[string][]byte{
+		"type": []byte(DestinationTypeAzure), "account": []byte(testAzureAccount), "container": []byte(container),
+		"sharedKey": []byte(base64.StdEncoding.EncodeToString(testAzureKey)), "endpoint": []byte(f.server.URL + "/" + testAzureAccount),
+	}
+}
+
+func TestNewAzureDestinationSecret(t *testing.T) {
+	data := map[string][]byte{"account": []byte("account"), "container": []byte("cores"), "sasToken": []byte("?sv=2021&sig=abc")}
+	c, err := NewAzureDestinationSecret(data)
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "sv=2021&sig=abc", c.SasToken)
+		assert.Equal(t, "https://account.blob.core.windows.net", c.Endpoint)
+		assert.Equal(t, false, c.CreateContainer)
+	}
+	delete(data, "sasToken")
+	_, err = NewAzureDestinationSecret(data)
+	assert.NotEqual(t, nil, err)
+	data["sharedKey"] = []byte("not base64")
+	_, err = NewAzureDestinationSecret(data)
+	assert.NotEqual(t, nil, err)
+	data["sharedKey"] = []byte(base64.StdEncoding.EncodeToString(testAzureKey))
+	data["createContainer"] = []byte("yes?")
+	_, err = NewAzureDestinationSecret(data)
+	assert.NotEqual(t, nil, err)
+	_, err = NewAzureDestinationSecret(map[string][]byte{"account": []byte("account"), "sasToken": []byte("sig=abc")})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestAzureBlobDestination(t *testing.T) {
+	server := NewFakeAzureServer()
+	defer server.Close()
+	tmpDir := t.TempDir()
+	r := NewDestinationRegistry()
+	r.Register(DestinationTypeAzure, NewAzureDestinationFactory(MultipartConfig{PartSize: MinPartSize, Concurrency: 2, MaxAttempts: 1}, server.server.Client()))
+
+	data := server.GetSecretData("cores")
+	d, err := r.NewDestination(DestinationTypeAzure, "test", data)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	assert.NotEqual(t, nil, d.Prepare())
+	data["createContainer"] = []byte("true")
+	d, err = r.NewDestination(DestinationTypeAzure, "test", data)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	assert.Equal(t, nil, d.Prepare())
+	assert.Equal(t, true, server.containers["cores"])
+	assert.Equal(t, nil, d.Prepare())
+
+	opts := &ObjectOptions{Metadata: map[string]string{"namespace": "test", "pod-name": "app-0"}}
+	for _, size := range []int{0, 1024, int(MinPartSize + 1024)} {
+		filePath := filepath.Join(tmpDir, "a.zip")
+		expected := CreateTestFile(t, filePath, size)
+		f, err := os.Open(filePath)
+		if !assert.Equal(t, nil, err) {
+			return
+		}
+		defer f.Close()
+		key := "ns/a b.zip"
+		if assert.Equal(t, nil, d.Put(key, f, opts), "size=%v", size) {
+			assert.Equal(t, true, bytes.Equal(expected, server.blobs["cores/"+key]), "size=%v", size)
+			assert.Equal(t, "app-0", server.headers["cores/"+key].Get("x-ms-meta-pod_name"))
+			assert.Equal(t, "test", server.headers["cores/"+key].Get("x-ms-meta-namespace"))
+		}
+	}
+	// azblob uploads files up to 256 MiB with a single Put Blob
+	assert.Equal(t, 0, server.blockCalls)
+	assert.Equal(t, 0, server.authFails)
+
+	// SAS tokens replace shared keys and are not leaked in errors
+	data = server.GetSecretData("notfound")
+	delete(data, "sharedKey")
+	data["sasToken"] = []byte("sv=2021-08-06&sig=secret")
+	d, err = r.NewDestination(DestinationTypeAzure, "test", data)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	f, err := os.Open(filepath.Join(tmpDir, "a.zip"))
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+	err = d.Put("ns/a.zip", f, nil)
+	if assert.NotEqual(t, nil, err) {
+		assert.Contains(t, err.Error(), "ContainerNotFound")
+		assert.NotContains(t, err.Error(), "secret")
+	}
+	assert.Equal(t, 0, server.authFails)
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Client-side encryption format version 1:
+//
+//	header: cseMagic | recipient public key (32 bytes) | ephemeral public key (32 bytes) | salt (16 bytes)
+//	body:   AES-256-GCM chunks of cseChunkSize bytes. The last chunk is shorter (or empty) and sealed with a last-chunk flag in its nonce.
+//
+// The content key is derived with HKDF-SHA256 from the X25519 shared secret of the ephemeral and recipient keys.
+// The version is part of cseMagic and cseInfo. A new format must change both so that old readers reject it.
+const (
+	cseMagic      = "CDUENC1\n"
+	cseKeySize    = 32
+	cseSaltSize   = 16
+	cseHeaderSize = len(cseMagic) + cseKeySize*2 + cseSaltSize
+	cseChunkSize  = 64 * 1024
+	cseInfo       = "core-dump-uploader x25519 aes-256-gcm v1"
+	cseSuffix     = ".enc"
+)
+
+// ParsePublicKey parses a base64-encoded X25519 public key in encryptionPublicKey of core-dump-handler secrets
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("failed: ParsePublicKey, encryptionPublicKey must be a base64-encoded X25519 public key, err=%v", err)
+	}
+	key, err := ecdh.X25519().NewPublicKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed: ParsePublicKey, encryptionPublicKey must be a base64-encoded X25519 public key, err=%v", err)
+	}
+	return key, nil
+}
+
+// ParseIdentity reads a base64-encoded X25519 private key. Empty lines and lines starting with # are ignored.
+func ParseIdentity(r io.Reader) (*ecdh.PrivateKey, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		buf, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("failed: ParseIdentity, DecodeString, err=%v", err)
+		}
+		key, err := ecdh.X25519().NewPrivateKey(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed: ParseIdentity, NewPrivateKey, err=%v", err)
+		}
+		return key, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed: ParseIdentity, Scan, err=%v", err)
+	}
+	return nil, fmt.Errorf("failed: ParseIdentity, no private key found")
+}
+
+// WriteIdentity writes a new private key in the format of ParseIdentity with its public key as a comment
+func WriteIdentity(w io.Writer) (*ecdh.PrivateKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed: WriteIdentity, GenerateKey, err=%v", err)
+	}
+	_, err = fmt.Fprintf(w, "# public key: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), base64.StdEncoding.EncodeToString(key.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("failed: WriteIdentity, Fprintf, err=%v", err)
+	}
+	return key, nil
+}
+
+func newCseAEAD(shared []byte, header []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, header[len(cseMagic):], []byte(cseInfo)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func cseNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type EncryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+// NewEncryptWriter encrypts data written to it for recipient. Close must be called to write the last chunk.
+func NewEncryptWriter(w io.Writer, recipient *ecdh.PublicKey) (io.WriteCloser, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed: NewEncryptWriter, GenerateKey, err=%v", err)
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("failed: NewEncryptWriter, ECDH, err=%v", err)
+	}
+	header := make([]byte, 0, cseHeaderSize)
+	header = append(header, cseMagic...)
+	header = append(header, recipient.Bytes()...)
+	header = append(header, ephemeral.PublicKey().Bytes()...)
+	salt := make([]byte, cseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed: NewEncryptWriter, rand.Read, err=%v", err)
+	}
+	header = append(header, salt...)
+	aead, err := newCseAEAD(shared, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed: NewEncryptWriter, newCseAEAD, err=%v", err)
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, fmt.Errorf("failed: NewEncryptWriter, Write, err=%v", err)
+	}
+	return &EncryptWriter{w: w, aead: aead, buf: make([]byte, 0, cseChunkSize)}, nil
+}
+
+func (e *EncryptWriter) flush(last bool) error {
+	sealed := e.aead.Seal(nil, cseNonce(e.counter, last), e.buf, nil)
+	e.counter += 1
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *EncryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, fmt.Errorf("failed: EncryptWriter.Write, closed")
+	}
+	n := 0
+	for len(p) > 0 {
+		// keep a full chunk until the next write since the last chunk is sealed differently
+		if len(e.buf) == cseChunkSize {
+			if err := e.flush(false); err != nil {
+				return n, err
+			}
+		}
+		l := cseChunkSize - len(e.buf)
+		if l > len(p) {
+			l = len(p)
+		}
+		e.buf = append(e.buf, p[:l]...)
+		p = p[l:]
+		n += l
+	}
+	return n, nil
+}
+
+func (e *EncryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	if len(e.buf) == cseChunkSize {
+		if err := e.flush(false); err != nil {
+			return err
+		}
+	}
+	return e.flush(true)
+}
+
+// ReadRecipient returns the recipient public key in the header of an encrypted file
+func ReadRecipient(r io.Reader) ([]byte, error) {
+	header := make([]byte, cseHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed: ReadRecipient, ReadFull, err=%v", err)
+	}
+	if string(header[:len(cseMagic)]) != cseMagic {
+		return nil, fmt.Errorf("failed: ReadRecipient, not an encrypted core dump")
+	}
+	return header[len(cseMagic) : len(cseMagic)+cseKeySize], nil
+}
+
+// Decrypt writes plaintext of r to w. It fails if r is truncated or modified.
+func Decrypt(w io.Writer, r io.Reader, identity *ecdh.PrivateKey) error {
+	header := make([]byte, cseHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("failed: Decrypt, ReadFull (header), err=%v", err)
+	}
+	if string(header[:len(cseMagic)]) != cseMagic {
+		return fmt.Errorf("failed: Decrypt, not an encrypted core dump")
+	}
+	recipient := header[len(cseMagic) : len(cseMagic)+cseKeySize]
+	if !bytes.Equal(recipient, identity.PublicKey().Bytes()) {
+		return fmt.Errorf("failed: Decrypt, encrypted for another key (%v)", base64.StdEncoding.EncodeToString(recipient))
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(header[len(cseMagic)+cseKeySize : len(cseMagic)+cseKeySize*2])
+	if err != nil {
+		return fmt.Errorf("failed: Decrypt, NewPublicKey, err=%v", err)
+	}
+	shared, err := identity.ECDH(ephemeral)
+	if err != nil {
+		return fmt.Errorf("failed: Decrypt, ECDH, err=%v", err)
+	}
+	aead, err := newCseAEAD(shared, header)
+	if err != nil {
+		return fmt.Errorf("failed: Decrypt, newCseAEAD, err=%v", err)
+	}
+	buf := make([]byte, cseChunkSize+aead.Overhead())
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(r, buf)
+		last := false
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			last = true
+		} else if err != nil {
+			return fmt.Errorf("failed: Decrypt, ReadFull, err=%v", err)
+		}
+		plain, err := aead.Open(buf[:0], cseNonce(counter, last), buf[:n], nil)
+		if err != nil {
+			return fmt.Errorf("failed: Decrypt, corrupted or truncated chunk %v", counter)
+		}
+		if _, err := w.Write(plain); err != nil {
+			return fmt.Errorf("failed: Decrypt, Write, err=%v", err)
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// EncryptFile encrypts f into workDir. It reuses a complete file for the same recipient so that multipart uploads can resume after restarts.
+// Callers remove the returned file after uploads.
+func EncryptFile(f *os.File, recipient *ecdh.PublicKey, workDir string) (*os.File, error) {
+	encPath := filepath.Join(workDir, filepath.Base(f.Name())+cseSuffix)
+	if ef, err := os.Open(encPath); err == nil {
+		r, err := ReadRecipient(ef)
+		if err == nil && bytes.Equal(r, recipient.Bytes()) {
+			if _, err := ef.Seek(0, io.SeekStart); err == nil {
+				return ef, nil
+			}
+		}
+		ef.Close()
+		log.Printf("INFO: EncryptFile, re-encrypt %v", encPath)
+	}
+	if err := os.MkdirAll(workDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed: EncryptFile, MkdirAll, workDir=%v, err=%v", workDir, err)
+	}
+	tmpPath := encPath + ".tmp"
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed: EncryptFile, OpenFile, tmpPath=%v, err=%v", tmpPath, err)
+	}
+	err = func() error {
+		w, err := NewEncryptWriter(out, recipient)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(f, 0, 1<<62)); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		return out.Sync()
+	}()
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, encPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed: EncryptFile, f.Name()=%v, encPath=%v, err=%v", f.Name(), encPath, err)
+	}
+	ef, err := os.Open(encPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed: EncryptFile, Open, encPath=%v, err=%v", encPath, err)
+	}
+	return ef, nil
+}
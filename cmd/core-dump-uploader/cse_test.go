@@ -0,0 +1,136 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func NewTestIdentity(t *testing.T) (identity string, publicKey string) {
+	var buf bytes.Buffer
+	key, err := WriteIdentity(&buf)
+	if err != nil {
+		t.Fatalf("Failed: WriteIdentity, err=%v", err)
+	}
+	return buf.String(), base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+}
+
+func TestParseKeys(t *testing.T) {
+	identity, publicKey := NewTestIdentity(t)
+	key, err := ParseIdentity(strings.NewReader(identity))
+	assert.Equal(t, nil, err)
+	pub, err := ParsePublicKey(publicKey + "\n")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, pub.Bytes(), key.PublicKey().Bytes())
+
+	_, err = ParseIdentity(strings.NewReader("# comment only\n"))
+	assert.NotEqual(t, nil, err)
+	_, err = ParseIdentity(strings.NewReader("not base64\n"))
+	assert.NotEqual(t, nil, err)
+	_, err = ParsePublicKey(base64.StdEncoding.EncodeToString([]byte("short")))
+	assert.NotEqual(t, nil, err)
+	_, err = ParsePublicKey("age1xxxxxxxx")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	identity, publicKey := NewTestIdentity(t)
+	key, _ := ParseIdentity(strings.NewReader(identity))
+	pub, _ := ParsePublicKey(publicKey)
+	for _, size := range []int{0, 1, cseChunkSize - 1, cseChunkSize, cseChunkSize + 1, cseChunkSize*3 + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		var enc bytes.Buffer
+		w, err := NewEncryptWriter(&enc, pub)
+		if !assert.Equal(t, nil, err) {
+			return
+		}
+		// write in odd sizes to cross chunk boundaries
+		for p := plain; len(p) > 0; {
+			l := 1000
+			if l > len(p) {
+				l = len(p)
+			}
+			w.Write(p[:l])
+			p = p[l:]
+		}
+		assert.Equal(t, nil, w.Close())
+		ciphertext := enc.Bytes()
+
+		var dec bytes.Buffer
+		assert.Equal(t, nil, Decrypt(&dec, bytes.NewReader(ciphertext), key), "size=%v", size)
+		assert.Equal(t, true, bytes.Equal(plain, dec.Bytes()), "size=%v", size)
+
+		// truncated
+		if len(ciphertext) > cseHeaderSize+16 {
+			assert.NotEqual(t, nil, Decrypt(&bytes.Buffer{}, bytes.NewReader(ciphertext[:len(ciphertext)-16]), key), "size=%v", size)
+		}
+		// tampered
+		tampered := append([]byte{}, ciphertext...)
+		tampered[len(tampered)-1] ^= 1
+		assert.NotEqual(t, nil, Decrypt(&bytes.Buffer{}, bytes.NewReader(tampered), key), "size=%v", size)
+	}
+
+	// another key
+	other, _ := NewTestIdentity(t)
+	otherKey, _ := ParseIdentity(strings.NewReader(other))
+	var enc bytes.Buffer
+	w, _ := NewEncryptWriter(&enc, pub)
+	w.Write([]byte("core"))
+	w.Close()
+	assert.NotEqual(t, nil, Decrypt(&bytes.Buffer{}, bytes.NewReader(enc.Bytes()), otherKey))
+	assert.NotEqual(t, nil, Decrypt(&bytes.Buffer{}, strings.NewReader("PK\x03\x04 not encrypted"), key))
+}
+
+func TestEncryptFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	workDir := filepath.Join(tmpDir, "uploads")
+	identity, publicKey := NewTestIdentity(t)
+	key, _ := ParseIdentity(strings.NewReader(identity))
+	pub, _ := ParsePublicKey(publicKey)
+
+	filePath := filepath.Join(tmpDir, "a.zip")
+	plain := CreateTestFile(t, filePath, cseChunkSize*2+5)
+	f, err := os.Open(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+	ef, err := EncryptFile(f, pub, workDir)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	assert.Equal(t, filepath.Join(workDir, "a.zip.enc"), ef.Name())
+	var dec bytes.Buffer
+	assert.Equal(t, nil, Decrypt(&dec, ef, key))
+	assert.Equal(t, true, bytes.Equal(plain, dec.Bytes()))
+	ef.Close()
+	before, _ := os.ReadFile(filepath.Join(workDir, "a.zip.enc"))
+
+	// reused for the same recipient to resume uploads
+	ef, err = EncryptFile(f, pub, workDir)
+	assert.Equal(t, nil, err)
+	ef.Close()
+	after, _ := os.ReadFile(filepath.Join(workDir, "a.zip.enc"))
+	assert.Equal(t, true, bytes.Equal(before, after))
+
+	// re-encrypted for a new recipient
+	_, publicKey2 := NewTestIdentity(t)
+	pub2, _ := ParsePublicKey(publicKey2)
+	ef, err = EncryptFile(f, pub2, workDir)
+	assert.Equal(t, nil, err)
+	ef.Close()
+	after, _ = os.ReadFile(filepath.Join(workDir, "a.zip.enc"))
+	assert.Equal(t, false, bytes.Equal(before, after))
+}
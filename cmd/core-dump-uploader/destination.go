@@ -0,0 +1,63 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Destination stores core dumps. Implementations are selected with type in core-dump-handler secrets.
+type Destination interface {
+	// Prepare checks and creates containers of objects such as buckets before Put
+	Prepare() error
+	Put(key string, f *os.File, opts *ObjectOptions) error
+}
+
+// DestinationFactory parses entries of a core-dump-handler secret in namespace. Errors are configuration errors.
+type DestinationFactory func(namespace string, data map[string][]byte) (Destination, error)
+
+// SecretGetter reads a secret that a core-dump-handler secret refers to in the same namespace
+type SecretGetter func(namespace string, name string) (map[string][]byte, error)
+
+type DestinationRegistry struct {
+	lock      sync.RWMutex
+	factories map[string]DestinationFactory
+}
+
+func NewDestinationRegistry() *DestinationRegistry {
+	return &DestinationRegistry{factories: make(map[string]DestinationFactory)}
+}
+
+func (r *DestinationRegistry) Register(destType string, factory DestinationFactory) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.factories[destType] = factory
+}
+
+func (r *DestinationRegistry) GetTypes() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ret := make([]string, 0, len(r.factories))
+	for destType := range r.factories {
+		ret = append(ret, destType)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (r *DestinationRegistry) NewDestination(destType string, namespace string, data map[string][]byte) (Destination, error) {
+	r.lock.RLock()
+	factory, ok := r.factories[destType]
+	r.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("failed: NewDestination, malformed core-dump-handler secret, unknown type=%v (valid: %v)", destType, strings.Join(r.GetTypes(), ", "))
+	}
+	return factory(namespace, data)
+}
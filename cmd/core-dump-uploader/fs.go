@@ -0,0 +1,306 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DestinationTypeFs = "fs"
+	fsTmpSuffix       = ".tmp"
+	fsMetadataSuffix  = ".metadata.json"
+)
+
+// FsDestinationSecret is configured with entries of core-dump-handler secrets with type=fs
+type FsDestinationSecret struct {
+	// Path is relative to the directory of the namespace under --fsRoot
+	Path string
+	// Uid and Gid are -1 to keep the owner of the uploader. Tenants cannot choose root (0).
+	Uid      int
+	Gid      int
+	FileMode os.FileMode
+	DirMode  os.FileMode
+}
+
+func parseFileMode(data map[string][]byte, ent string, defaultMode os.FileMode) (os.FileMode, error) {
+	v, ok := data[ent]
+	if !ok || len(v) == 0 {
+		return defaultMode, nil
+	}
+	mode, err := strconv.ParseUint(string(v), 8, 32)
+	if err != nil || mode&^0777 != 0 {
+		return 0, fmt.Errorf("failed: NewFsDestinationSecret, malformed core-dump-handler secret, %v must be octal permissions, %v", ent, string(v))
+	}
+	return os.FileMode(mode), nil
+}
+
+func parseId(data map[string][]byte, ent string) (int, error) {
+	v, ok := data[ent]
+	if !ok || len(v) == 0 {
+		return -1, nil
+	}
+	id, err := strconv.Atoi(string(v))
+	if err != nil || id <= 0 {
+		return -1, fmt.Errorf("failed: NewFsDestinationSecret, malformed core-dump-handler secret, %v must be a positive integer, %v", ent, string(v))
+	}
+	return id, nil
+}
+
+func NewFsDestinationSecret(data map[string][]byte) (*FsDestinationSecret, error) {
+	path := string(data["path"])
+	if filepath.IsAbs(path) {
+		return nil, fmt.Errorf("failed: NewFsDestinationSecret, malformed core-dump-handler secret, path must be relative, %v", path)
+	}
+	for _, element := range strings.Split(path, "/") {
+		if element == ".." {
+			return nil, fmt.Errorf("failed: NewFsDestinationSecret, malformed core-dump-handler secret, path must not contain .., %v", path)
+		}
+	}
+	c := &FsDestinationSecret{Path: filepath.Clean(path)}
+	var err error
+	if c.Uid, err = parseId(data, "uid"); err != nil {
+		return nil, err
+	}
+	if c.Gid, err = parseId(data, "gid"); err != nil {
+		return nil, err
+	}
+	if c.FileMode, err = parseFileMode(data, "fileMode", 0640); err != nil {
+		return nil, err
+	}
+	if c.DirMode, err = parseFileMode(data, "dirMode", 0750); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// FsDestination writes files into a directory tree such as an NFS share mounted on nodes
+type FsDestination struct {
+	c    *FsDestinationSecret
+	root string
+	// namespaceDir is <root>/<namespace> and baseDir is <namespaceDir>/<path>
+	namespaceDir string
+	baseDir      string
+	// quota is the maximum total size in bytes of files under namespaceDir. 0 is unlimited.
+	quota int64
+	// lock serializes quota checks and writes to namespaceDir in this uploader. Uploaders on other nodes are not serialized.
+	lock *sync.Mutex
+}
+
+// NewFsDestinationFactory allows each namespace to write only under <root>/<namespace> up to quota bytes (--fsQuota)
+func NewFsDestinationFactory(root string, quota int64) DestinationFactory {
+	var locks sync.Map
+	root = filepath.Clean(root)
+	return func(namespace string, data map[string][]byte) (Destination, error) {
+		c, err := NewFsDestinationSecret(data)
+		if err != nil {
+			return nil, err
+		}
+		namespaceDir := filepath.Join(root, SanitizeKeyElement(namespace))
+		baseDir := filepath.Join(namespaceDir, c.Path)
+		lock, _ := locks.LoadOrStore(namespaceDir, &sync.Mutex{})
+		return &FsDestination{
+			c: c, root: root, namespaceDir: namespaceDir, baseDir: baseDir, quota: quota, lock: lock.(*sync.Mutex),
+		}, nil
+	}
+}
+
+// OpenDir opens dir under root and creates missing directories with DirMode and the owner in the secret.
+// Each element is opened relative to its parent with O_NOFOLLOW since tenants can plant symlinks on shared mounts.
+func (d *FsDestination) OpenDir(dir string) (*os.File, error) {
+	rel, err := filepath.Rel(d.root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return nil, fmt.Errorf("failed: FsDestination.OpenDir, %v is not under %v", dir, d.root)
+	}
+	fd, err := unix.Open(d.root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed: FsDestination.OpenDir, Open, root=%v, err=%v", d.root, err)
+	}
+	current := d.root
+	for _, element := range strings.Split(rel, string(filepath.Separator)) {
+		if element == "." {
+			continue
+		}
+		current = filepath.Join(current, element)
+		created := true
+		if err := unix.Mkdirat(fd, element, uint32(d.c.DirMode)); err != nil {
+			if err != unix.EEXIST {
+				unix.Close(fd)
+				return nil, fmt.Errorf("failed: FsDestination.OpenDir, Mkdirat, dir=%v, err=%v", current, err)
+			}
+			created = false
+		}
+		next, err := unix.Openat(fd, element, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if err != nil {
+			return nil, fmt.Errorf("failed: FsDestination.OpenDir, %v is not a directory, err=%v", current, err)
+		}
+		fd = next
+		if !created {
+			continue
+		}
+		// Mkdirat is affected by umask
+		if err := unix.Fchmod(fd, uint32(d.c.DirMode)); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("failed: FsDestination.OpenDir, Fchmod, dir=%v, err=%v", current, err)
+		}
+		if err := unix.Fchown(fd, d.c.Uid, d.c.Gid); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("failed: FsDestination.OpenDir, Fchown, dir=%v, err=%v", current, err)
+		}
+	}
+	return os.NewFile(uintptr(fd), current), nil
+}
+
+// Prepare requires the root directory to exist since it is usually a mount point
+func (d *FsDestination) Prepare() error {
+	if stat, err := os.Stat(d.root); err != nil || !stat.IsDir() {
+		return fmt.Errorf("failed: FsDestination.Prepare, root=%v is not a directory, err=%v", d.root, err)
+	}
+	dir, err := d.OpenDir(d.baseDir)
+	if err != nil {
+		return err
+	}
+	return dir.Close()
+}
+
+// GetUsage returns the total size of regular files of the namespace
+func (d *FsDestination) GetUsage() (int64, error) {
+	usage := int64(0)
+	err := filepath.WalkDir(d.namespaceDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		usage += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed: FsDestination.GetUsage, namespaceDir=%v, err=%v", d.namespaceDir, err)
+	}
+	return usage, nil
+}
+
+// WriteFile writes r into a temporary file in dir and renames it to name so that readers never see partial files.
+// Both files are opened relative to dir without following symlinks.
+func (d *FsDestination) WriteFile(dir *os.File, name string, r io.Reader) error {
+	dirFd := int(dir.Fd())
+	filePath := filepath.Join(dir.Name(), name)
+	var tmp *os.File = nil
+	tmpName := ""
+	for i := 0; tmp == nil; i++ {
+		tmpName = "." + name + "." + strconv.FormatUint(uint64(rand.Uint32()), 10) + fsTmpSuffix
+		fd, err := unix.Openat(dirFd, tmpName, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+		if err == unix.EEXIST && i < 100 {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed: FsDestination.WriteFile, Openat, filePath=%v, err=%v", filePath, err)
+		}
+		tmp = os.NewFile(uintptr(fd), filepath.Join(dir.Name(), tmpName))
+	}
+	tmpPath := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			unix.Unlinkat(dirFd, tmpName, 0)
+		}
+	}()
+	if _, err := io.Copy(tmp, r); err != nil {
+		return fmt.Errorf("failed: FsDestination.WriteFile, Copy, filePath=%v, err=%v", tmpPath, err)
+	}
+	if err := tmp.Chmod(d.c.FileMode); err != nil {
+		return fmt.Errorf("failed: FsDestination.WriteFile, Chmod, filePath=%v, err=%v", tmpPath, err)
+	}
+	if err := tmp.Chown(d.c.Uid, d.c.Gid); err != nil {
+		return fmt.Errorf("failed: FsDestination.WriteFile, Chown, filePath=%v, err=%v", tmpPath, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed: FsDestination.WriteFile, Sync, filePath=%v, err=%v", tmpPath, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed: FsDestination.WriteFile, Close, filePath=%v, err=%v", tmpPath, err)
+	}
+	// rename replaces symlinks at name instead of following them
+	if err := unix.Renameat(dirFd, tmpName, dirFd, name); err != nil {
+		return fmt.Errorf("failed: FsDestination.WriteFile, Renameat, filePath=%v, err=%v", filePath, err)
+	}
+	committed = true
+	dir.Sync()
+	return nil
+}
+
+// Put writes f to <root>/<namespace>/<path>/<key> and metadata to <key>.metadata.json if the quota allows
+func (d *FsDestination) Put(key string, f *os.File, opts *ObjectOptions) error {
+	filePath := filepath.Join(d.baseDir, filepath.FromSlash(key))
+	if rel, err := filepath.Rel(d.baseDir, filePath); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("failed: FsDestination.Put, key=%v is not under %v", key, d.baseDir)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed: FsDestination.Put, Stat, f.Name()=%v, err=%v", f.Name(), err)
+	}
+	var metadata []byte = nil
+	if opts != nil && len(opts.Metadata) > 0 {
+		if metadata, err = json.Marshal(opts.Metadata); err != nil {
+			return fmt.Errorf("failed: FsDestination.Put, Marshal, err=%v", err)
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.quota > 0 {
+		usage, err := d.GetUsage()
+		if err != nil {
+			return err
+		}
+		if usage+stat.Size()+int64(len(metadata)) > d.quota {
+			return fmt.Errorf("failed: FsDestination.Put, quota exceeded, namespaceDir=%v, usage=%v, size=%v, quota=%v", d.namespaceDir, usage, stat.Size(), d.quota)
+		}
+	}
+	dir, err := d.OpenDir(filepath.Dir(filePath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	name := filepath.Base(filePath)
+	// readers can expect metadata when core dumps appear
+	if metadata != nil {
+		if err := d.WriteFile(dir, name+fsMetadataSuffix, strings.NewReader(string(metadata))); err != nil {
+			return err
+		}
+	}
+	if err := d.WriteFile(dir, name, io.NewSectionReader(f, 0, stat.Size())); err != nil {
+		return err
+	}
+	log.Printf("INFO: FsDestination.Put: %v->%v", f.Name(), filePath)
+	return nil
+}
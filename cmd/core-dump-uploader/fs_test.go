@@ -0,0 +1,141 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFsDestinationSecret(t *testing.T) {
+	c, err := NewFsDestinationSecret(map[string][]byte{"path": []byte("cores/"), "uid": []byte("1000"), "fileMode": []byte("0600")})
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "cores", c.Path)
+		assert.Equal(t, 1000, c.Uid)
+		assert.Equal(t, -1, c.Gid)
+		assert.Equal(t, os.FileMode(0600), c.FileMode)
+		assert.Equal(t, os.FileMode(0750), c.DirMode)
+	}
+	c, err = NewFsDestinationSecret(map[string][]byte{})
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, ".", c.Path)
+	}
+	for _, data := range []map[string][]byte{
+		{"path": []byte("../etc")}, {"path": []byte("a/../../b")}, {"path": []byte("a/..")}, {"path": []byte("/other/cores")}, {"uid": []byte("-1")}, {"uid": []byte("0")}, {"gid": []byte("0")},
+		{"gid": []byte("root")}, {"fileMode": []byte("0999")}, {"dirMode": []byte("01777")},
+	} {
+		_, err = NewFsDestinationSecret(data)
+		assert.NotEqual(t, nil, err, "data=%v", data)
+	}
+}
+
+func TestFsDestination(t *testing.T) {
+	root := t.TempDir()
+	tmpDir := t.TempDir()
+	r := NewDestinationRegistry()
+	r.Register(DestinationTypeFs, NewFsDestinationFactory(root, 4096))
+
+	// quota in secrets is ignored since tenants own them
+	data := map[string][]byte{"type": []byte(DestinationTypeFs), "path": []byte("cores"), "dirMode": []byte("0755"), "quota": []byte("1Gi")}
+	d, err := r.NewDestination(DestinationTypeFs, "test", data)
+	if !assert.Equal(t, nil, err) || !assert.Equal(t, nil, d.Prepare()) {
+		return
+	}
+	stat, err := os.Stat(filepath.Join(root, "test", "cores"))
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, os.FileMode(0755), stat.Mode().Perm())
+	}
+
+	filePath := filepath.Join(tmpDir, "a.zip")
+	expected := CreateTestFile(t, filePath, 1024)
+	f, err := os.Open(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+	opts := &ObjectOptions{Metadata: map[string]string{"namespace": "test", "pod-name": "app-0"}}
+	if assert.Equal(t, nil, d.Put("ns/a.zip", f, opts)) {
+		dest := filepath.Join(root, "test", "cores", "ns", "a.zip")
+		buf, err := os.ReadFile(dest)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, bytes.Equal(expected, buf))
+		stat, err := os.Stat(dest)
+		if assert.Equal(t, nil, err) {
+			assert.Equal(t, os.FileMode(0640), stat.Mode().Perm())
+		}
+		metadata := make(map[string]string)
+		buf, err = os.ReadFile(dest + fsMetadataSuffix)
+		if assert.Equal(t, nil, err) && assert.Equal(t, nil, json.Unmarshal(buf, &metadata)) {
+			assert.Equal(t, opts.Metadata, metadata)
+		}
+		// no temporary files are left
+		entries, err := os.ReadDir(filepath.Dir(dest))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 2, len(entries))
+	}
+
+	// overwrites are atomic and keep one file
+	assert.Equal(t, nil, d.Put("ns/a.zip", f, nil))
+	assert.Equal(t, nil, d.Put("ns/b.zip", f, nil))
+	assert.Equal(t, nil, d.Put("ns/c.zip", f, nil))
+	err = d.Put("ns/d.zip", f, nil)
+	if assert.NotEqual(t, nil, err) {
+		assert.Contains(t, err.Error(), "quota exceeded")
+	}
+	_, err = os.Stat(filepath.Join(root, "test", "cores", "ns", "d.zip"))
+	assert.Equal(t, true, os.IsNotExist(err))
+
+	// quotas count all paths of a namespace
+	d, err = r.NewDestination(DestinationTypeFs, "test", map[string][]byte{"path": []byte("more")})
+	if assert.Equal(t, nil, err) {
+		assert.NotEqual(t, nil, d.Put("ns/d.zip", f, nil))
+	}
+
+	// quotas are per namespace
+	d, err = r.NewDestination(DestinationTypeFs, "other", data)
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, nil, d.Prepare())
+		assert.Equal(t, nil, d.Put("ns/d.zip", f, nil))
+		_, err = os.Stat(filepath.Join(root, "other", "cores", "ns", "d.zip"))
+		assert.Equal(t, nil, err)
+	}
+
+	// keys cannot escape the directory of the namespace
+	assert.NotEqual(t, nil, d.Put("../../test/cores/ns/e.zip", f, nil))
+	_, err = os.Stat(filepath.Join(root, "test", "cores", "ns", "e.zip"))
+	assert.Equal(t, true, os.IsNotExist(err))
+
+	// symlinks planted on the shared mount are not followed
+	outside := t.TempDir()
+	assert.Equal(t, nil, os.Symlink(outside, filepath.Join(root, "other", "cores", "link")))
+	assert.NotEqual(t, nil, d.Put("link/f.zip", f, nil))
+	assert.Equal(t, nil, os.Symlink(outside, filepath.Join(root, "linked")))
+	d2, err := r.NewDestination(DestinationTypeFs, "linked", data)
+	if assert.Equal(t, nil, err) {
+		assert.NotEqual(t, nil, d2.Prepare())
+		assert.NotEqual(t, nil, d2.Put("ns/f.zip", f, nil))
+	}
+	assert.Equal(t, nil, os.Symlink(filepath.Join(outside, "f.zip"), filepath.Join(root, "other", "cores", "ns", "f.zip")))
+	assert.Equal(t, nil, d.Put("ns/f.zip", f, nil))
+	stat, err = os.Lstat(filepath.Join(root, "other", "cores", "ns", "f.zip"))
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, true, stat.Mode().IsRegular())
+	}
+	entries, _ := os.ReadDir(outside)
+	assert.Equal(t, 0, len(entries))
+
+	// Prepare fails if the root is not mounted
+	r.Register(DestinationTypeFs, NewFsDestinationFactory(filepath.Join(root, "notfound"), 0))
+	d, err = r.NewDestination(DestinationTypeFs, "test", data)
+	if assert.Equal(t, nil, err) {
+		assert.NotEqual(t, nil, d.Prepare())
+	}
+}
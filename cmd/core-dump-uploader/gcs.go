@@ -0,0 +1,237 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+const (
+	DestinationTypeGcs = "gcs"
+	gcsDefaultEndpoint = "https://storage.googleapis.com"
+	gcsDefaultTokenUri = "https://oauth2.googleapis.com/token"
+	// GcsChunkAlignment is the unit of chunks in resumable uploads
+	GcsChunkAlignment = 256 * 1024
+)
+
+// GcsServiceAccount is a subset of a service account key file
+type GcsServiceAccount struct {
+	ProjectId   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenUri    string `json:"token_uri"`
+}
+
+// GcsDestinationSecret is configured with entries of core-dump-handler secrets with type=gcs
+type GcsDestinationSecret struct {
+	Bucket string
+	// ServiceAccount is nil for emulators such as fake-gcs-server
+	ServiceAccount     *GcsServiceAccount
+	ServiceAccountJson []byte
+	ProjectId          string
+	Endpoint           string
+	CreateBucket       bool
+}
+
+func ParseRsaPrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, fmt.Errorf("failed: ParseRsaPrivateKey, no PEM block")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed: ParseRsaPrivateKey, ParsePKCS8PrivateKey, err=%v", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("failed: ParseRsaPrivateKey, not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+func NewGcsDestinationSecret(data map[string][]byte) (*GcsDestinationSecret, error) {
+	if len(data["bucket"]) == 0 {
+		return nil, fmt.Errorf("failed: NewGcsDestinationSecret, malformed core-dump-handler secret, missing entries=bucket")
+	}
+	c := &GcsDestinationSecret{
+		Bucket: string(data["bucket"]), ProjectId: string(data["projectId"]), Endpoint: strings.TrimSuffix(string(data["endpoint"]), "/"),
+	}
+	if v, ok := data["serviceAccountJson"]; ok && len(v) > 0 {
+		var sa GcsServiceAccount
+		if err := json.Unmarshal(v, &sa); err != nil {
+			return nil, fmt.Errorf("failed: NewGcsDestinationSecret, malformed core-dump-handler secret, cannot parse serviceAccountJson, err=%v", err)
+		}
+		if sa.ClientEmail == "" {
+			return nil, fmt.Errorf("failed: NewGcsDestinationSecret, malformed core-dump-handler secret, serviceAccountJson has no client_email")
+		}
+		if _, err := ParseRsaPrivateKey(sa.PrivateKey); err != nil {
+			return nil, fmt.Errorf("failed: NewGcsDestinationSecret, malformed core-dump-handler secret, serviceAccountJson, %v", err)
+		}
+		if sa.TokenUri == "" {
+			sa.TokenUri = gcsDefaultTokenUri
+		}
+		c.ServiceAccount, c.ServiceAccountJson = &sa, v
+		if c.ProjectId == "" {
+			c.ProjectId = sa.ProjectId
+		}
+	} else if c.Endpoint == "" {
+		return nil, fmt.Errorf("failed: NewGcsDestinationSecret, malformed core-dump-handler secret, serviceAccountJson is required without endpoint")
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = gcsDefaultEndpoint
+	}
+	if v, ok := data["createBucket"]; ok {
+		createBucket, err := strconv.ParseBool(string(v))
+		if err != nil {
+			return nil, fmt.Errorf("failed: NewGcsDestinationSecret, malformed core-dump-handler secret, cannot parse bool createBucket, %v", v)
+		}
+		c.CreateBucket = createBucket
+	}
+	if c.CreateBucket && c.ProjectId == "" {
+		return nil, fmt.Errorf("failed: NewGcsDestinationSecret, malformed core-dump-handler secret, createBucket requires projectId")
+	}
+	return c, nil
+}
+
+// GcsDestination uploads objects with resumable uploads of cloud.google.com/go/storage
+type GcsDestination struct {
+	c         *GcsDestinationSecret
+	client    *storage.Client
+	multipart MultipartConfig
+}
+
+func NewGcsDestinationFactory(multipart MultipartConfig, httpClient *http.Client) DestinationFactory {
+	return func(namespace string, data map[string][]byte) (Destination, error) {
+		c, err := NewGcsDestinationSecret(data)
+		if err != nil {
+			return nil, err
+		}
+		client, err := NewGcsClient(c, httpClient)
+		if err != nil {
+			return nil, err
+		}
+		return &GcsDestination{c: c, client: client, multipart: multipart}, nil
+	}
+}
+
+// NewGcsClient authorizes requests with the service account. Requests to emulators are not authorized.
+func NewGcsClient(c *GcsDestinationSecret, httpClient *http.Client) (*storage.Client, error) {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+	client := httpClient
+	if c.ServiceAccount != nil {
+		creds, err := google.CredentialsFromJSON(ctx, c.ServiceAccountJson, storage.ScopeReadWrite)
+		if err != nil {
+			return nil, fmt.Errorf("failed: NewGcsClient, CredentialsFromJSON, err=%v", err)
+		}
+		client = oauth2.NewClient(ctx, creds.TokenSource)
+		client.Timeout = httpClient.Timeout
+	}
+	opts := []option.ClientOption{option.WithHTTPClient(client)}
+	if c.Endpoint != gcsDefaultEndpoint {
+		opts = append(opts, option.WithEndpoint(c.Endpoint+"/storage/v1/"))
+	}
+	ret, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed: NewGcsClient, NewClient, endpoint=%v, err=%v", c.Endpoint, err)
+	}
+	return ret, nil
+}
+
+// Prepare creates the bucket if it does not exist and createBucket is true
+func (d *GcsDestination) Prepare() error {
+	bucket := d.client.Bucket(d.c.Bucket)
+	_, err := bucket.Attrs(context.Background())
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, storage.ErrBucketNotExist) || !d.c.CreateBucket {
+		return fmt.Errorf("failed: GcsDestination.Prepare, Attrs, bucket=%v, err=%v", d.c.Bucket, err)
+	}
+	err = bucket.Create(context.Background(), d.c.ProjectId, nil)
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusConflict {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed: GcsDestination.Prepare, Create, bucket=%v, err=%v", d.c.Bucket, err)
+	}
+	log.Printf("INFO: GcsDestination.Prepare, created bucket=%v", d.c.Bucket)
+	return nil
+}
+
+// GetGcsChunkSize rounds partSize up to a multiple of GcsChunkAlignment as resumable uploads require
+func GetGcsChunkSize(partSize int64) int64 {
+	if partSize < GcsChunkAlignment {
+		return GcsChunkAlignment
+	}
+	return (partSize + GcsChunkAlignment - 1) / GcsChunkAlignment * GcsChunkAlignment
+}
+
+// NewGcsRetryer retries failed requests of an upload up to multipart.MaxAttempts-1 times in total.
+// Uploads are retried although they have no preconditions since they overwrite the same object.
+func (d *GcsDestination) NewGcsRetryer() storage.RetryOption {
+	var lock sync.Mutex
+	retries := 0
+	return storage.WithErrorFunc(func(err error) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		if !storage.ShouldRetry(err) || retries+1 >= d.multipart.MaxAttempts {
+			return false
+		}
+		retries += 1
+		log.Printf("WARN: GcsDestination.Put, retry bucket=%v, attempt=%v, err=%v", d.c.Bucket, retries, err)
+		return true
+	})
+}
+
+// Put uploads f in chunks of --partSize. Upload sessions are not persisted, so uploads restart from the beginning after restarts.
+func (d *GcsDestination) Put(key string, f *os.File, opts *ObjectOptions) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed: GcsDestination.Put, Stat, f.Name()=%v, err=%v", f.Name(), err)
+	}
+	size := stat.Size()
+	obj := d.client.Bucket(d.c.Bucket).Object(key).Retryer(storage.WithPolicy(storage.RetryAlways), d.NewGcsRetryer())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := obj.NewWriter(ctx)
+	w.ChunkSize = int(GetGcsChunkSize(d.multipart.GetPartSize(size)))
+	if opts != nil && len(opts.Metadata) > 0 {
+		w.Metadata = opts.Metadata
+	}
+	if _, err := io.Copy(w, io.NewSectionReader(f, 0, size)); err != nil {
+		// cancel the upload before Close
+		cancel()
+		w.Close()
+		return fmt.Errorf("failed: GcsDestination.Put, Write, bucket=%v, key=%v, err=%v", d.c.Bucket, key, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed: GcsDestination.Put, Close, bucket=%v, key=%v, err=%v", d.c.Bucket, key, err)
+	}
+	log.Printf("INFO: GcsDestination.Put: %v->gs://%v/%v", f.Name(), d.c.Bucket, key)
+	return nil
+}
@@ -0,0 +1,350 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeGcsUpload struct {
+	bucket   string
+	key      string
+	size     int64
+	metadata map[string]string
+	data     []byte
+}
+
+// FakeGcsServer implements the token endpoint and a subset of JSON APIs for buckets and resumable uploads.
+// It does not check access tokens if publicKey is nil like emulators.
+type FakeGcsServer struct {
+	lock       sync.Mutex
+	server     *httptest.Server
+	publicKey  *rsa.PublicKey
+	buckets    map[string]bool
+	objects    map[string][]byte
+	metadata   map[string]map[string]string
+	uploads    map[string]*fakeGcsUpload
+	nextId     int
+	chunkCalls int
+	failChunks int
+	tokenCalls int
+	authFails  int
+}
+
+func NewFakeGcsServer(publicKey *rsa.PublicKey) *FakeGcsServer {
+	f := &FakeGcsServer{
+		publicKey: publicKey, buckets: make(map[string]bool), objects: make(map[string][]byte),
+		metadata: make(map[string]map[string]string), uploads: make(map[string]*fakeGcsUpload),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.ServeHTTP))
+	return f
+}
+
+func (f *FakeGcsServer) Close() {
+	f.server.Close()
+}
+
+func writeGcsError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, status, message)
+}
+
+func (f *FakeGcsServer) VerifyJwt(assertion string) bool {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	return rsa.VerifyPKCS1v15(f.publicKey, crypto.SHA256, sum[:], sig) == nil
+}
+
+func (f *FakeGcsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if r.URL.Path == "/token" {
+		f.tokenCalls += 1
+		if r.ParseForm() != nil || !f.VerifyJwt(r.PostForm.Get("assertion")) {
+			writeGcsError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"token","expires_in":3600,"token_type":"Bearer"}`)
+		return
+	}
+	query := r.URL.Query()
+	if f.publicKey != nil && query.Get("upload_id") == "" && r.Header.Get("Authorization") != "Bearer token" {
+		f.authFails += 1
+		writeGcsError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/storage/v1/b/"):
+		if !f.buckets[strings.TrimPrefix(r.URL.Path, "/storage/v1/b/")] {
+			writeGcsError(w, http.StatusNotFound, "The specified bucket does not exist.")
+			return
+		}
+		fmt.Fprint(w, "{}")
+	case r.Method == http.MethodPost && r.URL.Path == "/storage/v1/b":
+		var v struct {
+			Name string `json:"name"`
+		}
+		if json.Unmarshal(body, &v) != nil || query.Get("project") == "" {
+			writeGcsError(w, http.StatusBadRequest, "invalid")
+			return
+		}
+		if f.buckets[v.Name] {
+			writeGcsError(w, http.StatusConflict, "You already own this bucket.")
+			return
+		}
+		f.buckets[v.Name] = true
+		fmt.Fprint(w, "{}")
+	case r.Method == http.MethodPost && query.Get("uploadType") == "multipart":
+		// clients upload objects smaller than a chunk with a single request
+		f.chunkCalls += 1
+		if f.failChunks > 0 {
+			f.failChunks -= 1
+			writeGcsError(w, http.StatusServiceUnavailable, "unavailable")
+			return
+		}
+		bucket := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/o")
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if !f.buckets[bucket] || err != nil {
+			writeGcsError(w, http.StatusBadRequest, "invalid")
+			return
+		}
+		var v struct {
+			Name     string            `json:"name"`
+			Metadata map[string]string `json:"metadata"`
+		}
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		resource, err := mr.NextPart()
+		if err != nil || json.NewDecoder(resource).Decode(&v) != nil {
+			writeGcsError(w, http.StatusBadRequest, "invalid")
+			return
+		}
+		media, err := mr.NextPart()
+		if err != nil {
+			writeGcsError(w, http.StatusBadRequest, "invalid")
+			return
+		}
+		data, _ := io.ReadAll(media)
+		f.objects[bucket+"/"+v.Name] = data
+		f.metadata[bucket+"/"+v.Name] = v.Metadata
+		fmt.Fprintf(w, `{"bucket":%q,"name":%q}`, bucket, v.Name)
+	case r.Method == http.MethodPost && query.Get("uploadType") == "resumable" && query.Get("upload_id") == "":
+		bucket := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/o")
+		if !f.buckets[bucket] {
+			writeGcsError(w, http.StatusNotFound, "The specified bucket does not exist.")
+			return
+		}
+		var v struct {
+			Name     string            `json:"name"`
+			Metadata map[string]string `json:"metadata"`
+		}
+		json.Unmarshal(body, &v)
+		f.nextId += 1
+		id := strconv.Itoa(f.nextId)
+		f.uploads[id] = &fakeGcsUpload{bucket: bucket, key: v.Name, size: -1, metadata: v.Metadata}
+		w.Header().Set("Location", f.server.URL+r.URL.Path+"?uploadType=resumable&upload_id="+id)
+	case query.Get("upload_id") != "":
+		// chunks are sent with POST or PUT
+		upload, ok := f.uploads[query.Get("upload_id")]
+		if !ok {
+			writeGcsError(w, http.StatusNotFound, "No such upload")
+			return
+		}
+		f.chunkCalls += 1
+		if f.failChunks > 0 {
+			f.failChunks -= 1
+			writeGcsError(w, http.StatusServiceUnavailable, "unavailable")
+			return
+		}
+		// Content-Range is "bytes <first>-<last>/<total or *>" or "bytes */<total>" without data
+		byteRange, total, _ := strings.Cut(strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes "), "/")
+		if byteRange != "*" {
+			first, _, _ := strings.Cut(byteRange, "-")
+			offset, _ := strconv.ParseInt(first, 10, 64)
+			if offset != int64(len(upload.data)) {
+				writeGcsError(w, http.StatusBadRequest, "unexpected offset")
+				return
+			}
+			upload.data = append(upload.data, body...)
+		}
+		if total != "*" {
+			upload.size, _ = strconv.ParseInt(total, 10, 64)
+		}
+		if int64(len(upload.data)) == upload.size {
+			f.objects[upload.bucket+"/"+upload.key] = upload.data
+			f.metadata[upload.bucket+"/"+upload.key] = upload.metadata
+			fmt.Fprintf(w, `{"bucket":%q,"name":%q}`, upload.bucket, upload.key)
+			return
+		}
+		if len(upload.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(upload.data)-1))
+		}
+		// clients ask to replace 308 (resume incomplete) with 200
+		if r.Header.Get("X-GUploader-No-308") == "yes" {
+			w.Header().Set("X-Http-Status-Code-Override", "308")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+	default:
+		writeGcsError(w, http.StatusNotImplemented, "not implemented")
+	}
+}
+
+func NewTestServiceAccountKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed: NewTestServiceAccountKey, GenerateKey, err=%v", err)
+	}
+	return key
+}
+
+func GetTestServiceAccountJson(key *rsa.PrivateKey, tokenUri string) []byte {
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	buf, _ := json.Marshal(map[string]string{
+		"type": "service_account", "project_id": "project", "client_email": "uploader@project.iam.gserviceaccount.com",
+		"private_key": string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), "token_uri": tokenUri,
+	})
+	return buf
+}
+
+func TestNewGcsDestinationSecret(t *testing.T) {
+	saJson := GetTestServiceAccountJson(NewTestServiceAccountKey(t), "")
+	c, err := NewGcsDestinationSecret(map[string][]byte{"bucket": []byte("cores"), "serviceAccountJson": saJson, "createBucket": []byte("true")})
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "project", c.ProjectId)
+		assert.Equal(t, gcsDefaultEndpoint, c.Endpoint)
+		assert.Equal(t, gcsDefaultTokenUri, c.ServiceAccount.TokenUri)
+		assert.Equal(t, true, c.CreateBucket)
+	}
+	_, err = NewGcsDestinationSecret(map[string][]byte{"bucket": []byte("cores")})
+	assert.NotEqual(t, nil, err)
+	_, err = NewGcsDestinationSecret(map[string][]byte{"bucket": []byte("cores"), "serviceAccountJson": []byte(`{"client_email":"a","private_key":"b"}`)})
+	assert.NotEqual(t, nil, err)
+	_, err = NewGcsDestinationSecret(map[string][]byte{"serviceAccountJson": saJson})
+	assert.NotEqual(t, nil, err)
+	// emulators do not require credentials
+	c, err = NewGcsDestinationSecret(map[string][]byte{"bucket": []byte("cores"), "endpoint": []byte("http://localhost:4443/")})
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "http://localhost:4443", c.Endpoint)
+		assert.Equal(t, (*GcsServiceAccount)(nil), c.ServiceAccount)
+	}
+	_, err = NewGcsDestinationSecret(map[string][]byte{"bucket": []byte("cores"), "endpoint": []byte("http://localhost:4443/"), "createBucket": []byte("true")})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestGcsDestination(t *testing.T) {
+	key := NewTestServiceAccountKey(t)
+	server := NewFakeGcsServer(&key.PublicKey)
+	defer server.Close()
+	saJson := GetTestServiceAccountJson(key, server.server.URL+"/token")
+	tmpDir := t.TempDir()
+	r := NewDestinationRegistry()
+	r.Register(DestinationTypeGcs, NewGcsDestinationFactory(MultipartConfig{PartSize: MinPartSize, MaxAttempts: 2}, server.server.Client()))
+	data := map[string][]byte{"bucket": []byte("cores"), "serviceAccountJson": saJson, "endpoint": []byte(server.server.URL)}
+
+	d, err := r.NewDestination(DestinationTypeGcs, "test", data)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	assert.NotEqual(t, nil, d.Prepare())
+	data["createBucket"] = []byte("true")
+	d, err = r.NewDestination(DestinationTypeGcs, "test", data)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	assert.Equal(t, nil, d.Prepare())
+	assert.Equal(t, true, server.buckets["cores"])
+	assert.Equal(t, nil, d.Prepare())
+
+	opts := &ObjectOptions{Metadata: map[string]string{"namespace": "test", "pod-name": "app-0"}}
+	server.failChunks = 1
+	for _, size := range []int{0, 1024, int(MinPartSize*2 + 1024)} {
+		filePath := filepath.Join(tmpDir, "a.zip")
+		expected := CreateTestFile(t, filePath, size)
+		f, err := os.Open(filePath)
+		if !assert.Equal(t, nil, err) {
+			return
+		}
+		defer f.Close()
+		if assert.Equal(t, nil, d.Put("ns/a.zip", f, opts), "size=%v", size) {
+			assert.Equal(t, true, bytes.Equal(expected, server.objects["cores/ns/a.zip"]), "size=%v", size)
+			assert.Equal(t, opts.Metadata, server.metadata["cores/ns/a.zip"])
+		}
+	}
+	// 1 failed and 1 retried request for the empty file, 1 request for 1024 bytes, and 3 chunks for the large file
+	assert.Equal(t, 6, server.chunkCalls)
+	// every destination has its own access token
+	assert.Equal(t, 2, server.tokenCalls)
+	assert.Equal(t, 0, server.authFails)
+}
+
+func TestGetGcsChunkSize(t *testing.T) {
+	assert.Equal(t, int64(GcsChunkAlignment), GetGcsChunkSize(1))
+	assert.Equal(t, int64(GcsChunkAlignment), GetGcsChunkSize(GcsChunkAlignment))
+	assert.Equal(t, int64(GcsChunkAlignment*2), GetGcsChunkSize(GcsChunkAlignment+1))
+	// --partSize=5000000 is not a multiple of 256 KiB
+	assert.Equal(t, int64(5242880), GetGcsChunkSize(5000000))
+	assert.Equal(t, int64(0), GetGcsChunkSize(MinPartSize)%GcsChunkAlignment)
+}
+
+func TestGcsDestinationMaxAttempts(t *testing.T) {
+	server := NewFakeGcsServer(nil)
+	defer server.Close()
+	server.buckets["cores"] = true
+	tmpDir := t.TempDir()
+	r := NewDestinationRegistry()
+	r.Register(DestinationTypeGcs, NewGcsDestinationFactory(MultipartConfig{PartSize: 5000000, MaxAttempts: 2}, server.server.Client()))
+	d, err := r.NewDestination(DestinationTypeGcs, "test", map[string][]byte{"bucket": []byte("cores"), "endpoint": []byte(server.server.URL)})
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	filePath := filepath.Join(tmpDir, "a.zip")
+	expected := CreateTestFile(t, filePath, 5000000*2)
+	f, err := os.Open(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+	// chunks are rounded up to 256 KiB
+	assert.Equal(t, nil, d.Put("ns/a.zip", f, nil))
+	assert.Equal(t, true, bytes.Equal(expected, server.objects["cores/ns/a.zip"]))
+	assert.Equal(t, 2, server.chunkCalls)
+
+	server.chunkCalls = 0
+	server.failChunks = 2
+	assert.NotEqual(t, nil, d.Put("ns/a.zip", f, nil))
+	assert.Equal(t, 2, server.chunkCalls)
+}
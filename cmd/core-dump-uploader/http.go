@@ -0,0 +1,294 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DestinationTypeHttp = "http"
+	httpKeyPlaceholder  = "{key}"
+	httpKeyHeader       = "X-Core-Dump-Key"
+	httpMetadataPrefix  = "X-Core-Dump-Meta-"
+	// httpMaxRetryAfter is the longest Retry-After that Put waits for. Longer delays are left to the retry queue.
+	httpMaxRetryAfter = 5 * time.Minute
+	// httpMaxErrorBody is the number of bytes of response bodies in errors
+	httpMaxErrorBody = 256
+)
+
+// HttpDestinationSecret is configured with entries of core-dump-handler secrets with type=http
+type HttpDestinationSecret struct {
+	// Url is the endpoint to send files. {key} in Url is replaced with the escaped object key.
+	Url         string
+	Method      string
+	Header      http.Header
+	BearerToken string
+	// TlsConfig is nil if the secret has neither a client certificate nor a CA bundle
+	TlsConfig *tls.Config
+}
+
+func NewHttpDestinationSecret(data map[string][]byte) (*HttpDestinationSecret, error) {
+	if len(data["url"]) == 0 {
+		return nil, fmt.Errorf("failed: NewHttpDestinationSecret, malformed core-dump-handler secret, missing entries=url")
+	}
+	c := &HttpDestinationSecret{Url: string(data["url"]), Method: http.MethodPut, Header: http.Header{}, BearerToken: string(data["bearerToken"])}
+	u, err := url.Parse(strings.ReplaceAll(c.Url, httpKeyPlaceholder, "key"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("failed: NewHttpDestinationSecret, malformed core-dump-handler secret, url must be an http(s) URL, err=%v", err)
+	}
+	if v, ok := data["method"]; ok && len(v) > 0 {
+		c.Method = strings.ToUpper(string(v))
+		if c.Method != http.MethodPut && c.Method != http.MethodPost {
+			return nil, fmt.Errorf("failed: NewHttpDestinationSecret, malformed core-dump-handler secret, method must be PUT or POST, %v", string(v))
+		}
+	}
+	if v, ok := data["headers"]; ok && len(v) > 0 {
+		headers := make(map[string]string)
+		if err := json.Unmarshal(v, &headers); err != nil {
+			return nil, fmt.Errorf("failed: NewHttpDestinationSecret, malformed core-dump-handler secret, headers must be a JSON object of strings, err=%v", err)
+		}
+		for name, value := range headers {
+			c.Header.Set(name, value)
+		}
+	}
+
+	tlsConfig, err := NewTlsConfig(data, u.Scheme)
+	if err != nil {
+		return nil, fmt.Errorf("failed: NewHttpDestinationSecret, malformed core-dump-handler secret, %v", err)
+	}
+	c.TlsConfig = tlsConfig
+	return c, nil
+}
+
+// NewTlsConfig parses tlsCert, tlsKey, and caBundle in a secret. It returns nil if none of them are set.
+func NewTlsConfig(data map[string][]byte, scheme string) (*tls.Config, error) {
+	tlsCert, tlsKey, caBundle := data["tlsCert"], data["tlsKey"], data["caBundle"]
+	if (len(tlsCert) == 0) != (len(tlsKey) == 0) {
+		return nil, fmt.Errorf("tlsCert and tlsKey must be set together")
+	}
+	if len(tlsCert) == 0 && len(caBundle) == 0 {
+		return nil, nil
+	}
+	if scheme != "https" {
+		return nil, fmt.Errorf("tlsCert and caBundle require an https url")
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(tlsCert) > 0 {
+		cert, err := tls.X509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("X509KeyPair, err=%v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(caBundle) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("caBundle has no PEM certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// NewTlsClient clones the transport of httpClient with tlsConfig. It returns httpClient if tlsConfig is nil.
+func NewTlsClient(httpClient *http.Client, tlsConfig *tls.Config) *http.Client {
+	if tlsConfig == nil {
+		return httpClient
+	}
+	transport, ok := httpClient.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: httpClient.Timeout}
+}
+
+// HttpDestination streams files to crash ingestion services with a PUT or POST per file
+type HttpDestination struct {
+	c          *HttpDestinationSecret
+	httpClient *http.Client
+	// maxAttempts is the number of attempts to send a file (--httpMaxAttempts)
+	maxAttempts int
+	sleep       func(time.Duration)
+}
+
+// NewHttpDestinationFactory clones the transport of httpClient for secrets with TLS settings
+func NewHttpDestinationFactory(maxAttempts int, httpClient *http.Client) DestinationFactory {
+	return func(namespace string, data map[string][]byte) (Destination, error) {
+		c, err := NewHttpDestinationSecret(data)
+		if err != nil {
+			return nil, err
+		}
+		return &HttpDestination{c: c, httpClient: NewTlsClient(httpClient, c.TlsConfig), maxAttempts: maxAttempts, sleep: time.Sleep}, nil
+	}
+}
+
+func (d *HttpDestination) Prepare() error {
+	return nil
+}
+
+// GetUrl replaces {key} in the URL with the key escaped per path segment
+func (d *HttpDestination) GetUrl(key string) string {
+	if !strings.Contains(d.c.Url, httpKeyPlaceholder) {
+		return d.c.Url
+	}
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.ReplaceAll(d.c.Url, httpKeyPlaceholder, strings.Join(segments, "/"))
+}
+
+// GetLocation does not contain queries that may have credentials for logging
+func (d *HttpDestination) GetLocation(key string) string {
+	u, err := url.Parse(d.GetUrl(key))
+	if err != nil {
+		return "<malformed url>"
+	}
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+// HttpError has the status and the beginning of a response body
+type HttpError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *HttpError) Error() string {
+	return fmt.Sprintf("status=%v, body=%v", e.StatusCode, e.Body)
+}
+
+// NewHttpError reads the beginning of the body of res
+func NewHttpError(res *http.Response) *HttpError {
+	buf, _ := io.ReadAll(io.LimitReader(res.Body, httpMaxErrorBody))
+	return &HttpError{StatusCode: res.StatusCode, Body: strings.TrimSpace(string(buf)), RetryAfter: GetRetryAfter(res.Header, time.Now())}
+}
+
+// IsRetryable returns true for 429 and 5xx
+func (e *HttpError) IsRetryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// GetRetryAfter parses Retry-After in seconds or an HTTP date. It returns 0 if the header is missing or malformed.
+func GetRetryAfter(header http.Header, now time.Time) time.Duration {
+	v := strings.TrimSpace(header.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// Send sends a request with f and returns HttpError if status is not 2xx
+func (d *HttpDestination) Send(key string, f *os.File, size int64, opts *ObjectOptions) error {
+	req, err := http.NewRequest(d.c.Method, d.GetUrl(key), io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return fmt.Errorf("failed: HttpDestination.Send, NewRequest, err=%v", err)
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(httpKeyHeader, key)
+	if opts != nil {
+		for name, value := range opts.Metadata {
+			req.Header.Set(httpMetadataPrefix+name, value)
+		}
+	}
+	for name, values := range d.c.Header {
+		req.Header[name] = values
+	}
+	if d.c.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+d.c.BearerToken)
+	}
+	res, err := d.httpClient.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = d.GetLocation(key)
+		}
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	return NewHttpError(res)
+}
+
+// Put retries network errors, 429, and 5xx up to maxAttempts
+func (d *HttpDestination) Put(key string, f *os.File, opts *ObjectOptions) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed: HttpDestination.Put, Stat, f.Name()=%v, err=%v", f.Name(), err)
+	}
+	if d.c.TlsConfig != nil {
+		defer d.httpClient.CloseIdleConnections()
+	}
+	err = SendWithRetries(d.maxAttempts, d.sleep, key, func() error {
+		return d.Send(key, f, stat.Size(), opts)
+	})
+	if err != nil {
+		return fmt.Errorf("failed: HttpDestination.Put, url=%v, key=%v, err=%v", d.GetLocation(key), key, err)
+	}
+	log.Printf("INFO: HttpDestination.Put: %v->%v", f.Name(), d.GetLocation(key))
+	return nil
+}
+
+// SendWithRetries retries network errors, 429, and 5xx of send up to maxAttempts. It waits for Retry-After if responses have it.
+func SendWithRetries(maxAttempts int, sleep func(time.Duration), key string, send func() error) error {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	var err error = nil
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = send()
+		if err == nil {
+			return nil
+		}
+		delay := time.Duration(attempt) * time.Second
+		if e, ok := err.(*HttpError); ok {
+			if !e.IsRetryable() {
+				return err
+			}
+			if e.RetryAfter > httpMaxRetryAfter {
+				log.Printf("WARN: SendWithRetries, Retry-After=%v is longer than %v, key=%v", e.RetryAfter, httpMaxRetryAfter, key)
+				return err
+			}
+			if e.RetryAfter > 0 {
+				delay = e.RetryAfter
+			}
+		}
+		if attempt < maxAttempts {
+			log.Printf("WARN: SendWithRetries, retry key=%v, attempt=%v, delay=%v, err=%v", key, attempt, delay, err)
+			sleep(delay)
+		}
+	}
+	return err
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// FakeHttpServer records requests and returns statuses in order. It returns 201 after statuses are consumed.
+type FakeHttpServer struct {
+	lock     sync.Mutex
+	server   *httptest.Server
+	statuses []int
+	header   http.Header
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func NewFakeHttpServer(statuses ...int) *FakeHttpServer {
+	f := &FakeHttpServer{statuses: statuses, header: http.Header{}}
+	f.server = httptest.NewUnstartedServer(http.HandlerFunc(f.ServeHTTP))
+	return f
+}
+
+func (f *FakeHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	f.requests = append(f.requests, r)
+	f.bodies = append(f.bodies, body)
+	status := http.StatusCreated
+	if len(f.statuses) > 0 {
+		status, f.statuses = f.statuses[0], f.statuses[1:]
+	}
+	for name, values := range f.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(status)
+	w.Write([]byte("ingest says hello"))
+}
+
+func (f *FakeHttpServer) Close() {
+	f.server.Close()
+}
+
+func NewTestCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestNewHttpDestinationSecret(t *testing.T) {
+	c, err := NewHttpDestinationSecret(map[string][]byte{"url": []byte("https://ingest.example.com/cores/{key}?team=a"), "method": []byte("post"), "headers": []byte(`{"x-team":"a"}`)})
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, http.MethodPost, c.Method)
+		assert.Equal(t, "a", c.Header.Get("X-Team"))
+		assert.Equal(t, (*tls.Config)(nil), c.TlsConfig)
+	}
+	for _, data := range []map[string][]byte{
+		{}, {"url": []byte("ftp://example.com")}, {"url": []byte("/cores")}, {"url": []byte("https://example.com"), "method": []byte("GET")},
+		{"url": []byte("https://example.com"), "headers": []byte(`{"x-team":1}`)},
+		{"url": []byte("https://example.com"), "tlsCert": []byte("cert")},
+		{"url": []byte("https://example.com"), "caBundle": []byte("not pem")},
+		{"url": []byte("http://example.com"), "caBundle": []byte("not pem")},
+	} {
+		_, err = NewHttpDestinationSecret(data)
+		assert.NotEqual(t, nil, err, "data=%v", data)
+	}
+}
+
+func TestGetRetryAfter(t *testing.T) {
+	now := time.Date(2023, 8, 7, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Duration(0), GetRetryAfter(http.Header{}, now))
+	assert.Equal(t, 3*time.Second, GetRetryAfter(http.Header{"Retry-After": {"3"}}, now))
+	assert.Equal(t, time.Minute, GetRetryAfter(http.Header{"Retry-After": {now.Add(time.Minute).Format(http.TimeFormat)}}, now))
+	assert.Equal(t, time.Duration(0), GetRetryAfter(http.Header{"Retry-After": {now.Add(-time.Minute).Format(http.TimeFormat)}}, now))
+	assert.Equal(t, time.Duration(0), GetRetryAfter(http.Header{"Retry-After": {"soon"}}, now))
+}
+
+func TestHttpDestination(t *testing.T) {
+	server := NewFakeHttpServer(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	server.header.Set("Retry-After", "7")
+	server.server.Start()
+	defer server.Close()
+	tmpDir := t.TempDir()
+	r := NewDestinationRegistry()
+	r.Register(DestinationTypeHttp, NewHttpDestinationFactory(3, server.server.Client()))
+
+	data := map[string][]byte{
+		"type": []byte(DestinationTypeHttp), "url": []byte(server.server.URL + "/cores/{key}?token=secret"),
+		"headers": []byte(`{"X-Team":"a"}`), "bearerToken": []byte("token"),
+	}
+	d, err := r.NewDestination(DestinationTypeHttp, "test", data)
+	if !assert.Equal(t, nil, err) || !assert.Equal(t, nil, d.Prepare()) {
+		return
+	}
+	delays := make([]time.Duration, 0)
+	d.(*HttpDestination).sleep = func(delay time.Duration) { delays = append(delays, delay) }
+
+	filePath := filepath.Join(tmpDir, "a.zip")
+	expected := CreateTestFile(t, filePath, 1024)
+	f, err := os.Open(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+	opts := &ObjectOptions{Metadata: map[string]string{"pod-name": "app-0"}}
+	if assert.Equal(t, nil, d.Put("ns/a b.zip", f, opts)) {
+		assert.Equal(t, []time.Duration{7 * time.Second, 7 * time.Second}, delays)
+		assert.Equal(t, 3, len(server.requests))
+		req := server.requests[2]
+		assert.Equal(t, http.MethodPut, req.Method)
+		assert.Equal(t, "/cores/ns/a%20b.zip", req.URL.EscapedPath())
+		assert.Equal(t, "secret", req.URL.Query().Get("token"))
+		assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+		assert.Equal(t, "a", req.Header.Get("X-Team"))
+		assert.Equal(t, "ns/a b.zip", req.Header.Get(httpKeyHeader))
+		assert.Equal(t, "app-0", req.Header.Get(httpMetadataPrefix+"pod-name"))
+		assert.Equal(t, true, bytes.Equal(expected, server.bodies[2]))
+	}
+
+	// 4xx are not retried and errors do not leak queries
+	server.statuses = []int{http.StatusForbidden}
+	err = d.Put("ns/a.zip", f, nil)
+	if assert.NotEqual(t, nil, err) {
+		assert.Contains(t, err.Error(), "status=403")
+		assert.Contains(t, err.Error(), "ingest says hello")
+		assert.NotContains(t, err.Error(), "secret")
+	}
+	assert.Equal(t, 4, len(server.requests))
+
+	// long Retry-After is left to the retry queue
+	server.statuses = []int{http.StatusServiceUnavailable}
+	server.header.Set("Retry-After", "3600")
+	assert.NotEqual(t, nil, d.Put("ns/a.zip", f, nil))
+	assert.Equal(t, 5, len(server.requests))
+	assert.Equal(t, 2, len(delays))
+}
+
+func TestHttpDestinationMutualTls(t *testing.T) {
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test-ca"}, NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}
+	ca, caKey, caPem, _ := NewTestCertificate(t, caTemplate, nil, nil)
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "uploader"}, NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	_, _, clientPem, clientKeyPem := NewTestCertificate(t, clientTemplate, ca, caKey)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(caPem)
+
+	server := NewFakeHttpServer()
+	server.server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.server.StartTLS()
+	defer server.Close()
+	serverCaPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.server.Certificate().Raw})
+
+	tmpDir := t.TempDir()
+	filePath := filepath.Join(tmpDir, "a.zip")
+	CreateTestFile(t, filePath, 1024)
+	f, err := os.Open(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+
+	r := NewDestinationRegistry()
+	r.Register(DestinationTypeHttp, NewHttpDestinationFactory(1, &http.Client{}))
+	data := map[string][]byte{"url": []byte(server.server.URL + "/cores"), "method": []byte("POST"), "caBundle": serverCaPem}
+	// the server requires a client certificate
+	d, err := r.NewDestination(DestinationTypeHttp, "test", data)
+	if assert.Equal(t, nil, err) {
+		assert.NotEqual(t, nil, d.Put("ns/a.zip", f, nil))
+	}
+	data["tlsCert"], data["tlsKey"] = clientPem, clientKeyPem
+	d, err = r.NewDestination(DestinationTypeHttp, "test", data)
+	if assert.Equal(t, nil, err) && assert.Equal(t, nil, d.Put("ns/a.zip", f, nil)) {
+		req := server.requests[len(server.requests)-1]
+		assert.Equal(t, http.MethodPost, req.Method)
+		assert.Equal(t, "/cores", req.URL.Path)
+		assert.Equal(t, "uploader", req.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+}
+
+func TestHttpDestinationTimeout(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer server.Close()
+	defer close(block)
+	filePath := filepath.Join(t.TempDir(), "a.zip")
+	CreateTestFile(t, filePath, 1024)
+	f, err := os.Open(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+
+	r := NewDestinationRegistry()
+	r.Register(DestinationTypeHttp, NewHttpDestinationFactory(2, &http.Client{Timeout: 100 * time.Millisecond}))
+	d, err := r.NewDestination(DestinationTypeHttp, "test", map[string][]byte{"url": []byte(server.URL + "/{key}")})
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	begin := time.Now()
+	assert.NotEqual(t, nil, d.Put("ns/a.zip", f, nil))
+	assert.Less(t, time.Since(begin), 10*time.Second)
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	iamDefaultEndpoint = "https://iam.cloud.ibm.com/identity/token"
+	iamGrantTypeApiKey = "urn:ibm:params:oauth:grant-type:apikey"
+	// iamRetryInterval is the interval to retry failed refreshes while the current token is still valid
+	iamRetryInterval = 30 * time.Second
+	// iamMinTokenLifetime is the minimum remaining lifetime of a token to keep using it after failed refreshes
+	iamMinTokenLifetime        = time.Minute
+	iamServiceInstanceIdHeader = "ibm-service-instance-id"
+)
+
+// IamTokenProvider exchanges an IBM Cloud API key for IAM access tokens.
+// Tokens are refreshed after 80% of their lifetime like IBM Cloud SDKs.
+type IamTokenProvider struct {
+	lock        sync.Mutex
+	apiKey      string
+	endpoint    string
+	httpClient  *http.Client
+	accessToken string
+	expiry      time.Time
+	refreshAt   time.Time
+	now         func() time.Time
+}
+
+func NewIamTokenProvider(apiKey string, endpoint string, httpClient *http.Client) *IamTokenProvider {
+	if endpoint == "" {
+		endpoint = iamDefaultEndpoint
+	}
+	return &IamTokenProvider{apiKey: apiKey, endpoint: endpoint, httpClient: httpClient, now: time.Now}
+}
+
+// ValidateIamEndpoint checks iamEndpoint of secrets
+func ValidateIamEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("failed: ValidateIamEndpoint, iamEndpoint must be an http(s) URL, endpoint=%v, err=%v", endpoint, err)
+	}
+	return nil
+}
+
+// requestToken does not include API keys and response bodies in errors
+func (p *IamTokenProvider) requestToken(now time.Time) (string, time.Time, error) {
+	form := url.Values{"grant_type": {iamGrantTypeApiKey}, "apikey": {p.apiKey}}
+	req, err := http.NewRequest(http.MethodPost, p.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed: IamTokenProvider.Token, NewRequest, endpoint=%v, err=%v", p.endpoint, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed: IamTokenProvider.Token, Do, endpoint=%v, err=%v", p.endpoint, err)
+	}
+	defer res.Body.Close()
+	buf, _ := io.ReadAll(res.Body)
+	var token struct {
+		AccessToken  string `json:"access_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		Expiration   int64  `json:"expiration"`
+		ErrorCode    string `json:"errorCode"`
+		ErrorMessage string `json:"errorMessage"`
+	}
+	err = json.Unmarshal(buf, &token)
+	if res.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("failed: IamTokenProvider.Token, endpoint=%v, status=%v, errorCode=%v, errorMessage=%v", p.endpoint, res.StatusCode, token.ErrorCode, token.ErrorMessage)
+	}
+	if err != nil || token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("failed: IamTokenProvider.Token, endpoint=%v, malformed response, err=%v", p.endpoint, err)
+	}
+	expiry := now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	if token.Expiration > 0 {
+		expiry = time.Unix(token.Expiration, 0)
+	}
+	return token.AccessToken, expiry, nil
+}
+
+// Token returns a cached token or a new token. A valid token is returned even if refreshing it failed.
+func (p *IamTokenProvider) Token() (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := p.now()
+	if p.accessToken != "" && now.Before(p.refreshAt) {
+		return p.accessToken, nil
+	}
+	accessToken, expiry, err := p.requestToken(now)
+	if err != nil {
+		if p.accessToken != "" && now.Add(iamMinTokenLifetime).Before(p.expiry) {
+			log.Printf("WARN: IamTokenProvider.Token, use the current token until %v, err=%v", p.expiry, err)
+			p.refreshAt = now.Add(iamRetryInterval)
+			return p.accessToken, nil
+		}
+		return "", err
+	}
+	p.accessToken, p.expiry = accessToken, expiry
+	p.refreshAt = now.Add(expiry.Sub(now) * 4 / 5)
+	return p.accessToken, nil
+}
+
+// AddIamAuthHandler signs S3 requests with IAM bearer tokens instead of HMAC keys.
+// serviceInstanceId is required to create buckets.
+func AddIamAuthHandler(client *s3.S3, p *IamTokenProvider, serviceInstanceId string) {
+	client.Handlers.Sign.Remove(v4.SignRequestHandler)
+	client.Handlers.Sign.PushBackNamed(request.NamedHandler{Name: "core-dump.IamAuthHandler", Fn: func(r *request.Request) {
+		token, err := p.Token()
+		if err != nil {
+			r.Error = err
+			return
+		}
+		r.HTTPRequest.Header.Set("Authorization", "Bearer "+token)
+		if serviceInstanceId != "" {
+			r.HTTPRequest.Header.Set(iamServiceInstanceIdHeader, serviceInstanceId)
+		}
+	}})
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+// FakeIamServer issues token<N> for the API key "apikey"
+type FakeIamServer struct {
+	lock      sync.Mutex
+	server    *httptest.Server
+	calls     int
+	status    int
+	expiresIn int64
+}
+
+func NewFakeIamServer() *FakeIamServer {
+	f := &FakeIamServer{status: http.StatusOK, expiresIn: 3600}
+	f.server = httptest.NewServer(http.HandlerFunc(f.ServeHTTP))
+	return f
+}
+
+func (f *FakeIamServer) Close() {
+	f.server.Close()
+}
+
+func (f *FakeIamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls += 1
+	if r.FormValue("grant_type") != iamGrantTypeApiKey || r.FormValue("apikey") != "apikey" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"errorCode": "BXNIM0415E", "errorMessage": "Provided API key could not be found"})
+		return
+	}
+	if f.status != http.StatusOK {
+		w.WriteHeader(f.status)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"access_token": fmt.Sprintf("token%d", f.calls), "token_type": "Bearer", "expires_in": f.expiresIn})
+}
+
+func TestIamTokenProvider(t *testing.T) {
+	iam := NewFakeIamServer()
+	defer iam.Close()
+	now := time.Now()
+	p := NewIamTokenProvider("apikey", iam.server.URL, http.DefaultClient)
+	p.now = func() time.Time { return now }
+	token, err := p.Token()
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "token1", token)
+	}
+	// tokens are cached until 80% of their lifetime
+	now = now.Add(47 * time.Minute)
+	token, _ = p.Token()
+	assert.Equal(t, "token1", token)
+	assert.Equal(t, 1, iam.calls)
+	now = now.Add(2 * time.Minute)
+	token, _ = p.Token()
+	assert.Equal(t, "token2", token)
+
+	// failed refreshes keep valid tokens
+	iam.status = http.StatusServiceUnavailable
+	now = now.Add(50 * time.Minute)
+	token, err = p.Token()
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "token2", token)
+	}
+	token, _ = p.Token()
+	assert.Equal(t, 3, iam.calls)
+	now = now.Add(iamRetryInterval)
+	p.Token()
+	assert.Equal(t, 4, iam.calls)
+	now = now.Add(10 * time.Minute)
+	_, err = p.Token()
+	assert.NotEqual(t, nil, err)
+
+	iam.status = http.StatusOK
+	token, err = p.Token()
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "token6", token)
+	}
+
+	// API keys are not included in errors
+	_, err = NewIamTokenProvider("wrong-key", iam.server.URL, http.DefaultClient).Token()
+	if assert.NotEqual(t, nil, err) {
+		assert.Contains(t, err.Error(), "BXNIM0415E")
+		assert.NotContains(t, err.Error(), "wrong-key")
+	}
+}
+
+func TestNewS3DestinationSecretApiKey(t *testing.T) {
+	base := map[string][]byte{"bucket": []byte("bucket"), "keyPrefix": []byte("cores"), "endpoint": []byte("https://s3.us-south.cloud-object-storage.appdomain.cloud"), "createBucket": []byte("true")}
+	data := map[string][]byte{"apiKey": []byte("apikey"), "serviceInstanceId": []byte("crn:v1:instance"), "iamEndpoint": []byte("https://iam.test.cloud.ibm.com/identity/token")}
+	for key, value := range base {
+		data[key] = value
+	}
+	c, err := NewS3DestinationSecret(data)
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "apikey", c.ApiKey)
+		assert.Equal(t, "crn:v1:instance", c.ServiceInstanceId)
+		assert.Equal(t, "https://iam.test.cloud.ibm.com/identity/token", c.IamEndpoint)
+	}
+	for _, data := range []map[string][]byte{
+		{"apiKey": []byte("apikey"), "accessKey": []byte("a"), "secretKey": []byte("s")},
+		{"apiKey": []byte("apikey"), "roleArn": []byte("arn:aws:iam::123456789012:role/r")},
+		{"apiKey": []byte("apikey"), "iamEndpoint": []byte("iam.cloud.ibm.com")},
+	} {
+		for key, value := range base {
+			data[key] = value
+		}
+		_, err := NewS3DestinationSecret(data)
+		assert.NotEqual(t, nil, err, "data=%v", data)
+	}
+}
+
+func TestS3DestinationApiKey(t *testing.T) {
+	iam := NewFakeIamServer()
+	defer iam.Close()
+	s := NewMockS3Client(nil, nil, nil, nil)
+	cache := NewS3CredentialsCache(S3CredentialsConfig{})
+	r := NewDestinationRegistry()
+	r.Register(DestinationTypeS3, NewS3DestinationFactory(NewMockS3ClientFactory(s), cache, NewMockK8sClient(nil, nil, nil, false, false).GetSecretData))
+	data := map[string][]byte{
+		"bucket": []byte("bucket"), "keyPrefix": []byte("cores"), "endpoint": []byte("https://s3.us-south.cloud-object-storage.appdomain.cloud"), "createBucket": []byte("true"),
+		"apiKey": []byte("apikey"), "serviceInstanceId": []byte("crn:v1:instance"), "iamEndpoint": []byte(iam.server.URL),
+	}
+	_, err := r.NewDestination(DestinationTypeS3, "test", data)
+	if !assert.Equal(t, nil, err) || !assert.NotEqual(t, (*IamTokenProvider)(nil), s.config.IamToken) {
+		return
+	}
+	assert.Equal(t, (*credentials.Credentials)(nil), s.config.Credentials)
+	assert.Equal(t, "crn:v1:instance", s.config.ServiceInstanceId)
+	// destinations of a namespace share tokens
+	p := s.config.IamToken
+	_, err = r.NewDestination(DestinationTypeS3, "test", data)
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, p, s.config.IamToken)
+	}
+	data["apiKey"] = []byte("rotated")
+	_, err = r.NewDestination(DestinationTypeS3, "test", data)
+	if assert.Equal(t, nil, err) {
+		assert.NotEqual(t, p, s.config.IamToken)
+	}
+}
+
+func TestS3ClientIamAuth(t *testing.T) {
+	iam := NewFakeIamServer()
+	defer iam.Close()
+	server := NewFakeS3Server()
+	defer server.Close()
+	tmpDir := t.TempDir()
+	s := NewFakeS3ClientWithCredentials(server, MultipartConfig{PartSize: MinPartSize, Concurrency: 1, MaxAttempts: 1, StateDir: filepath.Join(tmpDir, "uploads")}, credentials.AnonymousCredentials)
+	AddIamAuthHandler(s.GetRawClient(), NewIamTokenProvider("apikey", iam.server.URL, http.DefaultClient), "crn:v1:instance")
+
+	for _, size := range []int{1024, int(MinPartSize) + 1} {
+		filePath := filepath.Join(tmpDir, fmt.Sprintf("%d.zip", size))
+		CreateTestFile(t, filePath, size)
+		f, err := os.Open(filePath)
+		if !assert.Equal(t, nil, err) {
+			return
+		}
+		err = s.PutObject("bucket", filepath.Base(filePath), f, nil)
+		f.Close()
+		if assert.Equal(t, nil, err) {
+			header := server.headers["bucket/"+filepath.Base(filePath)]
+			assert.Equal(t, "Bearer token1", header.Get("Authorization"))
+			assert.Equal(t, "crn:v1:instance", header.Get(iamServiceInstanceIdHeader))
+		}
+	}
+	assert.Equal(t, 1, iam.calls)
+
+	// IAM errors fail requests without HMAC signatures
+	s = NewFakeS3ClientWithCredentials(server, MultipartConfig{PartSize: MinPartSize, Concurrency: 1, MaxAttempts: 1}, credentials.AnonymousCredentials)
+	AddIamAuthHandler(s.GetRawClient(), NewIamTokenProvider("wrong-key", iam.server.URL, http.DefaultClient), "")
+	err := s.IsBucketExist("bucket")
+	if assert.NotEqual(t, nil, err) {
+		assert.Contains(t, err.Error(), "BXNIM0415E")
+	}
+}
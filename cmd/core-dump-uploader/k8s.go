@@ -7,27 +7,54 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+const (
+	coreDumpHandlerSecretType = "core-dump-handler"
+	// k8sResync is the resync period of informers for namespaces and secrets
+	k8sResync = 10 * time.Minute
+	// k8sRequestTimeout is the timeout of direct API calls before informers are synced
+	k8sRequestTimeout = 10 * time.Second
+)
+
 type K8sClient interface {
-	ResetClient() error
+	// Start creates a long-lived client and starts informers only at the first call
+	Start() error
 	CheckNamespace(namespace string) error
 	GetSecret(namespace string) (map[string][]byte, error)
-	GetRawClient() *kubernetes.Clientset
+	GetSecretData(namespace string, name string) (map[string][]byte, error)
+	GetRawClient() kubernetes.Interface
 }
 
+// K8sClientImpl looks up namespaces and core-dump-handler secrets in informer caches.
+// Caches keep serving the last known state while the API server is unavailable.
 type K8sClientImpl struct {
-	client                 *kubernetes.Clientset
-	kubeConfigPath         string
-	namespaceLabelSelector map[string]string
+	lock              sync.RWMutex
+	client            kubernetes.Interface
+	kubeConfigPath    string
+	namespaceSelector labels.Selector
+	namespaces        corelisters.NamespaceLister
+	secrets           corelisters.SecretLister
+	synced            []cache.InformerSynced
+	stopCh            chan struct{}
 }
 
 func ParseNamespaceLabelSelector(selectorString string) map[string]string {
@@ -41,12 +68,38 @@ func ParseNamespaceLabelSelector(selectorString string) map[string]string {
 	return selector
 }
 
-func NewK8sClient(kubeConfigPath string, selectorString string) K8sClient {
-	namespaceLabelSelector := ParseNamespaceLabelSelector(selectorString)
-	return &K8sClientImpl{client: nil, kubeConfigPath: kubeConfigPath, namespaceLabelSelector: namespaceLabelSelector}
+// ParseNamespaceSelector parses a JSON-encoded metav1.LabelSelector
+func ParseNamespaceSelector(selectorJson string) (labels.Selector, error) {
+	var labelSelector metav1.LabelSelector
+	if err := json.Unmarshal([]byte(selectorJson), &labelSelector); err != nil {
+		return nil, fmt.Errorf("failed: ParseNamespaceSelector, Unmarshal, selectorJson=%v, err=%v", selectorJson, err)
+	}
+	selector, err := metav1.LabelSelectorAsSelector(&labelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("failed: ParseNamespaceSelector, LabelSelectorAsSelector, selectorJson=%v, err=%v", selectorJson, err)
+	}
+	return selector, nil
+}
+
+// GetNamespaceSelector returns a selector from a JSON-encoded metav1.LabelSelector or a deprecated key1=value1,key2=value2 string.
+// All labels in a deprecated string must match.
+func GetNamespaceSelector(selectorJson string, selectorString string) (labels.Selector, error) {
+	if selectorJson != "" {
+		return ParseNamespaceSelector(selectorJson)
+	}
+	return labels.SelectorFromSet(ParseNamespaceLabelSelector(selectorString)), nil
+}
+
+func NewK8sClient(kubeConfigPath string, namespaceSelector labels.Selector) K8sClient {
+	return &K8sClientImpl{client: nil, kubeConfigPath: kubeConfigPath, namespaceSelector: namespaceSelector, stopCh: make(chan struct{})}
 }
 
-func (k *K8sClientImpl) ResetClient() error {
+func (k *K8sClientImpl) Start() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.client != nil {
+		return nil
+	}
 	var config *rest.Config = nil
 	var err error
 	if k.kubeConfigPath == "" {
@@ -55,59 +108,146 @@ func (k *K8sClientImpl) ResetClient() error {
 		config, err = clientcmd.BuildConfigFromFlags("", k.kubeConfigPath)
 	}
 	if err != nil {
-		return fmt.Errorf("failed: NewK8sClient, BuildConfigFromFlags, kubeConfigPath=%v, err=%v", k.kubeConfigPath, err)
+		return fmt.Errorf("failed: K8sClient.Start, BuildConfigFromFlags, kubeConfigPath=%v, err=%v", k.kubeConfigPath, err)
 	}
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return fmt.Errorf("failed: NewK8sClient, NewForConfig, err=%v", err)
+		return fmt.Errorf("failed: K8sClient.Start, NewForConfig, err=%v", err)
 	}
-	k.client = client
+	k.startInformers(client)
+	log.Printf("INFO: K8sClient.Start, started informers for namespaces and secrets with type=%v", coreDumpHandlerSecretType)
 	return nil
 }
 
+// startInformers does not wait for caches to be synced. Lookups call APIs directly until then.
+func (k *K8sClientImpl) startInformers(client kubernetes.Interface) {
+	factory := informers.NewSharedInformerFactory(client, k8sResync)
+	secretFactory := informers.NewSharedInformerFactoryWithOptions(client, k8sResync, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.FieldSelector = "type=" + coreDumpHandlerSecretType
+	}))
+	namespaceInformer := factory.Core().V1().Namespaces()
+	secretInformer := secretFactory.Core().V1().Secrets()
+	k.client = client
+	k.namespaces = namespaceInformer.Lister()
+	k.secrets = secretInformer.Lister()
+	k.synced = []cache.InformerSynced{namespaceInformer.Informer().HasSynced, secretInformer.Informer().HasSynced}
+	factory.Start(k.stopCh)
+	secretFactory.Start(k.stopCh)
+}
+
+// HasSynced returns true if informers listed namespaces and secrets at least once
+func (k *K8sClientImpl) HasSynced() bool {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if len(k.synced) == 0 {
+		return false
+	}
+	for _, synced := range k.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (k *K8sClientImpl) getNamespace(namespace string) (*corev1.Namespace, error) {
+	if k.HasSynced() {
+		return k.namespaces.Get(namespace)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), k8sRequestTimeout)
+	defer cancel()
+	return k.GetRawClient().CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+}
+
+func (k *K8sClientImpl) listSecrets(namespace string) ([]*corev1.Secret, error) {
+	var secrets []*corev1.Secret
+	if k.HasSynced() {
+		var err error
+		if secrets, err = k.secrets.Secrets(namespace).List(labels.Everything()); err != nil {
+			return nil, err
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), k8sRequestTimeout)
+		defer cancel()
+		list, err := k.GetRawClient().CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{FieldSelector: "type=" + coreDumpHandlerSecretType})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			secrets = append(secrets, &list.Items[i])
+		}
+	}
+	ret := make([]*corev1.Secret, 0, len(secrets))
+	for _, secret := range secrets {
+		if secret.Type == coreDumpHandlerSecretType {
+			ret = append(ret, secret)
+		}
+	}
+	// pick the same secret as List in the order of names
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
 func (k *K8sClientImpl) CheckNamespace(namespace string) error {
-	ns, err := k.client.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
+	ns, err := k.getNamespace(namespace)
 	if err != nil {
-		return fmt.Errorf("failed: CheckNamespace: not found namespace %v, err=%v", namespace, err)
-	}
-	var matched = false
-	for key, value := range ns.GetLabels() {
-		if found, ok := k.namespaceLabelSelector[key]; ok {
-			if found == value {
-				matched = true
-				break
-			}
+		notFound := apierrors.IsNotFound(err)
+		err = fmt.Errorf("failed: CheckNamespace: not found namespace %v, err=%v", namespace, err)
+		if notFound {
+			return NewPermanentError(err)
 		}
+		return err
 	}
-	if !matched {
-		return fmt.Errorf("failed: CheckNamespace: label selector did not match to namespace %v", namespace)
+	if !k.namespaceSelector.Matches(labels.Set(ns.GetLabels())) {
+		return NewPermanentError(fmt.Errorf("failed: CheckNamespace: label selector %v did not match to namespace %v", k.namespaceSelector, namespace))
 	}
 	return nil
 }
 
 func (k *K8sClientImpl) GetSecret(namespace string) (map[string][]byte, error) {
-	secrets, err := k.client.CoreV1().Secrets(namespace).List(context.TODO(), metav1.ListOptions{FieldSelector: "type=core-dump-handler"})
-	if err != nil || len(secrets.Items) == 0 {
-		return nil, fmt.Errorf("failed: GetSecret, not found core-dump-handler secrets in %v, err=%v, len(secrets.Items)=%v", namespace, err, len(secrets.Items))
+	secrets, err := k.listSecrets(namespace)
+	// tenants may create secrets after core dumps or informer caches may not have synced them yet
+	if err != nil || len(secrets) == 0 {
+		return nil, fmt.Errorf("failed: GetSecret, not found core-dump-handler secrets in %v, err=%v, len(secrets)=%v", namespace, err, len(secrets))
 	}
 	var ret map[string][]byte = nil
-	for _, secret := range secrets.Items {
+	for _, secret := range secrets {
 		/* TODO: PVC validation at Admission Web Hook
 		validated, ok := secret.GetAnnotations()["core-dump-handler/verified"]
 		if !ok || validated != "true" {
 			log.Printf("WARN: Ignore secret %v at %v without verification", secret.GetName(), namespace)
 			continue
 		}*/
-		c := secret.Data
 		if ret == nil {
-			ret = c
+			// secrets in informer caches must not be modified
+			ret = make(map[string][]byte, len(secret.Data))
+			for key, value := range secret.Data {
+				ret[key] = value
+			}
 		} else {
 			log.Printf("WARN: GetSecret, Ignore duplicated secret for type=core-dump-handler (%v at %v)", secret.GetName(), namespace)
 		}
 	}
-	return ret, err
+	return ret, nil
+}
+
+// GetSecretData reads a secret by name. Referenced secrets are not cached since they can have any type.
+func (k *K8sClientImpl) GetSecretData(namespace string, name string) (map[string][]byte, error) {
+	client := k.GetRawClient()
+	if client == nil {
+		return nil, fmt.Errorf("failed: GetSecretData, K8sClient is not started")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), k8sRequestTimeout)
+	defer cancel()
+	secret, err := client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed: GetSecretData, namespace=%v, name=%v, err=%v", namespace, name, err)
+	}
+	return secret.Data, nil
 }
 
-func (k *K8sClientImpl) GetRawClient() *kubernetes.Clientset {
+func (k *K8sClientImpl) GetRawClient() kubernetes.Interface {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
 	return k.client
 }
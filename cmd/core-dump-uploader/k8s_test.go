@@ -7,20 +7,29 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
 )
 
 const testKubeConfigPath = "/Users/tyos/.kube/core-dump-handler-test"
 
 func GetK8sClient(t *testing.T, kubeConfigPath string, selectorString string) (K8sClient, error) {
-	k8s := NewK8sClient(kubeConfigPath, selectorString)
-	err := k8s.ResetClient()
+	selector, err := GetNamespaceSelector("", selectorString)
+	if err != nil {
+		t.Errorf("Failed: GetNamespaceSelector, selectorString=%v, err=%v", selectorString, err)
+		return nil, err
+	}
+	k8s := NewK8sClient(kubeConfigPath, selector)
+	err = k8s.Start()
 	if err != nil {
 		t.SkipNow()
 		return nil, err
@@ -37,6 +46,30 @@ func TestCheckNamespace(t *testing.T) {
 	assert.Equal(t, nil, k8s.CheckNamespace("objcache"), "Failed: CheckNamespace, namespace objcache should not have kubernetes.io/metadata.name=tyos")
 }
 
+func TestGetNamespaceSelector(t *testing.T) {
+	selector, err := GetNamespaceSelector(`{"matchLabels":{"a":"b"},"matchExpressions":[{"key":"c","operator":"In","values":["d","e"]},{"key":"f","operator":"DoesNotExist"}]}`, "x=y")
+	if err != nil {
+		t.Errorf("Failed: GetNamespaceSelector, err=%v", err)
+		return
+	}
+	assert.Equal(t, true, selector.Matches(labels.Set{"a": "b", "c": "e"}))
+	assert.Equal(t, false, selector.Matches(labels.Set{"a": "b", "c": "e", "f": ""}))
+	assert.Equal(t, false, selector.Matches(labels.Set{"a": "b", "c": "g"}))
+	assert.Equal(t, false, selector.Matches(labels.Set{"c": "d"}))
+	assert.Equal(t, false, selector.Matches(labels.Set{"x": "y"}))
+
+	// deprecated format requires all labels
+	selector, err = GetNamespaceSelector("", "a=b,c=d")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, selector.Matches(labels.Set{"a": "b", "c": "d"}))
+	assert.Equal(t, false, selector.Matches(labels.Set{"a": "b"}))
+
+	_, err = GetNamespaceSelector(`{"matchExpressions":[{"key":"c","operator":"In"}]}`, "")
+	assert.NotEqual(t, nil, err)
+	_, err = GetNamespaceSelector(`a=b`, "")
+	assert.NotEqual(t, nil, err)
+}
+
 func TestGetSecret(t *testing.T) {
 	testNamespace := "tyos"
 	secretName := "core-dump-handler-test"
@@ -45,7 +78,7 @@ func TestGetSecret(t *testing.T) {
 	if err != nil {
 		return
 	}
-	expected := CoreDumpUploaderSecret{
+	expected := S3DestinationSecret{
 		Bucket: "bucket", KeyPrefix: "a/b/c", AccessKey: "ABCDEF", SecretKey: "12345", Endpoint: "https://endpoint", CreateBucket: true,
 	}
 	secret := &corev1.Secret{
@@ -73,9 +106,9 @@ func TestGetSecret(t *testing.T) {
 		t.Errorf("Failed: GetSecret, namespace=%v, err=%v", testNamespace, err)
 		return
 	}
-	c, err := NewCoreDumpUploaderSecret(secretData)
+	c, err := NewS3DestinationSecret(secretData)
 	if err != nil {
-		t.Errorf("Failed: NewCoreDumpUploaderSecret, err=%v", err)
+		t.Errorf("Failed: NewS3DestinationSecret, err=%v", err)
 		return
 	}
 	assert.Equal(t, expected.AccessKey, c.AccessKey)
@@ -85,23 +118,91 @@ func TestGetSecret(t *testing.T) {
 	assert.Equal(t, expected.KeyPrefix, c.KeyPrefix)
 }
 
+func TestK8sClientInformers(t *testing.T) {
+	selector, _ := GetNamespaceSelector("", "core-dump=enabled")
+	client := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "a", Labels: map[string]string{"core-dump": "enabled"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "b"}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "s2", Namespace: "a"}, Type: coreDumpHandlerSecretType, Data: map[string][]byte{"bucket": []byte("b2")}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "s1", Namespace: "a"}, Type: coreDumpHandlerSecretType, Data: map[string][]byte{"bucket": []byte("b1")}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "a"}, Type: corev1.SecretTypeOpaque, Data: map[string][]byte{"ca.crt": []byte("ca")}},
+	)
+	k8s := NewK8sClient("", selector).(*K8sClientImpl)
+	defer close(k8s.stopCh)
+	_, err := k8s.GetSecretData("a", "other")
+	assert.NotEqual(t, nil, err)
+
+	// direct API calls before informers start
+	k8s.client = client
+	assert.Equal(t, nil, k8s.CheckNamespace("a"))
+	data, err := k8s.GetSecret("a")
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "b1", string(data["bucket"]))
+	}
+	// secrets of any type can be referenced
+	data, err = k8s.GetSecretData("a", "other")
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "ca", string(data["ca.crt"]))
+	}
+	_, err = k8s.GetSecretData("b", "other")
+	assert.NotEqual(t, nil, err)
+
+	k8s.startInformers(client)
+	if !assert.Equal(t, true, cache.WaitForCacheSync(k8s.stopCh, k8s.synced...)) {
+		return
+	}
+	assert.Equal(t, true, k8s.HasSynced())
+	actions := len(client.Actions())
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, nil, k8s.CheckNamespace("a"))
+		// namespaces that did not opt in or were deleted are not retried
+		assert.Equal(t, true, IsPermanentError(k8s.CheckNamespace("b")))
+		assert.Equal(t, true, IsPermanentError(k8s.CheckNamespace("c")))
+		data, err = k8s.GetSecret("a")
+		if assert.Equal(t, nil, err) {
+			assert.Equal(t, "b1", string(data["bucket"]))
+		}
+		// missing secrets are retried
+		_, err = k8s.GetSecret("b")
+		assert.NotEqual(t, nil, err)
+		assert.Equal(t, false, IsPermanentError(err))
+	}
+	// lookups do not call APIs after caches are synced
+	assert.Equal(t, actions, len(client.Actions()))
+
+	// rotated secrets are picked up
+	data["bucket"] = []byte("modified")
+	secret, _ := client.CoreV1().Secrets("a").Get(context.TODO(), "s1", metav1.GetOptions{})
+	secret.Data = map[string][]byte{"bucket": []byte("b3")}
+	_, err = client.CoreV1().Secrets("a").Update(context.TODO(), secret, metav1.UpdateOptions{})
+	assert.Equal(t, nil, err)
+	assert.Eventually(t, func() bool {
+		data, err := k8s.GetSecret("a")
+		return err == nil && string(data["bucket"]) == "b3"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
 type MockK8sClient struct {
-	resetClientFail    error
+	startFail          error
 	checkNamespaceFail error
 	getSecretFail      error
 	malformedSecret    bool
 	createBucket       bool
+	secretData         map[string]map[string][]byte
+	rawClient          kubernetes.Interface
+	// secret overrides the core-dump-handler secret of GetSecret
+	secret map[string][]byte
 }
 
-func NewMockK8sClient(resetClientFail error, checkNamespaceFail error, getSecretFail error, malformedSecret bool, createBucket bool) *MockK8sClient {
+func NewMockK8sClient(startFail error, checkNamespaceFail error, getSecretFail error, malformedSecret bool, createBucket bool) *MockK8sClient {
 	return &MockK8sClient{
-		resetClientFail: resetClientFail, checkNamespaceFail: checkNamespaceFail, getSecretFail: getSecretFail,
+		startFail: startFail, checkNamespaceFail: checkNamespaceFail, getSecretFail: getSecretFail,
 		malformedSecret: malformedSecret, createBucket: createBucket,
 	}
 }
 
-func (k *MockK8sClient) ResetClient() error {
-	return k.resetClientFail
+func (k *MockK8sClient) Start() error {
+	return k.startFail
 }
 
 func (k *MockK8sClient) CheckNamespace(string) error {
@@ -112,6 +213,9 @@ func (k *MockK8sClient) GetSecret(string) (map[string][]byte, error) {
 	if k.getSecretFail != nil {
 		return nil, k.getSecretFail
 	}
+	if k.secret != nil {
+		return k.secret, nil
+	}
 	if k.malformedSecret {
 		return map[string][]byte{
 			"bucket": []byte("bucket"),
@@ -132,6 +236,14 @@ func (k *MockK8sClient) GetSecret(string) (map[string][]byte, error) {
 	return ret, nil
 }
 
-func (k *MockK8sClient) GetRawClient() *kubernetes.Clientset {
-	return nil
+func (k *MockK8sClient) GetSecretData(namespace string, name string) (map[string][]byte, error) {
+	data, ok := k.secretData[name]
+	if !ok {
+		return nil, fmt.Errorf("failed: GetSecretData, not found %v in %v", name, namespace)
+	}
+	return data, nil
+}
+
+func (k *MockK8sClient) GetRawClient() kubernetes.Interface {
+	return k.rawClient
 }
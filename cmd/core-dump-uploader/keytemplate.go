@@ -0,0 +1,162 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultKeyTemplate is the layout of object keys before keyTemplate was introduced
+	DefaultKeyTemplate = "{namespace}/{file}"
+	maxKeyElementLen   = 255
+	unknownKeyElement  = "unknown"
+)
+
+var keyPlaceholders = map[string]bool{
+	"namespace": true, "pod": true, "container": true, "node": true, "date": true, "exe": true, "signal": true, "uuid": true, "file": true,
+}
+
+// KeyTemplate generates object keys from placeholders such as {namespace} and {date}
+type KeyTemplate struct {
+	// Template is split into literals and placeholder names at odd indexes
+	elements []string
+}
+
+// NewKeyTemplate validates template. It returns DefaultKeyTemplate if template is empty.
+func NewKeyTemplate(template string) (*KeyTemplate, error) {
+	if template == "" {
+		template = DefaultKeyTemplate
+	}
+	elements := make([]string, 0)
+	rest := template
+	for {
+		i := strings.IndexAny(rest, "{}")
+		if i < 0 || rest[i] == '}' {
+			if i >= 0 {
+				return nil, fmt.Errorf("failed: NewKeyTemplate, unmatched }, keyTemplate=%v", template)
+			}
+			elements = append(elements, rest)
+			break
+		}
+		j := strings.IndexAny(rest[i+1:], "{}")
+		if j < 0 || rest[i+1+j] == '{' {
+			return nil, fmt.Errorf("failed: NewKeyTemplate, unmatched {, keyTemplate=%v", template)
+		}
+		name := rest[i+1 : i+1+j]
+		if !keyPlaceholders[name] {
+			return nil, fmt.Errorf("failed: NewKeyTemplate, unknown placeholder {%v}, keyTemplate=%v", name, template)
+		}
+		elements = append(elements, rest[:i], name)
+		rest = rest[i+2+j:]
+	}
+	t := &KeyTemplate{elements: elements}
+
+	// check literals with dummy values since placeholders are sanitized when keys are generated
+	values := make(map[string]string)
+	for name := range keyPlaceholders {
+		values[name] = "x"
+	}
+	key := t.Execute(values)
+	if strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return nil, fmt.Errorf("failed: NewKeyTemplate, keyTemplate must be a relative path with /, keyTemplate=%v", template)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return nil, fmt.Errorf("failed: NewKeyTemplate, keyTemplate must not contain empty, . or .. path segments, keyTemplate=%v", template)
+		}
+	}
+	if !t.HasPlaceholder("file") && !t.HasPlaceholder("uuid") {
+		return nil, fmt.Errorf("failed: NewKeyTemplate, keyTemplate requires {file} or {uuid} to avoid overwriting objects, keyTemplate=%v", template)
+	}
+	return t, nil
+}
+
+func (t *KeyTemplate) HasPlaceholder(name string) bool {
+	for i := 1; i < len(t.elements); i += 2 {
+		if t.elements[i] == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *KeyTemplate) String() string {
+	var b strings.Builder
+	for i, element := range t.elements {
+		if i%2 == 1 {
+			b.WriteString("{" + element + "}")
+		} else {
+			b.WriteString(element)
+		}
+	}
+	return b.String()
+}
+
+// Execute replaces placeholders with sanitized values. Missing values are replaced with "unknown".
+func (t *KeyTemplate) Execute(values map[string]string) string {
+	var b strings.Builder
+	for i, element := range t.elements {
+		if i%2 == 1 {
+			b.WriteString(SanitizeKeyElement(values[element]))
+		} else {
+			b.WriteString(element)
+		}
+	}
+	return b.String()
+}
+
+// SanitizeKeyElement prevents values from adding path segments or escaping keyPrefix
+func SanitizeKeyElement(s string) string {
+	ret := []rune{}
+	for _, c := range s {
+		if len(ret) >= maxKeyElementLen {
+			break
+		}
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.ContainsRune("-_.+=@", c) {
+			ret = append(ret, c)
+		} else {
+			ret = append(ret, '_')
+		}
+	}
+	switch string(ret) {
+	case "", ".", "..":
+		return unknownKeyElement
+	}
+	return string(ret)
+}
+
+// GetKeyValues returns placeholder values for a core dump. fileName is the base name of the uploaded file.
+func GetKeyValues(info *RuntimeInfo, fileName string, nodeName string, modTime time.Time) map[string]string {
+	values := map[string]string{
+		"namespace": info.Namespace, "pod": info.PodName, "container": info.ContainerName,
+		"node": info.Node, "exe": info.Exe, "signal": info.Signal, "uuid": info.Uuid, "file": fileName,
+	}
+	if values["node"] == "" {
+		values["node"] = nodeName
+	}
+	timestamp := info.Timestamp
+	if timestamp.IsZero() {
+		timestamp = modTime
+	}
+	values["date"] = timestamp.UTC().Format("2006-01-02")
+	if values["uuid"] == "" {
+		// keep keys stable across retries so that multipart uploads can resume
+		values["uuid"] = uuid.NewSHA1(uuid.NameSpaceURL, []byte(filepath.Base(fileName))).String()
+	}
+	return values
+}
+
+// GetObjectKey joins keyPrefix and the generated key. keyPrefix is used as is for compatibility.
+func GetObjectKey(keyPrefix string, t *KeyTemplate, values map[string]string) string {
+	return path.Join(keyPrefix, t.Execute(values))
+}
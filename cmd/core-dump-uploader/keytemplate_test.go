@@ -0,0 +1,59 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewKeyTemplate(t *testing.T) {
+	k, err := NewKeyTemplate("")
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, DefaultKeyTemplate, k.String())
+	}
+	k, err = NewKeyTemplate("{date}/{node}/{namespace}/{pod}-{container}/{exe}-{signal}-{uuid}.zip")
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, true, k.HasPlaceholder("uuid"))
+		assert.Equal(t, false, k.HasPlaceholder("file"))
+	}
+	for _, template := range []string{
+		"{namespace}/{unknown}/{file}", "{namespace/{file}", "{namespace}}/{file}", "{namespace}/{pod}",
+		"/{namespace}/{file}", "{namespace}/../{file}", "{namespace}//{file}", "{namespace}\\{file}", "./{file}",
+	} {
+		_, err = NewKeyTemplate(template)
+		assert.NotEqual(t, nil, err, "template=%v", template)
+	}
+}
+
+func TestExecuteKeyTemplate(t *testing.T) {
+	info := &RuntimeInfo{
+		Namespace: "test", PodName: "app-0", ContainerName: "server", Exe: "/usr/bin/app", Signal: "11",
+		Uuid: "8a1c8f1e-0000-4000-8000-000000000000", Timestamp: time.Date(2023, 8, 1, 23, 0, 0, 0, time.UTC),
+	}
+	values := GetKeyValues(info, "a.zip", "worker-1", time.Time{})
+	assert.Equal(t, "2023-08-01", values["date"])
+	assert.Equal(t, "worker-1", values["node"])
+
+	k, _ := NewKeyTemplate("")
+	assert.Equal(t, "prefix/test/a.zip", GetObjectKey("prefix/", k, values))
+	assert.Equal(t, "test/a.zip", GetObjectKey("", k, values))
+
+	k, _ = NewKeyTemplate("{date}/{node}/{namespace}/{pod}/{container}/{exe}-{signal}-{uuid}.zip")
+	assert.Equal(t, "prefix/2023-08-01/worker-1/test/app-0/server/_usr_bin_app-11-8a1c8f1e-0000-4000-8000-000000000000.zip", GetObjectKey("prefix", k, values))
+
+	// values cannot traverse paths
+	info = &RuntimeInfo{Namespace: "..", PodName: "../../etc", Exe: "."}
+	values = GetKeyValues(info, "b.zip", "", time.Date(2023, 8, 2, 0, 0, 0, 0, time.UTC))
+	k, _ = NewKeyTemplate("{namespace}/{pod}/{exe}/{node}/{date}/{file}")
+	assert.Equal(t, "prefix/unknown/.._.._etc/unknown/unknown/2023-08-02/b.zip", GetObjectKey("prefix", k, values))
+
+	// generated UUIDs are stable for the same file
+	assert.Equal(t, values["uuid"], GetKeyValues(info, "b.zip", "", time.Time{})["uuid"])
+	assert.NotEqual(t, values["uuid"], GetKeyValues(info, "c.zip", "", time.Time{})["uuid"])
+}
@@ -0,0 +1,326 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	MinPartSize  = int64(5 * 1024 * 1024)
+	MaxPartCount = int64(10000)
+	// multipartHeadSize covers headers of encrypted files, which differ for every encryption
+	multipartHeadSize = int64(4096)
+)
+
+type MultipartConfig struct {
+	PartSize    int64
+	Concurrency int
+	MaxAttempts int
+	// StateDir keeps upload IDs to resume uploads after restarts. Uploads are not resumed if it is empty.
+	StateDir string
+}
+
+// MultipartUploadState is stored in StateDir while a multipart upload is in progress
+type MultipartUploadState struct {
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	UploadId string `json:"uploadId"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"partSize"`
+	SSE      string `json:"sse,omitempty"`
+	// Head is the hash of the first bytes of the file. Uploaded parts are not reused for different contents of the same size.
+	Head string `json:"head"`
+}
+
+// GetPartSize returns a part size that fits size into MaxPartCount parts
+func (c *MultipartConfig) GetPartSize(size int64) int64 {
+	partSize := c.PartSize
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+	if (size+partSize-1)/partSize > MaxPartCount {
+		partSize = (size + MaxPartCount - 1) / MaxPartCount
+		partSize = (partSize + MinPartSize - 1) / MinPartSize * MinPartSize
+	}
+	return partSize
+}
+
+// GetStatePath uses the base name of a zip file since the retry queue moves it across directories
+func (c *MultipartConfig) GetStatePath(f *os.File) string {
+	if c.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(c.StateDir, filepath.Base(f.Name())+".json")
+}
+
+// GetHeadHash returns the hash of the first multipartHeadSize bytes of f
+func GetHeadHash(f *os.File, size int64) (string, error) {
+	if size > multipartHeadSize {
+		size = multipartHeadSize
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+		return "", fmt.Errorf("failed: GetHeadHash, f.Name()=%v, err=%v", f.Name(), err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func ReadMultipartUploadState(statePath string) *MultipartUploadState {
+	if statePath == "" {
+		return nil
+	}
+	buf, err := os.ReadFile(statePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("WARN: ReadMultipartUploadState, ReadFile, statePath=%v, err=%v", statePath, err)
+		}
+		return nil
+	}
+	var state MultipartUploadState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		log.Printf("WARN: ReadMultipartUploadState, Unmarshal, statePath=%v, err=%v", statePath, err)
+		return nil
+	}
+	return &state
+}
+
+func WriteMultipartUploadState(statePath string, state *MultipartUploadState) error {
+	if statePath == "" {
+		return nil
+	}
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed: WriteMultipartUploadState, Marshal, statePath=%v, err=%v", statePath, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0700); err != nil {
+		return fmt.Errorf("failed: WriteMultipartUploadState, MkdirAll, statePath=%v, err=%v", statePath, err)
+	}
+	tmpPath := statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, buf, 0600); err != nil {
+		return fmt.Errorf("failed: WriteMultipartUploadState, WriteFile, tmpPath=%v, err=%v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, statePath); err != nil {
+		return fmt.Errorf("failed: WriteMultipartUploadState, Rename, tmpPath=%v, statePath=%v, err=%v", tmpPath, statePath, err)
+	}
+	return nil
+}
+
+func RemoveMultipartUploadState(statePath string) {
+	if statePath == "" {
+		return
+	}
+	if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		log.Printf("WARN: RemoveMultipartUploadState, statePath=%v, err=%v", statePath, err)
+	}
+}
+
+// ListUploadedParts returns ETags of parts that were uploaded with the expected size
+func (s *S3ClientImpl) ListUploadedParts(state *MultipartUploadState) (map[int64]string, error) {
+	parts := make(map[int64]string)
+	lastPart := (state.Size + state.PartSize - 1) / state.PartSize
+	err := s.s.ListPartsPages(&s3.ListPartsInput{Bucket: &state.Bucket, Key: &state.Key, UploadId: &state.UploadId},
+		func(out *s3.ListPartsOutput, _ bool) bool {
+			for _, part := range out.Parts {
+				partSize := state.PartSize
+				if *part.PartNumber == lastPart {
+					partSize = state.Size - state.PartSize*(lastPart-1)
+				}
+				if *part.Size == partSize {
+					parts[*part.PartNumber] = *part.ETag
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed: ListUploadedParts, bucket=%v, key=%v, uploadId=%v, err=%v", state.Bucket, state.Key, state.UploadId, err)
+	}
+	return parts, nil
+}
+
+func (s *S3ClientImpl) AbortMultipartUpload(state *MultipartUploadState) {
+	_, err := s.s.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: &state.Bucket, Key: &state.Key, UploadId: &state.UploadId})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != s3.ErrCodeNoSuchUpload {
+			log.Printf("WARN: AbortMultipartUpload, bucket=%v, key=%v, uploadId=%v, err=%v", state.Bucket, state.Key, state.UploadId, err)
+			return
+		}
+	}
+	log.Printf("INFO: AbortMultipartUpload, bucket=%v, key=%v, uploadId=%v", state.Bucket, state.Key, state.UploadId)
+}
+
+// IsRetryableS3Error returns true for network errors, throttling, and server errors that a later attempt can succeed after
+func IsRetryableS3Error(err error) bool {
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return true
+	}
+	reqErr, ok := err.(awserr.RequestFailure)
+	return ok && reqErr.StatusCode() >= http.StatusInternalServerError
+}
+
+// UploadPart returns retryable=true if the upload can be resumed after the error
+func (s *S3ClientImpl) UploadPart(state *MultipartUploadState, f *os.File, partNumber int64, sse *ServerSideEncryption) (etag string, retryable bool, err error) {
+	offset := state.PartSize * (partNumber - 1)
+	length := state.PartSize
+	if offset+length > state.Size {
+		length = state.Size - offset
+	}
+	maxAttempts := s.multipart.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		var out *s3.UploadPartOutput
+		in := &s3.UploadPartInput{
+			Body: io.NewSectionReader(f, offset, length), Bucket: &state.Bucket, Key: &state.Key, UploadId: &state.UploadId,
+			PartNumber: aws.Int64(partNumber), ContentLength: aws.Int64(length),
+		}
+		sse.ApplyUploadPart(in)
+		out, err = s.s.UploadPart(in)
+		if err == nil {
+			return *out.ETag, false, nil
+		}
+		log.Printf("WARN: UploadPart, key=%v, partNumber=%v, attempt=%v, err=%v", state.Key, partNumber, attempt, err)
+		if attempt < maxAttempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	retryable = IsRetryableS3Error(err)
+	return "", retryable, fmt.Errorf("failed: UploadPart, bucket=%v, key=%v, partNumber=%v, err=%v", state.Bucket, state.Key, partNumber, sse.WrapError(err))
+}
+
+// GetMultipartUpload resumes a persisted upload of f or creates a new one
+func (s *S3ClientImpl) GetMultipartUpload(statePath string, bucket string, key string, f *os.File, size int64, opts *ObjectOptions) (*MultipartUploadState, map[int64]string, error) {
+	sse := opts.GetSSE()
+	partSize := s.multipart.GetPartSize(size)
+	head, err := GetHeadHash(f, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	if state := ReadMultipartUploadState(statePath); state != nil {
+		if state.Bucket == bucket && state.Key == key && state.Size == size && state.PartSize == partSize && state.SSE == sse.String() && state.Head == head {
+			parts, err := s.ListUploadedParts(state)
+			if err == nil {
+				log.Printf("INFO: GetMultipartUpload, resume uploadId=%v, key=%v, uploaded parts=%v", state.UploadId, key, len(parts))
+				return state, parts, nil
+			}
+			log.Printf("WARN: GetMultipartUpload, could not resume, err=%v", err)
+		}
+		s.AbortMultipartUpload(state)
+		RemoveMultipartUploadState(statePath)
+	}
+	in := &s3.CreateMultipartUploadInput{Bucket: &bucket, Key: &key}
+	opts.ApplyCreateMultipartUpload(in)
+	out, err := s.s.CreateMultipartUpload(in)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed: CreateMultipartUpload, bucket=%v, key=%v, err=%v", bucket, key, sse.WrapError(err))
+	}
+	state := &MultipartUploadState{Bucket: bucket, Key: key, UploadId: *out.UploadId, Size: size, PartSize: partSize, SSE: sse.String(), Head: head}
+	if err := WriteMultipartUploadState(statePath, state); err != nil {
+		s.AbortMultipartUpload(state)
+		return nil, nil, err
+	}
+	return state, make(map[int64]string), nil
+}
+
+func (s *S3ClientImpl) PutMultipartObject(bucket string, key string, f *os.File, size int64, opts *ObjectOptions) error {
+	sse := opts.GetSSE()
+	statePath := s.multipart.GetStatePath(f)
+	state, parts, err := s.GetMultipartUpload(statePath, bucket, key, f, size, opts)
+	if err != nil {
+		return err
+	}
+	partCount := (size + state.PartSize - 1) / state.PartSize
+	partNumbers := make(chan int64, partCount)
+	for partNumber := int64(1); partNumber <= partCount; partNumber++ {
+		if _, ok := parts[partNumber]; !ok {
+			partNumbers <- partNumber
+		}
+	}
+	close(partNumbers)
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error = nil
+	resumable := true
+	concurrency := s.multipart.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partNumber := range partNumbers {
+				lock.Lock()
+				failed := firstErr != nil
+				lock.Unlock()
+				if failed {
+					return
+				}
+				etag, retryable, err := s.UploadPart(state, f, partNumber, sse)
+				lock.Lock()
+				if err != nil && !retryable {
+					resumable = false
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+				} else if err == nil {
+					parts[partNumber] = etag
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil && resumable && statePath != "" {
+		// the retry queue resumes the upload with uploaded parts
+		log.Printf("INFO: PutMultipartObject, keep uploadId=%v to resume, key=%v", state.UploadId, key)
+		return firstErr
+	}
+	if firstErr != nil {
+		s.AbortMultipartUpload(state)
+		RemoveMultipartUploadState(statePath)
+		return firstErr
+	}
+
+	completed := make([]*s3.CompletedPart, 0, len(parts))
+	for partNumber, etag := range parts {
+		completed = append(completed, &s3.CompletedPart{PartNumber: aws.Int64(partNumber), ETag: aws.String(etag)})
+	}
+	sort.Slice(completed, func(i, j int) bool { return *completed[i].PartNumber < *completed[j].PartNumber })
+	_, err = s.s.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket: &bucket, Key: &key, UploadId: &state.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		if IsRetryableS3Error(err) && statePath != "" {
+			log.Printf("INFO: PutMultipartObject, keep uploadId=%v to resume, key=%v", state.UploadId, key)
+		} else {
+			s.AbortMultipartUpload(state)
+			RemoveMultipartUploadState(statePath)
+		}
+		return fmt.Errorf("failed: CompleteMultipartUpload, bucket=%v, key=%v, uploadId=%v, err=%v", bucket, key, state.UploadId, sse.WrapError(err))
+	}
+	RemoveMultipartUploadState(statePath)
+	return nil
+}
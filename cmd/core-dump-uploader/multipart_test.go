@@ -0,0 +1,382 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+// FakeS3Server implements a subset of S3 APIs for path-style requests
+type FakeS3Server struct {
+	lock      sync.Mutex
+	server    *httptest.Server
+	objects   map[string][]byte
+	headers   map[string]http.Header
+	uploads   map[string]map[int64][]byte
+	nextId    int
+	failParts map[int64]bool
+	// failStatus is the status of failed parts (default: 400 InvalidPart)
+	failStatus  int
+	partCalls   map[int64]int
+	putCalls    int
+	abortCalls  int
+	partHeaders map[int64]http.Header
+	rejectSSE   bool
+	// buckets keeps bodies of bucket subresources such as versioning. "" is the body of CreateBucket.
+	buckets         map[string]map[string][]byte
+	failSubresource string
+	deleteBuckets   int
+}
+
+func newFakeS3Server() *FakeS3Server {
+	return &FakeS3Server{
+		objects: make(map[string][]byte), headers: make(map[string]http.Header), uploads: make(map[string]map[int64][]byte),
+		failParts: make(map[int64]bool), partCalls: make(map[int64]int), partHeaders: make(map[int64]http.Header),
+		buckets: make(map[string]map[string][]byte),
+	}
+}
+
+// serveBucket handles bucket APIs for paths without keys
+func (f *FakeS3Server) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, body []byte) {
+	subresource := strings.TrimSuffix(r.URL.RawQuery, "=")
+	_, ok := f.buckets[bucket]
+	switch {
+	case r.Method == http.MethodHead:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == http.MethodPut && subresource == "":
+		if ok {
+			writeS3Error(w, http.StatusConflict, "BucketAlreadyOwnedByYou")
+			return
+		}
+		f.buckets[bucket] = map[string][]byte{"": body}
+		f.headers[bucket] = r.Header.Clone()
+	case r.Method == http.MethodPut:
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+			return
+		}
+		if subresource == f.failSubresource {
+			writeS3Error(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		f.buckets[bucket][subresource] = body
+		f.headers[bucket+"?"+subresource] = r.Header.Clone()
+	case r.Method == http.MethodDelete:
+		f.deleteBuckets += 1
+		delete(f.buckets, bucket)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func NewFakeS3Server() *FakeS3Server {
+	f := newFakeS3Server()
+	f.server = httptest.NewServer(http.HandlerFunc(f.ServeHTTP))
+	return f
+}
+
+// NewFakeS3TLSServer is required to test SSE-C since clients do not send customer keys over HTTP
+func NewFakeS3TLSServer() *FakeS3Server {
+	f := newFakeS3Server()
+	f.server = httptest.NewTLSServer(http.HandlerFunc(f.ServeHTTP))
+	return f
+}
+
+func (f *FakeS3Server) Close() {
+	f.server.Close()
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *FakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+	_, isUploads := query["uploads"]
+	uploadId := query.Get("uploadId")
+	if f.rejectSSE && (r.Header.Get("x-amz-server-side-encryption") != "" || r.Header.Get("x-amz-server-side-encryption-customer-algorithm") != "") {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	if !strings.Contains(key, "/") {
+		f.serveBucket(w, r, key, body)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && isUploads:
+		f.nextId += 1
+		id := strconv.Itoa(f.nextId)
+		f.uploads[id] = make(map[int64][]byte)
+		f.headers[key] = r.Header.Clone()
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && uploadId != "":
+		partNumber, _ := strconv.ParseInt(query.Get("partNumber"), 10, 64)
+		f.partCalls[partNumber] += 1
+		f.partHeaders[partNumber] = r.Header.Clone()
+		parts, ok := f.uploads[uploadId]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		if f.failParts[partNumber] && f.failStatus == http.StatusServiceUnavailable {
+			writeS3Error(w, f.failStatus, "SlowDown")
+			return
+		} else if f.failParts[partNumber] {
+			writeS3Error(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		parts[partNumber] = body
+		w.Header().Set("ETag", fmt.Sprintf("\"%x\"", md5.Sum(body)))
+	case r.Method == http.MethodGet && uploadId != "":
+		parts, ok := f.uploads[uploadId]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		fmt.Fprint(w, "<ListPartsResult><IsTruncated>false</IsTruncated>")
+		for partNumber, data := range parts {
+			fmt.Fprintf(w, "<Part><PartNumber>%d</PartNumber><ETag>\"%x\"</ETag><Size>%d</Size></Part>", partNumber, md5.Sum(data), len(data))
+		}
+		fmt.Fprint(w, "</ListPartsResult>")
+	case r.Method == http.MethodPost && uploadId != "":
+		parts, ok := f.uploads[uploadId]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var complete struct {
+			Parts []struct {
+				PartNumber int64
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil || len(complete.Parts) != len(parts) {
+			writeS3Error(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		var buf bytes.Buffer
+		for _, part := range complete.Parts {
+			buf.Write(parts[part.PartNumber])
+		}
+		f.objects[key] = buf.Bytes()
+		delete(f.uploads, uploadId)
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && uploadId != "":
+		f.abortCalls += 1
+		if _, ok := f.uploads[uploadId]; !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		delete(f.uploads, uploadId)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.putCalls += 1
+		f.objects[key] = body
+		f.headers[key] = r.Header.Clone()
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func NewFakeS3Client(f *FakeS3Server, multipart MultipartConfig) *S3ClientImpl {
+	return NewFakeS3ClientWithCredentials(f, multipart, credentials.NewStaticCredentials("access", "secret", ""))
+}
+
+func NewFakeS3ClientWithCredentials(f *FakeS3Server, multipart MultipartConfig, creds *credentials.Credentials) *S3ClientImpl {
+	conf := aws.NewConfig().
+		WithCredentials(creds).
+		WithEndpoint(f.server.URL).WithRegion("us-east").WithS3ForcePathStyle(true).WithMaxRetries(0).
+		WithHTTPClient(f.server.Client())
+	return &S3ClientImpl{s: s3.New(session.Must(session.NewSession(conf))), multipart: multipart}
+}
+
+func CreateTestFile(t *testing.T, filePath string, size int) []byte {
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = byte(i % 251)
+	}
+	if err := os.WriteFile(filePath, buf, 0644); err != nil {
+		t.Fatalf("Failed: CreateTestFile, filePath=%v, err=%v", filePath, err)
+	}
+	return buf
+}
+
+func TestGetPartSize(t *testing.T) {
+	c := MultipartConfig{PartSize: 1024}
+	assert.Equal(t, MinPartSize, c.GetPartSize(1))
+	c.PartSize = 64 * 1024 * 1024
+	assert.Equal(t, c.PartSize, c.GetPartSize(1024*1024*1024))
+	size := MaxPartCount*c.PartSize + 1
+	partSize := c.GetPartSize(size)
+	assert.Equal(t, true, (size+partSize-1)/partSize <= MaxPartCount)
+	assert.Equal(t, int64(0), partSize%MinPartSize)
+}
+
+func TestPutMultipartObject(t *testing.T) {
+	server := NewFakeS3Server()
+	defer server.Close()
+	tmpDir := t.TempDir()
+	stateDir := filepath.Join(tmpDir, "uploads")
+	s := NewFakeS3Client(server, MultipartConfig{PartSize: MinPartSize, Concurrency: 2, MaxAttempts: 2, StateDir: stateDir})
+
+	filePath := filepath.Join(tmpDir, "a.zip")
+	data := CreateTestFile(t, filePath, int(MinPartSize*2+1024))
+	f, err := os.Open(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+	assert.Equal(t, nil, s.PutObject("bucket", "prefix/a.zip", f, nil))
+	assert.Equal(t, true, bytes.Equal(data, server.objects["bucket/prefix/a.zip"]))
+	assert.Equal(t, map[int64]int{1: 1, 2: 1, 3: 1}, server.partCalls)
+	assert.Equal(t, 0, len(server.uploads))
+	_, err = os.Stat(filepath.Join(stateDir, "a.zip.json"))
+	assert.Equal(t, true, os.IsNotExist(err))
+
+	// small files are uploaded with a single request
+	filePath2 := filepath.Join(tmpDir, "b.zip")
+	data2 := CreateTestFile(t, filePath2, 1024)
+	f2, err := os.Open(filePath2)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f2.Close()
+	assert.Equal(t, nil, s.PutObject("bucket", "prefix/b.zip", f2, nil))
+	assert.Equal(t, 1, server.putCalls)
+	assert.Equal(t, data2, server.objects["bucket/prefix/b.zip"])
+}
+
+func TestResumeMultipartObject(t *testing.T) {
+	server := NewFakeS3Server()
+	defer server.Close()
+	tmpDir := t.TempDir()
+	stateDir := filepath.Join(tmpDir, "uploads")
+	s := NewFakeS3Client(server, MultipartConfig{PartSize: MinPartSize, Concurrency: 2, MaxAttempts: 2, StateDir: stateDir})
+
+	filePath := filepath.Join(tmpDir, "a.zip")
+	data := CreateTestFile(t, filePath, int(MinPartSize*3))
+	// an uploader restarted after uploading the first part
+	server.uploads["100"] = map[int64][]byte{1: data[:MinPartSize]}
+	f, err := os.Open(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+	head, err := GetHeadHash(f, int64(len(data)))
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	state := &MultipartUploadState{Bucket: "bucket", Key: "prefix/a.zip", UploadId: "100", Size: int64(len(data)), PartSize: MinPartSize, Head: head}
+	assert.Equal(t, nil, WriteMultipartUploadState(filepath.Join(stateDir, "a.zip.json"), state))
+	assert.Equal(t, nil, s.PutObject("bucket", "prefix/a.zip", f, nil))
+	assert.Equal(t, true, bytes.Equal(data, server.objects["bucket/prefix/a.zip"]))
+	assert.Equal(t, map[int64]int{2: 1, 3: 1}, server.partCalls)
+
+	// stale upload IDs are replaced with a new upload
+	assert.Equal(t, nil, WriteMultipartUploadState(filepath.Join(stateDir, "a.zip.json"), state))
+	server.partCalls = make(map[int64]int)
+	assert.Equal(t, nil, s.PutObject("bucket", "prefix/a.zip", f, nil))
+	assert.Equal(t, map[int64]int{1: 1, 2: 1, 3: 1}, server.partCalls)
+
+	// uploaded parts of different contents are not reused
+	server.uploads["200"] = map[int64][]byte{1: data[:MinPartSize]}
+	state.UploadId, state.Head = "200", "other"
+	assert.Equal(t, nil, WriteMultipartUploadState(filepath.Join(stateDir, "a.zip.json"), state))
+	server.partCalls = make(map[int64]int)
+	assert.Equal(t, nil, s.PutObject("bucket", "prefix/a.zip", f, nil))
+	assert.Equal(t, map[int64]int{1: 1, 2: 1, 3: 1}, server.partCalls)
+	_, ok := server.uploads["200"]
+	assert.Equal(t, false, ok)
+}
+
+func TestAbortMultipartObject(t *testing.T) {
+	server := NewFakeS3Server()
+	defer server.Close()
+	tmpDir := t.TempDir()
+	stateDir := filepath.Join(tmpDir, "uploads")
+	s := NewFakeS3Client(server, MultipartConfig{PartSize: MinPartSize, Concurrency: 1, MaxAttempts: 2, StateDir: stateDir})
+
+	filePath := filepath.Join(tmpDir, "a.zip")
+	CreateTestFile(t, filePath, int(MinPartSize*2))
+	server.failParts[2] = true
+	f, err := os.Open(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+	assert.NotEqual(t, nil, s.PutObject("bucket", "prefix/a.zip", f, nil))
+	assert.Equal(t, 2, server.partCalls[2])
+	assert.Equal(t, 1, server.abortCalls)
+	assert.Equal(t, 0, len(server.uploads))
+	_, ok := server.objects["bucket/prefix/a.zip"]
+	assert.Equal(t, false, ok)
+	entries, _ := os.ReadDir(stateDir)
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestResumeMultipartObjectAfterRetryableError(t *testing.T) {
+	server := NewFakeS3Server()
+	defer server.Close()
+	tmpDir := t.TempDir()
+	stateDir := filepath.Join(tmpDir, "uploads")
+	s := NewFakeS3Client(server, MultipartConfig{PartSize: MinPartSize, Concurrency: 1, MaxAttempts: 1, StateDir: stateDir})
+
+	filePath := filepath.Join(tmpDir, "a.zip")
+	data := CreateTestFile(t, filePath, int(MinPartSize*2))
+	server.failParts[2] = true
+	server.failStatus = http.StatusServiceUnavailable
+	f, err := os.Open(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+	assert.NotEqual(t, nil, s.PutObject("bucket", "prefix/a.zip", f, nil))
+	// the upload ID is kept for the next attempt of the retry queue
+	assert.Equal(t, 0, server.abortCalls)
+	assert.Equal(t, 1, len(server.uploads))
+	assert.NotEqual(t, (*MultipartUploadState)(nil), ReadMultipartUploadState(filepath.Join(stateDir, "a.zip.json")))
+
+	delete(server.failParts, 2)
+	assert.Equal(t, nil, s.PutObject("bucket", "prefix/a.zip", f, nil))
+	assert.Equal(t, true, bytes.Equal(data, server.objects["bucket/prefix/a.zip"]))
+	assert.Equal(t, map[int64]int{1: 1, 2: 2}, server.partCalls)
+	assert.Equal(t, 0, server.abortCalls)
+}
+
+func TestIsRetryableS3Error(t *testing.T) {
+	assert.Equal(t, true, IsRetryableS3Error(awserr.New(request.ErrCodeRequestError, "connection reset", nil)))
+	assert.Equal(t, true, IsRetryableS3Error(awserr.NewRequestFailure(awserr.New("SlowDown", "", nil), http.StatusServiceUnavailable, "")))
+	assert.Equal(t, true, IsRetryableS3Error(awserr.NewRequestFailure(awserr.New("InternalError", "", nil), http.StatusInternalServerError, "")))
+	assert.Equal(t, false, IsRetryableS3Error(awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), http.StatusForbidden, "")))
+	assert.Equal(t, false, IsRetryableS3Error(awserr.NewRequestFailure(awserr.New("NoSuchUpload", "", nil), http.StatusNotFound, "")))
+}
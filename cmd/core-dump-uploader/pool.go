@@ -0,0 +1,151 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"sync"
+)
+
+// WorkerPool processes files with a bounded number of workers.
+// Namespaces take turns so that a namespace with many large core dumps does not block others.
+// A file path is never queued or processed twice at once.
+// Files are classified into namespaces by a dedicated goroutine since classify reads zip files.
+type WorkerPool struct {
+	lock       sync.Mutex
+	cond       *sync.Cond
+	pending    []string
+	queues     map[string][]string
+	namespaces []string
+	paths      map[string]bool
+	running    int
+	stopped    bool
+	classify   func(filePath string) (namespace string)
+	process    func(filePath string)
+	wg         sync.WaitGroup
+}
+
+func NewWorkerPool(concurrency int, classify func(filePath string) (namespace string), process func(filePath string)) *WorkerPool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	p := &WorkerPool{
+		pending: make([]string, 0), queues: make(map[string][]string), namespaces: make([]string, 0), paths: make(map[string]bool),
+		classify: classify, process: process,
+	}
+	p.cond = sync.NewCond(&p.lock)
+	p.wg.Add(1)
+	go p.classifier()
+	for i := 0; i < concurrency; i++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+	return p
+}
+
+// Submit returns false if filePath is already queued or being processed, or the pool is stopped.
+// It does not block callers such as the event loop of Uploader.Run.
+func (p *WorkerPool) Submit(filePath string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stopped || p.paths[filePath] {
+		return false
+	}
+	p.paths[filePath] = true
+	p.pending = append(p.pending, filePath)
+	p.cond.Broadcast()
+	return true
+}
+
+func (p *WorkerPool) classifier() {
+	defer p.wg.Done()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for {
+		for !p.stopped && len(p.pending) == 0 {
+			p.cond.Wait()
+		}
+		if p.stopped {
+			return
+		}
+		filePath := p.pending[0]
+		p.pending = p.pending[1:]
+		p.lock.Unlock()
+
+		namespace := p.classify(filePath)
+
+		p.lock.Lock()
+		if p.stopped {
+			delete(p.paths, filePath)
+			p.cond.Broadcast()
+			return
+		}
+		if len(p.queues[namespace]) == 0 {
+			p.namespaces = append(p.namespaces, namespace)
+		}
+		p.queues[namespace] = append(p.queues[namespace], filePath)
+		p.cond.Broadcast()
+	}
+}
+
+// next must be called with p.lock held
+func (p *WorkerPool) next() string {
+	namespace := p.namespaces[0]
+	p.namespaces = p.namespaces[1:]
+	queue := p.queues[namespace]
+	filePath := queue[0]
+	if len(queue) == 1 {
+		delete(p.queues, namespace)
+	} else {
+		p.queues[namespace] = queue[1:]
+		p.namespaces = append(p.namespaces, namespace)
+	}
+	return filePath
+}
+
+func (p *WorkerPool) worker() {
+	defer p.wg.Done()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for {
+		for !p.stopped && len(p.namespaces) == 0 {
+			p.cond.Wait()
+		}
+		if p.stopped {
+			return
+		}
+		filePath := p.next()
+		p.running += 1
+		p.lock.Unlock()
+
+		p.process(filePath)
+
+		p.lock.Lock()
+		p.running -= 1
+		delete(p.paths, filePath)
+		p.cond.Broadcast()
+	}
+}
+
+// Wait blocks until no files are queued or being processed
+func (p *WorkerPool) Wait() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for !p.stopped && (len(p.paths) > 0 || p.running > 0) {
+		p.cond.Wait()
+	}
+}
+
+// Stop drops queued files and waits for running workers. Dropped files are found again by the next sweep.
+func (p *WorkerPool) Stop() {
+	p.lock.Lock()
+	p.stopped = true
+	p.pending = p.pending[:0]
+	p.queues = make(map[string][]string)
+	p.namespaces = p.namespaces[:0]
+	p.cond.Broadcast()
+	p.lock.Unlock()
+	p.wg.Wait()
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolFairness(t *testing.T) {
+	block := make(chan struct{})
+	var lock sync.Mutex
+	processed := make([]string, 0)
+	classify := func(filePath string) string {
+		return strings.Split(filePath, "/")[0]
+	}
+	p := NewWorkerPool(1, classify, func(filePath string) {
+		if filePath == "blocker" {
+			<-block
+			return
+		}
+		lock.Lock()
+		processed = append(processed, filePath)
+		lock.Unlock()
+	})
+	defer p.Stop()
+
+	// queue files while the single worker is busy
+	assert.Equal(t, true, p.Submit("blocker"))
+	assert.Eventually(t, func() bool {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		return p.running == 1
+	}, time.Second, 10*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, true, p.Submit(fmt.Sprintf("a/%d.zip", i)))
+	}
+	assert.Equal(t, true, p.Submit("b/0.zip"))
+	assert.Equal(t, true, p.Submit("c/0.zip"))
+	assert.Eventually(t, func() bool {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		return len(p.pending) == 0 && len(p.namespaces) == 3
+	}, time.Second, 10*time.Millisecond)
+	close(block)
+	p.Wait()
+	assert.Equal(t, []string{"a/0.zip", "b/0.zip", "c/0.zip", "a/1.zip", "a/2.zip"}, processed)
+}
+
+func TestWorkerPoolDedup(t *testing.T) {
+	block := make(chan struct{})
+	var lock sync.Mutex
+	counts := make(map[string]int)
+	p := NewWorkerPool(4, func(string) string { return "" }, func(filePath string) {
+		<-block
+		lock.Lock()
+		counts[filePath] += 1
+		lock.Unlock()
+	})
+	assert.Equal(t, true, p.Submit("a.zip"))
+	assert.Equal(t, false, p.Submit("a.zip"))
+	assert.Equal(t, true, p.Submit("b.zip"))
+	close(block)
+	p.Wait()
+	assert.Equal(t, map[string]int{"a.zip": 1, "b.zip": 1}, counts)
+
+	// a path can be submitted again after completion
+	assert.Equal(t, true, p.Submit("a.zip"))
+	p.Wait()
+	assert.Equal(t, 2, counts["a.zip"])
+
+	p.Stop()
+	assert.Equal(t, false, p.Submit("c.zip"))
+}
+
+func TestWorkerPoolConcurrency(t *testing.T) {
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	p := NewWorkerPool(3, func(string) string { return "" }, func(string) {
+		lock.Lock()
+		running += 1
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		lock.Lock()
+		running -= 1
+		lock.Unlock()
+	})
+	defer p.Stop()
+	for i := 0; i < 10; i++ {
+		p.Submit(fmt.Sprintf("%d.zip", i))
+	}
+	p.Wait()
+	assert.Equal(t, 3, maxRunning)
+}
+
+func TestWorkerPoolSubmitDoesNotClassify(t *testing.T) {
+	block := make(chan struct{})
+	processed := make(chan string, 2)
+	p := NewWorkerPool(1, func(filePath string) string {
+		if filePath == "slow.zip" {
+			<-block
+		}
+		return ""
+	}, func(filePath string) {
+		processed <- filePath
+	})
+	defer p.Stop()
+
+	// a slow file does not block callers of Submit
+	assert.Equal(t, true, p.Submit("slow.zip"))
+	submitted := make(chan bool)
+	go func() { submitted <- p.Submit("a.zip") }()
+	select {
+	case ok := <-submitted:
+		assert.Equal(t, true, ok)
+	case <-time.After(time.Second):
+		t.Errorf("Failed: Submit blocked while classifying another file")
+	}
+	close(block)
+	p.Wait()
+	assert.Equal(t, "slow.zip", <-processed)
+	assert.Equal(t, "a.zip", <-processed)
+}
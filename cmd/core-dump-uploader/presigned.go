@@ -0,0 +1,448 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	DestinationTypePresigned = "presigned"
+	// presignedFilenameVariable in fields of POST policies is replaced with the file name by object storage
+	presignedFilenameVariable = "${filename}"
+	presignedMaxSignerBody    = 64 * 1024
+	// presignedConfigMapPrefix followed by a namespace names the ConfigMap of claimed presignedUrls
+	presignedConfigMapPrefix = "core-dump-presigned-"
+	presignedConfigMapKey    = "state.json"
+)
+
+// PresignedTarget is an upload URL issued by a tenant. A JSON string is a URL for PUT.
+type PresignedTarget struct {
+	Url     string            `json:"url"`
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Fields are form fields of a POST policy. The file is sent as the last field named "file".
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+func (t *PresignedTarget) UnmarshalJSON(buf []byte) error {
+	var u string
+	if err := json.Unmarshal(buf, &u); err == nil {
+		*t = PresignedTarget{Url: u}
+	} else {
+		type target PresignedTarget
+		var v target
+		if err := json.Unmarshal(buf, &v); err != nil {
+			return err
+		}
+		*t = PresignedTarget(v)
+	}
+	if t.Method == "" {
+		t.Method = http.MethodPut
+		if t.Fields != nil {
+			t.Method = http.MethodPost
+		}
+	}
+	t.Method = strings.ToUpper(t.Method)
+	return nil
+}
+
+func (t *PresignedTarget) Validate() error {
+	u, err := url.Parse(t.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http(s) URL, err=%v", err)
+	}
+	if t.Method != http.MethodPut && t.Method != http.MethodPost {
+		return fmt.Errorf("method must be PUT or POST, %v", t.Method)
+	}
+	if t.Fields != nil && t.Method != http.MethodPost {
+		return fmt.Errorf("fields require POST")
+	}
+	return nil
+}
+
+// GetLocation does not contain signatures in queries for logging
+func (t *PresignedTarget) GetLocation() string {
+	u, err := url.Parse(t.Url)
+	if err != nil {
+		return "<malformed url>"
+	}
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+// IsReusable returns true for POST policies that name objects with ${filename}. Other targets are used once.
+func (t *PresignedTarget) IsReusable() bool {
+	return t.Method == http.MethodPost && strings.Contains(t.Fields["key"], presignedFilenameVariable)
+}
+
+// GetHash identifies a target in upload states without keeping signatures
+func (t *PresignedTarget) GetHash() string {
+	sum := sha256.Sum256([]byte(t.Url + "\n" + t.Fields["key"] + "\n" + t.Fields["policy"]))
+	return hex.EncodeToString(sum[:])
+}
+
+// PresignedDestinationSecret is configured with entries of core-dump-handler secrets with type=presigned.
+// Either SignerUrl or Targets is set.
+type PresignedDestinationSecret struct {
+	// SignerUrl issues a PresignedTarget for each file
+	SignerUrl   string
+	SignerToken string
+	Targets     []PresignedTarget
+	// TlsConfig is nil if the secret has neither a client certificate nor a CA bundle
+	TlsConfig *tls.Config
+}
+
+func NewPresignedDestinationSecret(data map[string][]byte) (*PresignedDestinationSecret, error) {
+	c := &PresignedDestinationSecret{SignerUrl: string(data["signerUrl"]), SignerToken: string(data["signerToken"])}
+	if (c.SignerUrl == "") == (len(data["presignedUrls"]) == 0) {
+		return nil, fmt.Errorf("failed: NewPresignedDestinationSecret, malformed core-dump-handler secret, either signerUrl or presignedUrls is required")
+	}
+	scheme := "https"
+	if c.SignerUrl != "" {
+		u, err := url.Parse(c.SignerUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("failed: NewPresignedDestinationSecret, malformed core-dump-handler secret, signerUrl must be an http(s) URL, err=%v", err)
+		}
+		scheme = u.Scheme
+	} else {
+		if err := json.Unmarshal(data["presignedUrls"], &c.Targets); err != nil {
+			return nil, fmt.Errorf("failed: NewPresignedDestinationSecret, malformed core-dump-handler secret, presignedUrls must be a JSON array, err=%v", err)
+		}
+		for i := range c.Targets {
+			if err := c.Targets[i].Validate(); err != nil {
+				return nil, fmt.Errorf("failed: NewPresignedDestinationSecret, malformed core-dump-handler secret, presignedUrls[%v]: %v", i, err)
+			}
+		}
+	}
+	tlsConfig, err := NewTlsConfig(data, scheme)
+	if err != nil {
+		return nil, fmt.Errorf("failed: NewPresignedDestinationSecret, malformed core-dump-handler secret, %v", err)
+	}
+	c.TlsConfig = tlsConfig
+	return c, nil
+}
+
+// PresignedUploadState records targets that uploaders on any node claimed in a namespace
+type PresignedUploadState struct {
+	Claimed []string `json:"claimed"`
+}
+
+// PresignedClaimStore keeps claimed targets of namespaces where uploaders on all nodes see them
+type PresignedClaimStore interface {
+	// Update applies f to claimed hashes of namespace and saves them if f returns true. f is called again after conflicts.
+	Update(namespace string, f func(claimed map[string]bool) bool) error
+}
+
+// ConfigMapClaimStore keeps claimed targets in a ConfigMap per namespace in the namespace of the uploader.
+// Updates with stale resourceVersions conflict, so two nodes never claim the same target.
+type ConfigMapClaimStore struct {
+	k8sClient K8sClient
+	namespace string
+}
+
+func NewConfigMapClaimStore(k8sClient K8sClient, namespace string) *ConfigMapClaimStore {
+	return &ConfigMapClaimStore{k8sClient: k8sClient, namespace: namespace}
+}
+
+func (s *ConfigMapClaimStore) Update(namespace string, f func(claimed map[string]bool) bool) error {
+	if err := s.k8sClient.Start(); err != nil {
+		return err
+	}
+	client := s.k8sClient.GetRawClient()
+	name := presignedConfigMapPrefix + namespace
+	isConflict := func(err error) bool { return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) }
+	err := retry.OnError(retry.DefaultRetry, isConflict, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), k8sRequestTimeout)
+		defer cancel()
+		cm, err := client.CoreV1().ConfigMaps(s.namespace).Get(ctx, name, metav1.GetOptions{})
+		notFound := apierrors.IsNotFound(err)
+		if notFound {
+			cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: s.namespace}}
+		} else if err != nil {
+			return err
+		}
+		claimed := make(map[string]bool)
+		if v, ok := cm.Data[presignedConfigMapKey]; ok {
+			var state PresignedUploadState
+			// overwriting malformed states would reuse URLs. delete the ConfigMap to reset claims.
+			if err := json.Unmarshal([]byte(v), &state); err != nil {
+				return fmt.Errorf("malformed %v, err=%v", presignedConfigMapKey, err)
+			}
+			for _, hash := range state.Claimed {
+				claimed[hash] = true
+			}
+		}
+		if !f(claimed) {
+			return nil
+		}
+		state := PresignedUploadState{Claimed: make([]string, 0, len(claimed))}
+		for hash := range claimed {
+			state.Claimed = append(state.Claimed, hash)
+		}
+		sort.Strings(state.Claimed)
+		buf, _ := json.Marshal(&state)
+		cm.Data = map[string]string{presignedConfigMapKey: string(buf)}
+		if notFound {
+			_, err = client.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{})
+		} else {
+			_, err = client.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed: ConfigMapClaimStore.Update, namespace=%v, name=%v, err=%v", s.namespace, name, err)
+	}
+	return nil
+}
+
+// presignedPool claims targets of a namespace for uploads
+type presignedPool struct {
+	claims    PresignedClaimStore
+	namespace string
+}
+
+// Reserve claims the first target that no uploader has claimed. POST policies with ${filename} are returned without claims.
+// Targets stay claimed if uploaders crash before Release, so they are never used twice.
+func (p *presignedPool) Reserve(targets []PresignedTarget) (*PresignedTarget, error) {
+	if len(targets) > 0 && targets[0].IsReusable() {
+		return &targets[0], nil
+	}
+	var target *PresignedTarget = nil
+	err := p.claims.Update(p.namespace, func(claimed map[string]bool) bool {
+		target = nil
+		// drop hashes that are not in targets to keep the state small
+		hashes := make(map[string]bool)
+		for i := range targets {
+			hash := targets[i].GetHash()
+			hashes[hash] = true
+			if target == nil && (targets[i].IsReusable() || !claimed[hash]) {
+				target = &targets[i]
+			}
+		}
+		for hash := range claimed {
+			if !hashes[hash] {
+				delete(claimed, hash)
+			}
+		}
+		if target == nil || target.IsReusable() {
+			return false
+		}
+		claimed[target.GetHash()] = true
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed: presignedPool.Reserve, %v", err)
+	}
+	if target == nil {
+		return nil, fmt.Errorf("failed: presignedPool.Reserve, all %v presignedUrls were used, add new URLs to the secret", len(targets))
+	}
+	return target, nil
+}
+
+// Release unclaims target if consumed is false so that later uploads use it
+func (p *presignedPool) Release(target *PresignedTarget, consumed bool) {
+	if consumed || target.IsReusable() {
+		return
+	}
+	hash := target.GetHash()
+	err := p.claims.Update(p.namespace, func(claimed map[string]bool) bool {
+		if !claimed[hash] {
+			return false
+		}
+		delete(claimed, hash)
+		return true
+	})
+	if err != nil {
+		log.Printf("WARN: presignedPool.Release, url=%v, %v", target.GetLocation(), err)
+	}
+}
+
+// PresignedDestination uploads files to URLs that tenants sign so that nodes never hold credentials of object storage
+type PresignedDestination struct {
+	c          *PresignedDestinationSecret
+	namespace  string
+	httpClient *http.Client
+	// maxAttempts is the number of attempts to send a file (--httpMaxAttempts)
+	maxAttempts int
+	pool        *presignedPool
+	sleep       func(time.Duration)
+}
+
+// NewPresignedDestinationFactory shares claimed presignedUrls of each namespace among nodes with claims
+func NewPresignedDestinationFactory(claims PresignedClaimStore, maxAttempts int, httpClient *http.Client) DestinationFactory {
+	return func(namespace string, data map[string][]byte) (Destination, error) {
+		c, err := NewPresignedDestinationSecret(data)
+		if err != nil {
+			return nil, err
+		}
+		return &PresignedDestination{
+			c: c, namespace: namespace, httpClient: NewTlsClient(httpClient, c.TlsConfig), maxAttempts: maxAttempts,
+			pool: &presignedPool{claims: claims, namespace: namespace}, sleep: time.Sleep,
+		}, nil
+	}
+}
+
+func (d *PresignedDestination) Prepare() error {
+	return nil
+}
+
+// Sign requests a target for key from the signer of the tenant
+func (d *PresignedDestination) Sign(key string, size int64, opts *ObjectOptions) (*PresignedTarget, error) {
+	body := map[string]interface{}{"namespace": d.namespace, "key": key, "size": size}
+	if opts != nil && len(opts.Metadata) > 0 {
+		body["metadata"] = opts.Metadata
+	}
+	buf, _ := json.Marshal(body)
+	req, err := http.NewRequest(http.MethodPost, d.c.SignerUrl, bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("failed: PresignedDestination.Sign, NewRequest, err=%v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.c.SignerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+d.c.SignerToken)
+	}
+	res, err := d.httpClient.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, NewHttpError(res)
+	}
+	var target PresignedTarget
+	if err := json.NewDecoder(io.LimitReader(res.Body, presignedMaxSignerBody)).Decode(&target); err != nil {
+		return nil, fmt.Errorf("failed: PresignedDestination.Sign, malformed response, err=%v", err)
+	}
+	if err := target.Validate(); err != nil {
+		return nil, fmt.Errorf("failed: PresignedDestination.Sign, malformed response, %v", err)
+	}
+	return &target, nil
+}
+
+// GetPostBody wraps f in a multipart form with fields of a POST policy. The file is the last part as object storage requires.
+func GetPostBody(target *PresignedTarget, key string, f *os.File, size int64) (io.Reader, int64, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	names := make([]string, 0, len(target.Fields))
+	for name := range target.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := w.WriteField(name, target.Fields[name]); err != nil {
+			return nil, 0, "", err
+		}
+	}
+	if _, err := w.CreateFormFile("file", key); err != nil {
+		return nil, 0, "", err
+	}
+	prefix := append([]byte{}, buf.Bytes()...)
+	buf.Reset()
+	if err := w.Close(); err != nil {
+		return nil, 0, "", err
+	}
+	suffix := buf.Bytes()
+	body := io.MultiReader(bytes.NewReader(prefix), io.NewSectionReader(f, 0, size), bytes.NewReader(suffix))
+	return body, int64(len(prefix)) + size + int64(len(suffix)), w.FormDataContentType(), nil
+}
+
+// Upload sends f to target and returns HttpError if status is not 2xx
+func (d *PresignedDestination) Upload(target *PresignedTarget, key string, f *os.File, size int64) error {
+	var body io.Reader = io.NewSectionReader(f, 0, size)
+	length, contentType := size, ""
+	if target.Method == http.MethodPost {
+		var err error
+		if body, length, contentType, err = GetPostBody(target, key, f, size); err != nil {
+			return fmt.Errorf("failed: PresignedDestination.Upload, GetPostBody, err=%v", err)
+		}
+	}
+	req, err := http.NewRequest(target.Method, target.Url, body)
+	if err != nil {
+		return fmt.Errorf("failed: PresignedDestination.Upload, NewRequest, url=%v, err=%v", target.GetLocation(), err)
+	}
+	req.ContentLength = length
+	if length == 0 {
+		req.Body = http.NoBody
+	}
+	for name, value := range target.Headers {
+		req.Header.Set(name, value)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := d.httpClient.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = target.GetLocation()
+		}
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	return NewHttpError(res)
+}
+
+// Put requests a new target for every attempt from the signer. Otherwise, it uses a target in presignedUrls that no node has claimed.
+func (d *PresignedDestination) Put(key string, f *os.File, opts *ObjectOptions) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed: PresignedDestination.Put, Stat, f.Name()=%v, err=%v", f.Name(), err)
+	}
+	if d.c.TlsConfig != nil {
+		defer d.httpClient.CloseIdleConnections()
+	}
+	var target *PresignedTarget = nil
+	if d.c.SignerUrl != "" {
+		err = SendWithRetries(d.maxAttempts, d.sleep, key, func() error {
+			var err error
+			if target, err = d.Sign(key, stat.Size(), opts); err != nil {
+				return err
+			}
+			return d.Upload(target, key, f, stat.Size())
+		})
+	} else {
+		if target, err = d.pool.Reserve(d.c.Targets); err != nil {
+			return err
+		}
+		err = SendWithRetries(d.maxAttempts, d.sleep, key, func() error {
+			return d.Upload(target, key, f, stat.Size())
+		})
+		// expired or rejected URLs are not retried with later uploads
+		e, ok := err.(*HttpError)
+		d.pool.Release(target, err == nil || (ok && !e.IsRetryable()))
+	}
+	if err != nil {
+		return fmt.Errorf("failed: PresignedDestination.Put, key=%v, err=%v", key, err)
+	}
+	log.Printf("INFO: PresignedDestination.Put: %v->%v", f.Name(), target.GetLocation())
+	return nil
+}
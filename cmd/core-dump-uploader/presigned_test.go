@@ -0,0 +1,271 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestNewPresignedDestinationSecret(t *testing.T) {
+	c, err := NewPresignedDestinationSecret(map[string][]byte{
+		"presignedUrls": []byte(`["https://s3.example.com/b/a.zip?X-Amz-Signature=1", {"url": "https://s3.example.com/b", "fields": {"key": "cores/${filename}"}}]`),
+	})
+	if assert.Equal(t, nil, err) && assert.Equal(t, 2, len(c.Targets)) {
+		assert.Equal(t, http.MethodPut, c.Targets[0].Method)
+		assert.Equal(t, false, c.Targets[0].IsReusable())
+		assert.Equal(t, "https://s3.example.com/b/a.zip", c.Targets[0].GetLocation())
+		assert.Equal(t, http.MethodPost, c.Targets[1].Method)
+		assert.Equal(t, true, c.Targets[1].IsReusable())
+	}
+	c, err = NewPresignedDestinationSecret(map[string][]byte{"signerUrl": []byte("https://signer.example.com/sign"), "signerToken": []byte("token")})
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "token", c.SignerToken)
+	}
+	for _, data := range []map[string][]byte{
+		{}, {"signerUrl": []byte("https://signer.example.com/sign"), "presignedUrls": []byte(`[]`)}, {"signerUrl": []byte("signer")},
+		{"presignedUrls": []byte(`{}`)}, {"presignedUrls": []byte(`["ftp://example.com/a.zip"]`)},
+		{"presignedUrls": []byte(`[{"url": "https://example.com/a.zip", "method": "GET"}]`)},
+		{"presignedUrls": []byte(`[{"url": "https://example.com/a.zip", "method": "PUT", "fields": {}}]`)},
+	} {
+		_, err = NewPresignedDestinationSecret(data)
+		assert.NotEqual(t, nil, err, "data=%v", data)
+	}
+}
+
+func TestPresignedDestinationSigner(t *testing.T) {
+	upload := NewFakeHttpServer(http.StatusServiceUnavailable)
+	upload.server.Start()
+	defer upload.Close()
+	signRequests := make([]map[string]interface{}, 0)
+	signer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		signRequests = append(signRequests, body)
+		json.NewEncoder(w).Encode(&PresignedTarget{
+			Url: upload.server.URL + "/bucket/" + body["key"].(string) + "?X-Amz-Signature=secret", Headers: map[string]string{"x-amz-meta-pod": "app-0"},
+		})
+	}))
+	defer signer.Close()
+
+	tmpDir := t.TempDir()
+	r := NewDestinationRegistry()
+	r.Register(DestinationTypePresigned, NewPresignedDestinationFactory(NewTestClaimStore(fake.NewSimpleClientset()), 2, http.DefaultClient))
+	data := map[string][]byte{"type": []byte(DestinationTypePresigned), "signerUrl": []byte(signer.URL + "/sign"), "signerToken": []byte("token")}
+	d, err := r.NewDestination(DestinationTypePresigned, "test", data)
+	if !assert.Equal(t, nil, err) || !assert.Equal(t, nil, d.Prepare()) {
+		return
+	}
+	d.(*PresignedDestination).sleep = func(time.Duration) {}
+
+	filePath := filepath.Join(tmpDir, "a.zip")
+	expected := CreateTestFile(t, filePath, 1024)
+	f, err := os.Open(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+	opts := &ObjectOptions{Metadata: map[string]string{"pod-name": "app-0"}}
+	if assert.Equal(t, nil, d.Put("test/a.zip", f, opts)) {
+		// every attempt uses a new URL
+		assert.Equal(t, 2, len(signRequests))
+		assert.Equal(t, "test", signRequests[0]["namespace"])
+		assert.Equal(t, "test/a.zip", signRequests[0]["key"])
+		assert.Equal(t, float64(1024), signRequests[0]["size"])
+		assert.Equal(t, map[string]interface{}{"pod-name": "app-0"}, signRequests[0]["metadata"])
+		req := upload.requests[1]
+		assert.Equal(t, http.MethodPut, req.Method)
+		assert.Equal(t, "/bucket/test/a.zip", req.URL.Path)
+		assert.Equal(t, "app-0", req.Header.Get("x-amz-meta-pod"))
+		assert.Equal(t, true, bytes.Equal(expected, upload.bodies[1]))
+	}
+
+	data["signerToken"] = []byte("wrong")
+	d, err = r.NewDestination(DestinationTypePresigned, "test", data)
+	if assert.Equal(t, nil, err) {
+		err = d.Put("test/a.zip", f, opts)
+		if assert.NotEqual(t, nil, err) {
+			assert.Contains(t, err.Error(), "status=401")
+		}
+		assert.Equal(t, 2, len(signRequests))
+	}
+}
+
+func NewTestClaimStore(client kubernetes.Interface) PresignedClaimStore {
+	return NewConfigMapClaimStore(&MockK8sClient{rawClient: client}, "core-dump-handler")
+}
+
+func TestPresignedDestinationUrls(t *testing.T) {
+	upload := NewFakeHttpServer()
+	upload.server.Start()
+	defer upload.Close()
+	tmpDir := t.TempDir()
+	client := fake.NewSimpleClientset()
+	// each registry is an uploader on a different node
+	newRegistry := func() *DestinationRegistry {
+		r := NewDestinationRegistry()
+		r.Register(DestinationTypePresigned, NewPresignedDestinationFactory(NewTestClaimStore(client), 1, http.DefaultClient))
+		return r
+	}
+	urls, _ := json.Marshal([]string{upload.server.URL + "/b/1.zip?X-Amz-Signature=1", upload.server.URL + "/b/2.zip?X-Amz-Signature=2"})
+	data := map[string][]byte{"presignedUrls": urls}
+	r := newRegistry()
+	d, err := r.NewDestination(DestinationTypePresigned, "test", data)
+	if !assert.Equal(t, nil, err) || !assert.Equal(t, nil, d.Prepare()) {
+		return
+	}
+
+	filePath := filepath.Join(tmpDir, "a.zip")
+	CreateTestFile(t, filePath, 1024)
+	f, err := os.Open(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+	// URLs that fail with retryable errors are reused
+	upload.statuses = []int{http.StatusInternalServerError}
+	assert.NotEqual(t, nil, d.Put("test/a.zip", f, nil))
+	assert.Equal(t, nil, d.Put("test/a.zip", f, nil))
+	assert.Equal(t, "/b/1.zip", upload.requests[0].URL.Path)
+	assert.Equal(t, "/b/1.zip", upload.requests[1].URL.Path)
+	cm, err := client.CoreV1().ConfigMaps("core-dump-handler").Get(context.TODO(), presignedConfigMapPrefix+"test", metav1.GetOptions{})
+	if assert.Equal(t, nil, err) {
+		assert.NotContains(t, cm.Data[presignedConfigMapKey], "Signature")
+	}
+	// rejected URLs are not reused
+	upload.statuses = []int{http.StatusForbidden}
+	assert.NotEqual(t, nil, d.Put("test/b.zip", f, nil))
+	assert.Equal(t, "/b/2.zip", upload.requests[2].URL.Path)
+
+	// other nodes and restarted uploaders do not reuse URLs
+	d, err = newRegistry().NewDestination(DestinationTypePresigned, "test", data)
+	if assert.Equal(t, nil, err) {
+		err = d.Put("test/c.zip", f, nil)
+		if assert.NotEqual(t, nil, err) {
+			assert.Contains(t, err.Error(), "were used")
+		}
+	}
+	assert.Equal(t, 3, len(upload.requests))
+	// other namespaces have their own URLs
+	d, err = r.NewDestination(DestinationTypePresigned, "other", data)
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, nil, d.Put("other/c.zip", f, nil))
+	}
+}
+
+func TestPresignedPoolConflict(t *testing.T) {
+	c, err := NewPresignedDestinationSecret(map[string][]byte{"presignedUrls": []byte(`["https://s3.example.com/b/1.zip", "https://s3.example.com/b/2.zip"]`)})
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	client := fake.NewSimpleClientset()
+	pool := &presignedPool{claims: NewTestClaimStore(client), namespace: "test"}
+	// the first claim creates the ConfigMap
+	target, err := pool.Reserve(c.Targets)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	pool.Release(target, false)
+	// another node claims 1.zip between Get and Update
+	conflicts := 0
+	client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts += 1
+		cm := action.(k8stesting.UpdateAction).GetObject().(*corev1.ConfigMap).DeepCopy()
+		state, _ := json.Marshal(&PresignedUploadState{Claimed: []string{c.Targets[0].GetHash()}})
+		cm.Data[presignedConfigMapKey] = string(state)
+		if err := client.Tracker().Update(corev1.SchemeGroupVersion.WithResource("configmaps"), cm, cm.Namespace); err != nil {
+			return true, nil, err
+		}
+		return true, nil, apierrors.NewConflict(corev1.Resource("configmaps"), cm.Name, fmt.Errorf("modified"))
+	})
+	target, err = pool.Reserve(c.Targets)
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, 1, conflicts)
+		assert.Equal(t, "https://s3.example.com/b/2.zip", target.Url)
+	}
+	_, err = pool.Reserve(c.Targets)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestPresignedDestinationPostPolicy(t *testing.T) {
+	upload := NewFakeHttpServer()
+	upload.server.Start()
+	defer upload.Close()
+	tmpDir := t.TempDir()
+	r := NewDestinationRegistry()
+	r.Register(DestinationTypePresigned, NewPresignedDestinationFactory(NewTestClaimStore(fake.NewSimpleClientset()), 1, http.DefaultClient))
+	targets, _ := json.Marshal([]PresignedTarget{{Url: upload.server.URL + "/b", Fields: map[string]string{"key": "cores/${filename}", "policy": "p", "x-amz-signature": "s"}}})
+	d, err := r.NewDestination(DestinationTypePresigned, "test", map[string][]byte{"presignedUrls": targets})
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+
+	filePath := filepath.Join(tmpDir, "a.zip")
+	expected := CreateTestFile(t, filePath, 1024)
+	f, err := os.Open(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+	// POST policies with ${filename} are reusable
+	for i, key := range []string{"test/a.zip", "test/b.zip"} {
+		if !assert.Equal(t, nil, d.Put(key, f, nil)) {
+			return
+		}
+		req := upload.requests[i]
+		assert.Equal(t, http.MethodPost, req.Method)
+		assert.Equal(t, int64(len(upload.bodies[i])), req.ContentLength)
+		_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if !assert.Equal(t, nil, err) {
+			return
+		}
+		fields := make(map[string]string)
+		mr := multipart.NewReader(bytes.NewReader(upload.bodies[i]), params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				assert.Equal(t, io.EOF, err)
+				break
+			}
+			buf, _ := io.ReadAll(part)
+			if part.FormName() == "file" {
+				assert.Contains(t, part.Header.Get("Content-Disposition"), `filename="`+key+`"`)
+				assert.Equal(t, true, bytes.Equal(expected, buf))
+				assert.Equal(t, 3, len(fields))
+			} else {
+				fields[part.FormName()] = string(buf)
+			}
+		}
+		assert.Equal(t, "cores/${filename}", fields["key"])
+	}
+}
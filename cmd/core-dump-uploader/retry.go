@@ -0,0 +1,256 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const retryStateSuffix = ".state.json"
+
+// RetryState is stored next to a zip file in the retry and dead-letter directories
+type RetryState struct {
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+// PermanentError fails uploads that retries cannot fix, e.g., namespaces that were deleted or did not opt in
+type PermanentError struct {
+	err error
+}
+
+func NewPermanentError(err error) error {
+	return &PermanentError{err: err}
+}
+
+func (e *PermanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.err
+}
+
+func IsPermanentError(err error) bool {
+	var e *PermanentError
+	return errors.As(err, &e)
+}
+
+// RetryQueue keeps zip files that failed to upload until they succeed or exceed the maximum number of attempts
+type RetryQueue interface {
+	Succeed(filePath string)
+	// Discard removes files that failed with permanent errors
+	Discard(filePath string, cause error)
+	// Fail moves filePath into the retry dir or the dead-letter dir. It returns true if filePath was moved into the dead-letter dir.
+	Fail(filePath string, cause error) (bool, error)
+	Due() []string
+}
+
+type RetryQueueImpl struct {
+	retryDir       string
+	deadLetterDir  string
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	now            func() time.Time
+}
+
+func NewRetryQueue(retryDir string, deadLetterDir string, maxAttempts int, initialBackoff time.Duration, maxBackoff time.Duration) (RetryQueue, error) {
+	for _, dir := range []string{retryDir, deadLetterDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed: NewRetryQueue, MkdirAll, dir=%v, err=%v", dir, err)
+		}
+	}
+	if maxAttempts < 1 {
+		return nil, fmt.Errorf("failed: NewRetryQueue, maxAttempts must be positive, maxAttempts=%v", maxAttempts)
+	}
+	return &RetryQueueImpl{
+		retryDir: retryDir, deadLetterDir: deadLetterDir, maxAttempts: maxAttempts,
+		initialBackoff: initialBackoff, maxBackoff: maxBackoff, now: time.Now,
+	}, nil
+}
+
+func GetRetryStatePath(filePath string) string {
+	return filePath + retryStateSuffix
+}
+
+func (q *RetryQueueImpl) GetBackoff(attempts int) time.Duration {
+	backoff := q.initialBackoff
+	for i := 1; i < attempts && backoff < q.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > q.maxBackoff {
+		backoff = q.maxBackoff
+	}
+	return backoff
+}
+
+func (q *RetryQueueImpl) Succeed(filePath string) {
+	for _, p := range []string{filePath, GetRetryStatePath(filePath)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed: RetryQueue.Succeed, could not remove file %v, err=%v", p, err)
+		}
+	}
+}
+
+func (q *RetryQueueImpl) Discard(filePath string, cause error) {
+	for _, p := range []string{filePath, GetRetryStatePath(filePath)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed: RetryQueue.Discard, could not remove file %v, err=%v", p, err)
+		}
+	}
+	log.Printf("WARN: RetryQueue.Discard, removed %v without retries, err=%v", filePath, cause)
+}
+
+func (q *RetryQueueImpl) Fail(filePath string, cause error) (bool, error) {
+	state, err := ReadRetryState(GetRetryStatePath(filePath))
+	if err != nil {
+		return false, err
+	}
+	state.Attempts += 1
+	state.LastError = cause.Error()
+	destDir := q.retryDir
+	if state.Attempts >= q.maxAttempts {
+		destDir = q.deadLetterDir
+		state.NextAttempt = time.Time{}
+	} else {
+		state.NextAttempt = q.now().Add(q.GetBackoff(state.Attempts))
+	}
+	dest := filepath.Join(destDir, filepath.Base(filePath))
+	if dest != filePath {
+		if err := MoveFile(filePath, dest); err != nil {
+			return false, err
+		}
+		if err := os.Remove(GetRetryStatePath(filePath)); err != nil && !os.IsNotExist(err) {
+			log.Printf("WARN: RetryQueue.Fail, could not remove state %v, err=%v", GetRetryStatePath(filePath), err)
+		}
+	}
+	if err := WriteRetryState(GetRetryStatePath(dest), state); err != nil {
+		return false, err
+	}
+	if destDir == q.deadLetterDir {
+		log.Printf("WARN: RetryQueue.Fail, gave up %v after %v attempts, lastError=%v", dest, state.Attempts, state.LastError)
+	} else {
+		log.Printf("INFO: RetryQueue.Fail, retry %v at %v (attempts=%v), lastError=%v", dest, state.NextAttempt.Format(time.RFC3339), state.Attempts, state.LastError)
+	}
+	return destDir == q.deadLetterDir, nil
+}
+
+func (q *RetryQueueImpl) Due() []string {
+	entries, err := os.ReadDir(q.retryDir)
+	if err != nil {
+		log.Printf("WARN: RetryQueue.Due, ReadDir, retryDir=%v, err=%v", q.retryDir, err)
+		return nil
+	}
+	now := q.now()
+	ret := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".zip") {
+			continue
+		}
+		filePath := filepath.Join(q.retryDir, entry.Name())
+		state, err := ReadRetryState(GetRetryStatePath(filePath))
+		if err != nil {
+			log.Printf("WARN: RetryQueue.Due, retry %v without state, err=%v", filePath, err)
+		} else if state.NextAttempt.After(now) {
+			continue
+		}
+		ret = append(ret, filePath)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// ReadRetryState returns an empty state if statePath does not exist
+func ReadRetryState(statePath string) (*RetryState, error) {
+	state := &RetryState{}
+	buf, err := os.ReadFile(statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("failed: ReadRetryState, ReadFile, statePath=%v, err=%v", statePath, err)
+	}
+	if err := json.Unmarshal(buf, state); err != nil {
+		return nil, fmt.Errorf("failed: ReadRetryState, Unmarshal, statePath=%v, err=%v", statePath, err)
+	}
+	return state, nil
+}
+
+// WriteRetryState replaces statePath atomically
+func WriteRetryState(statePath string, state *RetryState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed: WriteRetryState, Marshal, statePath=%v, err=%v", statePath, err)
+	}
+	tmpPath := statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, buf, 0600); err != nil {
+		return fmt.Errorf("failed: WriteRetryState, WriteFile, tmpPath=%v, err=%v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, statePath); err != nil {
+		return fmt.Errorf("failed: WriteRetryState, Rename, tmpPath=%v, statePath=%v, err=%v", tmpPath, statePath, err)
+	}
+	return nil
+}
+
+// MoveFile renames src to dest. It copies the file if they are on different mounts (e.g., hostDir and hostDir/cores in uploader containers).
+func MoveFile(src string, dest string) error {
+	err := os.Rename(src, dest)
+	if err == nil || !errors.Is(err, unix.EXDEV) {
+		if err != nil {
+			return fmt.Errorf("failed: MoveFile, Rename, src=%v, dest=%v, err=%v", src, dest, err)
+		}
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed: MoveFile, Open, src=%v, err=%v", src, err)
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("failed: MoveFile, Stat, src=%v, err=%v", src, err)
+	}
+	tmpPath := dest + ".tmp"
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed: MoveFile, OpenFile, tmpPath=%v, err=%v", tmpPath, err)
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed: MoveFile, Copy, src=%v, tmpPath=%v, err=%v", src, tmpPath, err)
+	}
+	// keep mtime like rename for keys of core dumps without timestamps
+	if err := os.Chtimes(tmpPath, stat.ModTime(), stat.ModTime()); err != nil {
+		log.Printf("WARN: MoveFile, Chtimes, tmpPath=%v, err=%v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, dest); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed: MoveFile, Rename, tmpPath=%v, dest=%v, err=%v", tmpPath, dest, err)
+	}
+	if err := os.Remove(src); err != nil && !os.IsNotExist(err) {
+		log.Printf("WARN: MoveFile, could not remove %v, err=%v", src, err)
+	}
+	return nil
+}
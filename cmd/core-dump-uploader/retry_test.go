@@ -0,0 +1,140 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+type MockRetryQueue struct {
+	lock      sync.Mutex
+	failed    map[string]int
+	succeeded map[string]int
+	discarded map[string]int
+}
+
+func NewMockRetryQueue() *MockRetryQueue {
+	return &MockRetryQueue{failed: make(map[string]int), succeeded: make(map[string]int), discarded: make(map[string]int)}
+}
+func (q *MockRetryQueue) Succeed(filePath string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.succeeded[filePath] += 1
+}
+func (q *MockRetryQueue) Discard(filePath string, cause error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.discarded[filePath] += 1
+}
+func (q *MockRetryQueue) Fail(filePath string, cause error) (bool, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.failed[filePath] += 1
+	return false, nil
+}
+func (q *MockRetryQueue) Due() []string {
+	return nil
+}
+
+func TestGetBackoff(t *testing.T) {
+	q := &RetryQueueImpl{initialBackoff: time.Second, maxBackoff: 10 * time.Second}
+	assert.Equal(t, time.Second, q.GetBackoff(1))
+	assert.Equal(t, 2*time.Second, q.GetBackoff(2))
+	assert.Equal(t, 8*time.Second, q.GetBackoff(4))
+	assert.Equal(t, 10*time.Second, q.GetBackoff(5))
+	assert.Equal(t, 10*time.Second, q.GetBackoff(100))
+}
+
+func TestRetryQueue(t *testing.T) {
+	tmpDir := t.TempDir()
+	retryDir := filepath.Join(tmpDir, "retry")
+	deadLetterDir := filepath.Join(tmpDir, "dead-letter")
+	_, err := NewRetryQueue(retryDir, deadLetterDir, 0, time.Second, time.Minute)
+	assert.NotEqual(t, nil, err)
+	queue, err := NewRetryQueue(retryDir, deadLetterDir, 3, time.Second, time.Minute)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	q := queue.(*RetryQueueImpl)
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	q.now = func() time.Time { return now }
+
+	filePath := filepath.Join(tmpDir, "a.zip")
+	if err := CreateRandomFile(t, filePath, 4); err != nil {
+		return
+	}
+	deadLettered, err := q.Fail(filePath, unix.EIO)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, deadLettered)
+	_, err = os.Stat(filePath)
+	assert.Equal(t, true, os.IsNotExist(err))
+	retryPath := filepath.Join(retryDir, "a.zip")
+	state, err := ReadRetryState(GetRetryStatePath(retryPath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &RetryState{Attempts: 1, LastError: unix.EIO.Error(), NextAttempt: now.Add(time.Second)}, state)
+	assert.Equal(t, 0, len(q.Due()))
+
+	now = now.Add(time.Second)
+	assert.Equal(t, []string{retryPath}, q.Due())
+	_, err = q.Fail(retryPath, unix.EACCES)
+	assert.Equal(t, nil, err)
+	state, err = ReadRetryState(GetRetryStatePath(retryPath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &RetryState{Attempts: 2, LastError: unix.EACCES.Error(), NextAttempt: now.Add(2 * time.Second)}, state)
+
+	now = now.Add(2 * time.Second)
+	deadLettered, err = q.Fail(retryPath, unix.EIO)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, deadLettered)
+	assert.Equal(t, 0, len(q.Due()))
+	deadPath := filepath.Join(deadLetterDir, "a.zip")
+	_, err = os.Stat(deadPath)
+	assert.Equal(t, nil, err)
+	_, err = os.Stat(GetRetryStatePath(retryPath))
+	assert.Equal(t, true, os.IsNotExist(err))
+	state, err = ReadRetryState(GetRetryStatePath(deadPath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, state.Attempts)
+
+	// files without state are retried immediately
+	filePath2 := filepath.Join(retryDir, "b.zip")
+	if err := CreateRandomFile(t, filePath2, 4); err != nil {
+		return
+	}
+	assert.Equal(t, []string{filePath2}, q.Due())
+	q.Succeed(filePath2)
+	_, err = os.Stat(filePath2)
+	assert.Equal(t, true, os.IsNotExist(err))
+	assert.Equal(t, 0, len(q.Due()))
+
+	// files with permanent errors are removed with their state
+	filePath3 := filepath.Join(retryDir, "c.zip")
+	if err := CreateRandomFile(t, filePath3, 4); err != nil {
+		return
+	}
+	assert.Equal(t, nil, WriteRetryState(GetRetryStatePath(filePath3), &RetryState{Attempts: 1}))
+	q.Discard(filePath3, NewPermanentError(unix.EINVAL))
+	for _, p := range []string{filePath3, GetRetryStatePath(filePath3)} {
+		_, err = os.Stat(p)
+		assert.Equal(t, true, os.IsNotExist(err))
+	}
+}
+
+func TestIsPermanentError(t *testing.T) {
+	assert.Equal(t, false, IsPermanentError(unix.EIO))
+	assert.Equal(t, true, IsPermanentError(NewPermanentError(unix.EINVAL)))
+	assert.Equal(t, true, IsPermanentError(fmt.Errorf("wrapped: %w", NewPermanentError(unix.EINVAL))))
+	assert.Equal(t, unix.EINVAL, errors.Unwrap(NewPermanentError(unix.EINVAL)))
+}
@@ -0,0 +1,262 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxObjectTags       = 10
+	maxTagKeyLength     = 128
+	maxTagValueLength   = 256
+	maxMetadataLabelLen = 1024
+	maxTimestampSec     = 100000000000
+)
+
+// RuntimeInfo is collected from JSON files that core-dump-composer adds to zip files
+type RuntimeInfo struct {
+	Namespace     string
+	PodName       string
+	PodUID        string
+	ContainerName string
+	ContainerID   string
+	Image         string
+	ImageDigest   string
+	Labels        map[string]string
+	// Uuid, Exe, Signal, Node, Timestamp, and ContainerID are set from -dump-info.json
+	Uuid      string
+	Exe       string
+	Signal    string
+	Node      string
+	Timestamp time.Time
+}
+
+// podStatusJson is the output of crictl inspectp in -runtime-info.json
+type podStatusJson struct {
+	Status struct {
+		Metadata struct {
+			Name      string  `json:"name"`
+			Uid       string  `json:"uid"`
+			Namespace *string `json:"namespace"`
+		} `json:"metadata"`
+		Labels map[string]string `json:"labels"`
+	} `json:"status"`
+}
+
+// containerListJson is the output of crictl ps in -ps-info.json
+type containerListJson struct {
+	Containers []struct {
+		Id       string `json:"id"`
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Image struct {
+			Image string `json:"image"`
+		} `json:"image"`
+		ImageRef string `json:"imageRef"`
+	} `json:"containers"`
+}
+
+// imageStatusJson is the output of crictl inspecti in -image-info.json
+type imageStatusJson struct {
+	Status struct {
+		RepoTags    []string `json:"repoTags"`
+		RepoDigests []string `json:"repoDigests"`
+	} `json:"status"`
+}
+
+// dumpInfoJson is written by core-dump-composer in -dump-info.json. Numbers may be encoded as strings.
+type dumpInfoJson struct {
+	Uuid      string          `json:"uuid"`
+	Hostname  string          `json:"hostname"`
+	Node      string          `json:"node"`
+	Exe       string          `json:"exe"`
+	Signal    json.RawMessage `json:"signal"`
+	Timestamp json.RawMessage `json:"timestamp"`
+	// ContainerId is the container of the crashing process if the composer knows its cgroup
+	ContainerId string `json:"container_id"`
+}
+
+// GetJsonScalar returns a JSON string or number without quotes
+func GetJsonScalar(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n.String()
+	}
+	return ""
+}
+
+func ParseRuntimeInfo(buf []byte) (*RuntimeInfo, error) {
+	var v podStatusJson
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return nil, fmt.Errorf("failed: ParseRuntimeInfo, json.Unmarshal, err=%v", err)
+	}
+	if v.Status.Metadata.Namespace == nil {
+		return nil, fmt.Errorf("failed: ParseRuntimeInfo, no entry for status.metadata.namespace")
+	}
+	return &RuntimeInfo{
+		Namespace: *v.Status.Metadata.Namespace, PodName: v.Status.Metadata.Name, PodUID: v.Status.Metadata.Uid,
+		Labels: v.Status.Labels,
+	}, nil
+}
+
+// ParsePsInfo sets the container and image of the crashing process. A pod may have several containers, so it
+// matches ContainerID from -dump-info.json and leaves the container unknown if it cannot tell which one crashed.
+func (r *RuntimeInfo) ParsePsInfo(buf []byte) error {
+	var v containerListJson
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return fmt.Errorf("failed: ParsePsInfo, json.Unmarshal, err=%v", err)
+	}
+	if len(v.Containers) == 0 {
+		return fmt.Errorf("failed: ParsePsInfo, no containers")
+	}
+	index := -1
+	for i, c := range v.Containers {
+		if r.ContainerID != "" && c.Id != "" && (strings.HasPrefix(c.Id, r.ContainerID) || strings.HasPrefix(r.ContainerID, c.Id)) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		if len(v.Containers) > 1 {
+			return fmt.Errorf("failed: ParsePsInfo, cannot find the crashing container in %v containers, ContainerID=%v", len(v.Containers), r.ContainerID)
+		}
+		index = 0
+	}
+	c := v.Containers[index]
+	r.ContainerName = c.Metadata.Name
+	if r.ContainerID == "" {
+		r.ContainerID = c.Id
+	}
+	if r.Image == "" {
+		r.Image = c.Image.Image
+	}
+	if r.ImageDigest == "" {
+		r.ImageDigest = GetImageDigest(c.ImageRef)
+	}
+	return nil
+}
+
+// ParseImageInfo prefers a tagged image name and a repository digest to image IDs in -ps-info.json
+func (r *RuntimeInfo) ParseImageInfo(buf []byte) error {
+	var v imageStatusJson
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return fmt.Errorf("failed: ParseImageInfo, json.Unmarshal, err=%v", err)
+	}
+	if len(v.Status.RepoTags) > 0 {
+		r.Image = v.Status.RepoTags[0]
+	}
+	if len(v.Status.RepoDigests) > 0 {
+		if digest := GetImageDigest(v.Status.RepoDigests[0]); digest != "" {
+			r.ImageDigest = digest
+		}
+	}
+	return nil
+}
+
+// ParseDumpInfo sets the process and node that generated the core dump
+func (r *RuntimeInfo) ParseDumpInfo(buf []byte) error {
+	var v dumpInfoJson
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return fmt.Errorf("failed: ParseDumpInfo, json.Unmarshal, err=%v", err)
+	}
+	r.Uuid, r.Exe, r.Signal = v.Uuid, v.Exe, GetJsonScalar(v.Signal)
+	r.Node = v.Node
+	if r.Node == "" {
+		r.Node = v.Hostname
+	}
+	r.ContainerID = v.ContainerId
+	// core-dump-composer records %t of core_pattern in seconds. Values after year 5138 in seconds are taken as milliseconds.
+	if t, err := strconv.ParseInt(GetJsonScalar(v.Timestamp), 10, 64); err == nil && t > 0 {
+		if t < maxTimestampSec {
+			r.Timestamp = time.Unix(t, 0).UTC()
+		} else {
+			r.Timestamp = time.UnixMilli(t).UTC()
+		}
+	}
+	return nil
+}
+
+// GetImageDigest returns sha256:... in an image reference
+func GetImageDigest(ref string) string {
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		ref = ref[i+1:]
+	}
+	if strings.HasPrefix(ref, "sha256:") {
+		return ref
+	}
+	return ""
+}
+
+// GetMetadata returns values for x-amz-meta-* headers. Labels are encoded in JSON and omitted if they are too long.
+func (r *RuntimeInfo) GetMetadata() map[string]string {
+	ret := make(map[string]string)
+	for key, value := range map[string]string{
+		"namespace": r.Namespace, "pod-name": r.PodName, "pod-uid": r.PodUID,
+		"container-name": r.ContainerName, "image": r.Image, "image-digest": r.ImageDigest,
+	} {
+		if value != "" {
+			ret[key] = value
+		}
+	}
+	if len(r.Labels) > 0 {
+		if buf, err := json.Marshal(r.Labels); err == nil && len(buf) <= maxMetadataLabelLen {
+			ret["labels"] = string(buf)
+		}
+	}
+	return ret
+}
+
+// SanitizeTag replaces characters that S3 does not allow in tags
+func SanitizeTag(s string, maxLength int) string {
+	ret := []rune{}
+	for _, c := range s {
+		if len(ret) >= maxLength {
+			break
+		}
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.ContainsRune(" +-=._:/@", c) {
+			ret = append(ret, c)
+		} else {
+			ret = append(ret, '_')
+		}
+	}
+	return string(ret)
+}
+
+// GetTags returns object tags for namespace, pod, container and as many pod labels as S3 allows
+func (r *RuntimeInfo) GetTags() map[string]string {
+	ret := make(map[string]string)
+	for key, value := range map[string]string{"namespace": r.Namespace, "pod": r.PodName, "container": r.ContainerName} {
+		if value != "" {
+			ret[key] = SanitizeTag(value, maxTagValueLength)
+		}
+	}
+	keys := make([]string, 0, len(r.Labels))
+	for key := range r.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if len(ret) >= maxObjectTags {
+			break
+		}
+		tagKey := SanitizeTag(key, maxTagKeyLength)
+		if _, ok := ret[tagKey]; !ok {
+			ret[tagKey] = SanitizeTag(r.Labels[key], maxTagValueLength)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testRuntimeInfo = `{"status":{"metadata":{"name":"app-0","uid":"1234","namespace":"test"},"labels":{"app":"web","tier":"front/end"}}}`
+	testPsInfo      = `{"containers":[{"metadata":{"name":"server"},"image":{"image":"sha256:abcd"},"imageRef":"docker.io/library/app@sha256:abcd"}]}`
+	testImageInfo   = `{"status":{"repoTags":["docker.io/library/app:1.0"],"repoDigests":["docker.io/library/app@sha256:ef01"]}}`
+	// testDumpInfo is in the layout of core-dump-composer. All values are strings and timestamp is %t of core_pattern in seconds.
+	testDumpInfo = `{"uuid":"8a1c8f1e-0000-4000-8000-000000000000","dump_file":"8a1c8f1e-0000-4000-8000-000000000000-dump-1690930800-app-0-app-1-11.core",` +
+		`"ext":"core","timestamp":"1690930800","hostname":"app-0","exe":"app","real_pid":"1","signal":"11","node":"worker-1"}`
+	testMultiPsInfo = `{"containers":[{"id":"aaaa1111","metadata":{"name":"sidecar"},"image":{"image":"sha256:1111"},"imageRef":"proxy@sha256:1111"},` +
+		`{"id":"bbbb2222","metadata":{"name":"server"},"image":{"image":"sha256:2222"},"imageRef":"app@sha256:2222"}]}`
+)
+
+func TestParseRuntimeInfo(t *testing.T) {
+	info, err := ParseRuntimeInfo([]byte(testRuntimeInfo))
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	assert.Equal(t, &RuntimeInfo{Namespace: "test", PodName: "app-0", PodUID: "1234", Labels: map[string]string{"app": "web", "tier": "front/end"}}, info)
+	assert.Equal(t, nil, info.ParsePsInfo([]byte(testPsInfo)))
+	assert.Equal(t, "server", info.ContainerName)
+	assert.Equal(t, "sha256:abcd", info.Image)
+	assert.Equal(t, "sha256:abcd", info.ImageDigest)
+	assert.Equal(t, nil, info.ParseImageInfo([]byte(testImageInfo)))
+	assert.Equal(t, "docker.io/library/app:1.0", info.Image)
+	assert.Equal(t, "sha256:ef01", info.ImageDigest)
+
+	assert.NotEqual(t, nil, info.ParsePsInfo([]byte(`{"containers":[]}`)))
+	_, err = ParseRuntimeInfo([]byte(`{"status":{"metadata":{"name":"app-0"}}}`))
+	assert.NotEqual(t, nil, err)
+	_, err = ParseRuntimeInfo(randString(100))
+	assert.NotEqual(t, nil, err)
+
+	// hostname is used if node is not recorded and signals may be numbers
+	assert.Equal(t, nil, info.ParseDumpInfo([]byte(`{"hostname":"app-0","exe":"app","signal":6,"timestamp":"1690930800000"}`)))
+	assert.Equal(t, "app-0", info.Node)
+	assert.Equal(t, "6", info.Signal)
+	assert.Equal(t, time.Date(2023, 8, 1, 23, 0, 0, 0, time.UTC), info.Timestamp)
+	assert.Equal(t, nil, info.ParseDumpInfo([]byte(testDumpInfo)))
+	assert.Equal(t, "worker-1", info.Node)
+	assert.Equal(t, time.Date(2023, 8, 1, 23, 0, 0, 0, time.UTC), info.Timestamp)
+}
+
+func TestParsePsInfoWithContainers(t *testing.T) {
+	// the crashing container is matched by its (possibly abbreviated) ID
+	info := &RuntimeInfo{}
+	assert.Equal(t, nil, info.ParseDumpInfo([]byte(`{"exe":"app","timestamp":"1690930800","container_id":"bbbb2222cccc"}`)))
+	assert.Equal(t, nil, info.ParsePsInfo([]byte(testMultiPsInfo)))
+	assert.Equal(t, "server", info.ContainerName)
+	assert.Equal(t, "sha256:2222", info.ImageDigest)
+
+	// do not guess the container if a pod has several containers
+	info = &RuntimeInfo{}
+	assert.NotEqual(t, nil, info.ParsePsInfo([]byte(testMultiPsInfo)))
+	assert.Equal(t, "", info.ContainerName)
+	assert.Equal(t, "", info.Image)
+	info = &RuntimeInfo{ContainerID: "ffff"}
+	assert.NotEqual(t, nil, info.ParsePsInfo([]byte(testMultiPsInfo)))
+	assert.Equal(t, "", info.ContainerName)
+}
+
+func TestGetMetadataAndTags(t *testing.T) {
+	info := &RuntimeInfo{Namespace: "test", PodName: "app-0", ContainerName: "server", Image: "app:1.0", Labels: map[string]string{"app": "web"}}
+	assert.Equal(t, map[string]string{
+		"namespace": "test", "pod-name": "app-0", "container-name": "server", "image": "app:1.0", "labels": `{"app":"web"}`,
+	}, info.GetMetadata())
+	assert.Equal(t, map[string]string{"namespace": "test", "pod": "app-0", "container": "server", "app": "web"}, info.GetTags())
+
+	// S3 allows up to 10 tags with limited characters and lengths
+	info.Labels = make(map[string]string)
+	for i := 0; i < 20; i++ {
+		info.Labels[fmt.Sprintf("label-%02d", i)] = fmt.Sprintf("v%d", i)
+	}
+	info.Labels["a*b"] = strings.Repeat("x", maxMetadataLabelLen)
+	tags := info.GetTags()
+	assert.Equal(t, maxObjectTags, len(tags))
+	assert.Equal(t, maxTagValueLength, len(tags["a_b"]))
+	assert.Equal(t, "v0", tags["label-00"])
+	_, ok := tags["label-19"]
+	assert.Equal(t, false, ok)
+
+	// labels are dropped from metadata rather than exceeding header limits
+	_, ok = info.GetMetadata()["labels"]
+	assert.Equal(t, false, ok)
+}
+
+func TestGetRuntimeInfo(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "a.zip")
+	f, err := os.Create(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	zw := zip.NewWriter(f)
+	for name, data := range map[string]string{
+		"core-runtime-info.json": testRuntimeInfo, "core-ps-info.json": testPsInfo, "core-image-info.json": testImageInfo,
+		"core-dump-info.json": testDumpInfo,
+	} {
+		w, err := zw.Create(name)
+		if !assert.Equal(t, nil, err) {
+			return
+		}
+		w.Write([]byte(data))
+	}
+	assert.Equal(t, nil, zw.Close())
+	assert.Equal(t, nil, f.Close())
+	z := NewZippedCoreDump("default")
+	info := z.GetRuntimeInfo(filePath)
+	assert.Equal(t, "test", info.Namespace)
+	assert.Equal(t, "server", info.ContainerName)
+	assert.Equal(t, "docker.io/library/app:1.0", info.Image)
+	assert.Equal(t, "worker-1", info.Node)
+	assert.Equal(t, "11", info.Signal)
+	assert.Equal(t, time.Date(2023, 8, 1, 23, 0, 0, 0, time.UTC), info.Timestamp)
+	assert.Equal(t, &RuntimeInfo{Namespace: "default"}, z.GetRuntimeInfo(""))
+}
+
+func TestPutObjectWithMetadataAndTags(t *testing.T) {
+	server := NewFakeS3Server()
+	defer server.Close()
+	tmpDir := t.TempDir()
+	s := NewFakeS3Client(server, MultipartConfig{PartSize: MinPartSize, Concurrency: 1, MaxAttempts: 1, StateDir: filepath.Join(tmpDir, "uploads")})
+	opts := &ObjectOptions{
+		Metadata: map[string]string{"namespace": "test", "pod-name": "app-0"},
+		Tags:     map[string]string{"namespace": "test", "app": "web server"},
+	}
+	for _, size := range []int{1024, int(MinPartSize * 2)} {
+		filePath := filepath.Join(tmpDir, fmt.Sprintf("%d.zip", size))
+		CreateTestFile(t, filePath, size)
+		f, err := os.Open(filePath)
+		if !assert.Equal(t, nil, err) {
+			return
+		}
+		defer f.Close()
+		assert.Equal(t, nil, s.PutObject("bucket", "meta/"+filepath.Base(filePath), f, opts))
+		header := server.headers[fmt.Sprintf("bucket/meta/%d.zip", size)]
+		assert.Equal(t, "test", header.Get("X-Amz-Meta-Namespace"))
+		assert.Equal(t, "app-0", header.Get("X-Amz-Meta-Pod-Name"))
+		assert.Equal(t, "app=web+server&namespace=test", header.Get("X-Amz-Tagging"))
+	}
+}
@@ -6,11 +6,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
 	"regexp"
+	"sort"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -20,31 +23,138 @@ import (
 )
 
 type S3Client interface {
-	ResetClient(accessKey string, secretKey string, endpoint string) error
-	CreateBucket(bucket string) error
+	ResetClient(config *S3ClientConfig) error
+	CreateBucket(bucket string, opts *BucketOptions) error
 	IsBucketExist(bucket string) error
-	PutObject(bucket string, keyPrefix string, f *os.File) error
+	PutObject(bucket string, key string, f *os.File, opts *ObjectOptions) error
 	GetRawClient() *s3.S3
 }
 
+// ObjectOptions are applied to uploaded objects. A nil ObjectOptions uploads objects without encryption, metadata, or tags.
+type ObjectOptions struct {
+	SSE      *ServerSideEncryption
+	Metadata map[string]string
+	Tags     map[string]string
+}
+
+func (o *ObjectOptions) GetSSE() *ServerSideEncryption {
+	if o == nil {
+		return nil
+	}
+	return o.SSE
+}
+
+// GetTagging returns tags in the URL-encoded format of x-amz-tagging
+func (o *ObjectOptions) GetTagging() string {
+	if o == nil || len(o.Tags) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(o.Tags))
+	for key := range o.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := url.Values{}
+	for _, key := range keys {
+		values.Set(key, o.Tags[key])
+	}
+	return values.Encode()
+}
+
+func (o *ObjectOptions) GetMetadata() map[string]*string {
+	if o == nil || len(o.Metadata) == 0 {
+		return nil
+	}
+	ret := make(map[string]*string)
+	for key, value := range o.Metadata {
+		ret[key] = aws.String(value)
+	}
+	return ret
+}
+
+func (o *ObjectOptions) ApplyPutObject(in *s3.PutObjectInput) {
+	o.GetSSE().ApplyPutObject(in)
+	in.Metadata = o.GetMetadata()
+	if tagging := o.GetTagging(); tagging != "" {
+		in.Tagging = aws.String(tagging)
+	}
+}
+
+func (o *ObjectOptions) ApplyCreateMultipartUpload(in *s3.CreateMultipartUploadInput) {
+	o.GetSSE().ApplyCreateMultipartUpload(in)
+	in.Metadata = o.GetMetadata()
+	if tagging := o.GetTagging(); tagging != "" {
+		in.Tagging = aws.String(tagging)
+	}
+}
+
+// S3ClientConfig is resolved from a core-dump-handler secret. Credentials may refresh temporary credentials by themselves.
+type S3ClientConfig struct {
+	Credentials *credentials.Credentials
+	Endpoint    string
+	// IamToken signs requests with IBM Cloud IAM tokens instead of Credentials
+	IamToken          *IamTokenProvider
+	ServiceInstanceId string
+	// Region defaults to a dummy region for endpoints that ignore regions
+	Region         string
+	ForcePathStyle bool
+	// HTTPClient applies CA bundles, TLS verification, and proxies. nil uses the default client.
+	HTTPClient *http.Client
+	CaBundle   []byte
+}
+
+// NewAwsSession gives caBundle of secrets priority over AWS_CA_BUNDLE of the uploader.
+// Sessions overwrite RootCAs of transports, so the transport of conf is cloned for each session.
+func NewAwsSession(conf *aws.Config, caBundle []byte) (*session.Session, error) {
+	opts := session.Options{Config: *conf.Copy()}
+	if conf.HTTPClient != nil {
+		if transport, ok := conf.HTTPClient.Transport.(*http.Transport); ok {
+			opts.Config.HTTPClient = &http.Client{Transport: transport.Clone(), Timeout: conf.HTTPClient.Timeout}
+		}
+	}
+	if len(caBundle) > 0 {
+		opts.CustomCABundle = bytes.NewReader(caBundle)
+	}
+	return session.NewSessionWithOptions(opts)
+}
+
+// S3ClientFactory creates an S3Client for each upload since ResetClient changes credentials per namespace
+type S3ClientFactory func() S3Client
+
 type S3ClientImpl struct {
-	s *s3.S3
+	s         *s3.S3
+	multipart MultipartConfig
 }
 
-func NewS3Client() S3Client {
-	return &S3ClientImpl{}
+func NewS3Client(multipart MultipartConfig) S3Client {
+	return &S3ClientImpl{multipart: multipart}
 }
 
-func (s *S3ClientImpl) ResetClient(accessKey string, secretKey string, endpoint string) error {
+func (s *S3ClientImpl) ResetClient(config *S3ClientConfig) error {
+	creds := config.Credentials
+	if config.IamToken != nil {
+		creds = credentials.AnonymousCredentials
+	}
+	region := config.Region
+	if region == "" {
+		region = "us-east" // dummy region to avoid assert
+	}
 	conf := aws.NewConfig().
-		WithCredentials(credentials.NewStaticCredentials(accessKey, secretKey, "")).
-		WithEndpoint(endpoint).
-		WithRegion("us-east") // dummy region to avoid assert
-	session, err := session.NewSession(conf)
+		WithCredentials(creds).
+		WithEndpoint(config.Endpoint).
+		WithRegion(region).
+		WithS3ForcePathStyle(config.ForcePathStyle)
+	if config.HTTPClient != nil {
+		conf = conf.WithHTTPClient(config.HTTPClient)
+	}
+	session, err := NewAwsSession(conf, config.CaBundle)
 	if err != nil {
 		return fmt.Errorf("failed: NewS3Client, NewSession: err=%v", err)
 	}
-	s.s = s3.New(session, conf)
+	s.s = s3.New(session)
+	if config.IamToken != nil {
+		AddIamAuthHandler(s.s, config.IamToken, config.ServiceInstanceId)
+	}
 	return nil
 }
 
@@ -58,20 +168,25 @@ func GetLocationConstraintString(endpoint string) string {
 	return fmt.Sprintf("%s-smart", result[2])
 }
 
-func (s *S3ClientImpl) CreateBucket(bucket string) error {
-	constraint := GetLocationConstraintString(s.s.Endpoint)
-	_, err := s.s.CreateBucket(&s3.CreateBucketInput{
-		Bucket: &bucket,
-		CreateBucketConfiguration: &s3.CreateBucketConfiguration{
-			LocationConstraint: &constraint,
-		},
-	})
-	awsErr, ok := err.(awserr.Error)
-	reqErr, ok2 := err.(awserr.RequestFailure)
-	if err != nil && (ok && (awsErr.Code() != s3.ErrCodeBucketAlreadyOwnedByYou && awsErr.Code() != s3.ErrCodeBucketAlreadyExists) || (ok2 && reqErr.StatusCode() != 409)) {
-		return fmt.Errorf("failed: CreateBucket: bucket=%v, err=%v", bucket, err)
-	}
-	log.Printf("INFO: CreateBukcet: bucket=%v", bucket)
+// CreateBucket configures buckets only if it created them. Buckets are deleted if they cannot be configured so that next uploads retry.
+func (s *S3ClientImpl) CreateBucket(bucket string, opts *BucketOptions) error {
+	_, err := s.s.CreateBucket(opts.GetCreateBucketInput(bucket))
+	if err != nil {
+		awsErr, ok := err.(awserr.Error)
+		reqErr, ok2 := err.(awserr.RequestFailure)
+		if !ok || (awsErr.Code() != s3.ErrCodeBucketAlreadyOwnedByYou && awsErr.Code() != s3.ErrCodeBucketAlreadyExists) || (ok2 && reqErr.StatusCode() != 409) {
+			return fmt.Errorf("failed: CreateBucket: bucket=%v, err=%v", bucket, err)
+		}
+		log.Printf("INFO: CreateBukcet: bucket=%v was created by others", bucket)
+		return nil
+	}
+	log.Printf("INFO: CreateBukcet: bucket=%v, locationConstraint=%v", bucket, opts.LocationConstraint)
+	if err := s.ConfigureBucket(bucket, opts); err != nil {
+		if _, err2 := s.s.DeleteBucket(&s3.DeleteBucketInput{Bucket: &bucket}); err2 != nil {
+			log.Printf("WARN: CreateBucket, DeleteBucket, bucket=%v is left without configurations, err=%v", bucket, err2)
+		}
+		return err
+	}
 	return nil
 }
 
@@ -87,15 +202,28 @@ func (s *S3ClientImpl) IsBucketExist(bucket string) error {
 	return err
 }
 
-func (s *S3ClientImpl) PutObject(bucket string, keyPrefix string, f *os.File) error {
-	key := keyPrefix + filepath.Base(f.Name())
-	_, err := s.s.PutObject(&s3.PutObjectInput{
+// PutObject uses multipart uploads for files larger than a part
+func (s *S3ClientImpl) PutObject(bucket string, key string, f *os.File, opts *ObjectOptions) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed: PutObject, Stat, f.Name()=%v, err=%v", f.Name(), err)
+	}
+	if stat.Size() > s.multipart.GetPartSize(stat.Size()) {
+		if err := s.PutMultipartObject(bucket, key, f, stat.Size(), opts); err != nil {
+			return err
+		}
+		log.Printf("INFO: PutObject: %v->s3://%v/%v (multipart)", f.Name(), bucket, key)
+		return nil
+	}
+	in := &s3.PutObjectInput{
 		Body:   f,
 		Bucket: &bucket,
 		Key:    &key,
-	})
+	}
+	opts.ApplyPutObject(in)
+	_, err = s.s.PutObject(in)
 	if err != nil {
-		return fmt.Errorf("failed: PutObject: bucket=%v, key=%v, err=%v", bucket, key, err)
+		return fmt.Errorf("failed: PutObject: bucket=%v, key=%v, err=%v", bucket, key, opts.GetSSE().WrapError(err))
 	}
 	log.Printf("INFO: PutObject: %v->s3://%v/%v", f.Name(), bucket, key)
 	return nil
@@ -21,7 +21,7 @@ import (
 
 const testUploadYamlFile = "../../secret.yaml"
 
-func NewCoreDumpUploaderSecretFromFile(fileName string) (*CoreDumpUploaderSecret, error) {
+func NewS3DestinationSecretFromFile(fileName string) (*S3DestinationSecret, error) {
 	f, err := os.Open(fileName)
 	if err != nil {
 		return nil, err
@@ -30,11 +30,11 @@ func NewCoreDumpUploaderSecretFromFile(fileName string) (*CoreDumpUploaderSecret
 	if err != nil {
 		return nil, err
 	}
-	var ret CoreDumpUploaderSecret
+	var ret S3DestinationSecret
 	if err := yaml.Unmarshal(buf, &ret); err != nil {
 		return nil, err
 	}
-	log.Printf("INFO: NewCoreDumpUploaderSecretFromFile, fileName=%v, bucket=%v, keyPrefix=%v, endpoint=%v, createBucket=%v",
+	log.Printf("INFO: NewS3DestinationSecretFromFile, fileName=%v, bucket=%v, keyPrefix=%v, endpoint=%v, createBucket=%v",
 		fileName, ret.Bucket, ret.KeyPrefix, ret.Endpoint, ret.CreateBucket)
 	return &ret, nil
 }
@@ -44,13 +44,18 @@ func GetS3Client(t *testing.T, testUploadYamlFile string) (S3Client, error) {
 		t.SkipNow()
 		return nil, err
 	}
-	c, err := NewCoreDumpUploaderSecretFromFile(testUploadYamlFile)
+	c, err := NewS3DestinationSecretFromFile(testUploadYamlFile)
 	if err != nil {
-		t.Errorf("Failed: NewCoreDumpUploaderSecretFromFile, file=%v", testUploadYamlFile)
+		t.Errorf("Failed: NewS3DestinationSecretFromFile, file=%v", testUploadYamlFile)
 		return nil, err
 	}
-	s := NewS3Client()
-	err = s.ResetClient(c.AccessKey, c.SecretKey, c.Endpoint)
+	s := NewS3Client(MultipartConfig{PartSize: MinPartSize, Concurrency: 2, MaxAttempts: 3})
+	creds, err := NewS3CredentialsCache(S3CredentialsConfig{}).Get("test", c)
+	if err != nil {
+		t.Errorf("Failed: S3CredentialsCache.Get, file=%v", testUploadYamlFile)
+		return nil, err
+	}
+	err = s.ResetClient(&S3ClientConfig{Credentials: creds, Endpoint: c.Endpoint})
 	if err != nil {
 		t.Errorf("Failed: ResetClient, file=%v", testUploadYamlFile)
 		return nil, err
@@ -87,7 +92,7 @@ func TestCreateBucket(t *testing.T) {
 	}
 
 	bucketName := "tyos-core-dump-handler-test-bucket-ops"
-	err = s.CreateBucket(bucketName)
+	err = s.CreateBucket(bucketName, &BucketOptions{LocationConstraint: GetLocationConstraintString(s.GetRawClient().Endpoint)})
 	if err != nil {
 		t.Errorf("Failed: CreateBucket, file=%v, err=%v", testUploadYamlFile, err)
 		return
@@ -112,7 +117,7 @@ func TestCreateExistBucket(t *testing.T) {
 	}
 
 	bucketName := "tyos-core-dump-handler-test-put-object"
-	err = s.CreateBucket(bucketName)
+	err = s.CreateBucket(bucketName, &BucketOptions{LocationConstraint: GetLocationConstraintString(s.GetRawClient().Endpoint)})
 	if err != nil {
 		t.Errorf("Failed: CreateBucket, file=%v, err=%v", testUploadYamlFile, err)
 		return
@@ -134,7 +139,7 @@ func TestPutObject(t *testing.T) {
 	}
 
 	bucketName := "tyos-core-dump-handler-test-put-object"
-	keyPrefix := "tyos/"
+	key := "tyos/" + filepath.Base(filePath)
 
 	f, err := os.Open(filePath)
 	if err != nil {
@@ -143,12 +148,11 @@ func TestPutObject(t *testing.T) {
 	}
 	defer f.Close()
 
-	err = s.PutObject(bucketName, keyPrefix, f)
+	err = s.PutObject(bucketName, key, f, nil)
 	if err != nil {
-		t.Errorf("Failed: PutObject, bucketName=%v, keyPrefix=%v, f.Name()=%v, err=%v", bucketName, keyPrefix, f.Name(), err)
+		t.Errorf("Failed: PutObject, bucketName=%v, key=%v, f.Name()=%v, err=%v", bucketName, key, f.Name(), err)
 		return
 	}
-	key := keyPrefix + filepath.Base(filePath)
 	ret, err := s.GetRawClient().HeadObject(&s3.HeadObjectInput{Bucket: &bucketName, Key: &key})
 	if err != nil {
 		t.Errorf("Failed: HeadObject, key=%v, err=%v", key, err)
@@ -162,6 +166,7 @@ type MockS3Client struct {
 	createBucketFail  error
 	isBucketExistFail error
 	putObjectFail     error
+	config            *S3ClientConfig
 }
 
 func NewMockS3Client(resetClientFail error, createBucketFail error, isBucketExistFail error, putObjectFail error) *MockS3Client {
@@ -171,11 +176,16 @@ func NewMockS3Client(resetClientFail error, createBucketFail error, isBucketExis
 	}
 }
 
-func (s *MockS3Client) ResetClient(accessKey string, secretKey string, endpoint string) error {
+func NewMockS3ClientFactory(s *MockS3Client) S3ClientFactory {
+	return func() S3Client { return s }
+}
+
+func (s *MockS3Client) ResetClient(config *S3ClientConfig) error {
+	s.config = config
 	return s.resetClientFail
 }
 
-func (s *MockS3Client) CreateBucket(string) error {
+func (s *MockS3Client) CreateBucket(string, *BucketOptions) error {
 	return s.createBucketFail
 }
 
@@ -183,7 +193,7 @@ func (s *MockS3Client) IsBucketExist(string) error {
 	return s.isBucketExistFail
 }
 
-func (s *MockS3Client) PutObject(string, string, *os.File) error {
+func (s *MockS3Client) PutObject(string, string, *os.File, *ObjectOptions) error {
 	return s.putObjectFail
 }
 
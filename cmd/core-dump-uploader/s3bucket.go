@@ -0,0 +1,201 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	S3ProviderAws   = "aws"
+	S3ProviderIbm   = "ibm"
+	S3ProviderMinio = "minio"
+	// s3AwsDefaultRegion does not accept its name as a location constraint
+	s3AwsDefaultRegion = "us-east-1"
+	s3ExpirationRuleId = "core-dump-expiration"
+)
+
+var s3AwsEndpointRegexp = regexp.MustCompile(`^s3[.-](?:dualstack\.)?([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// BucketOptions are applied to buckets that the uploader creates. Existing buckets are not changed.
+type BucketOptions struct {
+	// LocationConstraint is omitted if empty
+	LocationConstraint string
+	// ExpirationDays expires objects under ExpirationPrefix. 0 disables it.
+	ExpirationDays   int64
+	ExpirationPrefix string
+	Versioning       bool
+	// ObjectLockMode is GOVERNANCE or COMPLIANCE. Empty disables object lock.
+	ObjectLockMode          string
+	ObjectLockRetentionDays int64
+}
+
+// GetS3Provider returns provider or guesses it from endpoint. Unknown endpoints are handled like MinIO.
+func GetS3Provider(provider string, endpoint string) string {
+	if provider != "" {
+		return provider
+	}
+	if GetLocationConstraintString(endpoint) != "" {
+		return S3ProviderIbm
+	}
+	if u, err := url.Parse(endpoint); err == nil {
+		host := u.Hostname()
+		if strings.HasSuffix(host, ".amazonaws.com") || strings.HasSuffix(host, ".amazonaws.com.cn") {
+			return S3ProviderAws
+		}
+	}
+	return S3ProviderMinio
+}
+
+// GetAwsRegion returns region or the region in endpoint. Global endpoints are in us-east-1.
+func GetAwsRegion(endpoint string, region string) string {
+	if region != "" {
+		return region
+	}
+	if u, err := url.Parse(endpoint); err == nil {
+		if result := s3AwsEndpointRegexp.FindStringSubmatch(u.Hostname()); len(result) == 2 {
+			return result[1]
+		}
+	}
+	return s3AwsDefaultRegion
+}
+
+// GetLocationConstraint returns a location constraint for CreateBucket of each provider
+func GetLocationConstraint(provider string, endpoint string, region string) string {
+	switch provider {
+	case S3ProviderIbm:
+		if constraint := GetLocationConstraintString(endpoint); constraint != "" {
+			return constraint
+		}
+		if region != "" {
+			return region + "-smart"
+		}
+		return ""
+	case S3ProviderAws:
+		if region = GetAwsRegion(endpoint, region); region == s3AwsDefaultRegion {
+			return ""
+		}
+		return region
+	default:
+		return region
+	}
+}
+
+// NewBucketOptions parses optional bucket settings in a core-dump-handler secret
+func NewBucketOptions(data map[string][]byte, endpoint string, region string, keyPrefix string) (*BucketOptions, error) {
+	provider := string(data["provider"])
+	if provider != "" && provider != S3ProviderAws && provider != S3ProviderIbm && provider != S3ProviderMinio {
+		return nil, fmt.Errorf("unknown provider=%v (valid: %v, %v, %v)", provider, S3ProviderAws, S3ProviderIbm, S3ProviderMinio)
+	}
+	o := &BucketOptions{ExpirationPrefix: keyPrefix}
+	if constraint, ok := data["locationConstraint"]; ok {
+		o.LocationConstraint = string(constraint)
+	} else {
+		o.LocationConstraint = GetLocationConstraint(GetS3Provider(provider, endpoint), endpoint, region)
+	}
+	for key, value := range map[string]*int64{"expirationDays": &o.ExpirationDays, "objectLockRetentionDays": &o.ObjectLockRetentionDays} {
+		if buf, ok := data[key]; ok {
+			days, err := strconv.ParseInt(string(buf), 10, 64)
+			if err != nil || days <= 0 {
+				return nil, fmt.Errorf("%v must be a positive number of days, %v", key, string(buf))
+			}
+			*value = days
+		}
+	}
+	var err error
+	if o.Versioning, err = parseOptionalBool(data, "versioning"); err != nil {
+		return nil, err
+	}
+	o.ObjectLockMode = string(data["objectLockMode"])
+	switch o.ObjectLockMode {
+	case "":
+		if o.ObjectLockRetentionDays > 0 {
+			return nil, fmt.Errorf("objectLockRetentionDays requires objectLockMode")
+		}
+	case s3.ObjectLockRetentionModeGovernance, s3.ObjectLockRetentionModeCompliance:
+		if o.ObjectLockRetentionDays == 0 {
+			return nil, fmt.Errorf("objectLockMode requires objectLockRetentionDays")
+		}
+		// object lock requires versioning
+		o.Versioning = true
+	default:
+		return nil, fmt.Errorf("unknown objectLockMode=%v (valid: %v, %v)", o.ObjectLockMode, s3.ObjectLockRetentionModeGovernance, s3.ObjectLockRetentionModeCompliance)
+	}
+	return o, nil
+}
+
+func (o *BucketOptions) GetCreateBucketInput(bucket string) *s3.CreateBucketInput {
+	// an empty configuration prevents the SDK from sending the region of the client as a location constraint
+	in := &s3.CreateBucketInput{Bucket: aws.String(bucket), CreateBucketConfiguration: &s3.CreateBucketConfiguration{}}
+	if o.LocationConstraint != "" {
+		in.CreateBucketConfiguration.LocationConstraint = aws.String(o.LocationConstraint)
+	}
+	if o.ObjectLockMode != "" {
+		in.ObjectLockEnabledForBucket = aws.Bool(true)
+	}
+	return in
+}
+
+// GetLifecycleRule expires current versions and noncurrent versions after ExpirationDays
+func (o *BucketOptions) GetLifecycleRule() *s3.LifecycleRule {
+	rule := &s3.LifecycleRule{
+		ID:         aws.String(s3ExpirationRuleId),
+		Status:     aws.String(s3.ExpirationStatusEnabled),
+		Filter:     &s3.LifecycleRuleFilter{Prefix: aws.String(o.ExpirationPrefix)},
+		Expiration: &s3.LifecycleExpiration{Days: aws.Int64(o.ExpirationDays)},
+	}
+	if o.Versioning {
+		rule.NoncurrentVersionExpiration = &s3.NoncurrentVersionExpiration{NoncurrentDays: aws.Int64(o.ExpirationDays)}
+	}
+	return rule
+}
+
+// ConfigureBucket applies versioning, object lock, and lifecycle rules to a new bucket
+func (s *S3ClientImpl) ConfigureBucket(bucket string, o *BucketOptions) error {
+	if o.Versioning {
+		_, err := s.s.PutBucketVersioning(&s3.PutBucketVersioningInput{
+			Bucket:                  aws.String(bucket),
+			VersioningConfiguration: &s3.VersioningConfiguration{Status: aws.String(s3.BucketVersioningStatusEnabled)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed: ConfigureBucket, PutBucketVersioning, bucket=%v, err=%v", bucket, err)
+		}
+	}
+	if o.ObjectLockMode != "" {
+		_, err := s.s.PutObjectLockConfiguration(&s3.PutObjectLockConfigurationInput{
+			Bucket: aws.String(bucket),
+			ObjectLockConfiguration: &s3.ObjectLockConfiguration{
+				ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled),
+				Rule: &s3.ObjectLockRule{DefaultRetention: &s3.DefaultRetention{
+					Mode: aws.String(o.ObjectLockMode), Days: aws.Int64(o.ObjectLockRetentionDays),
+				}},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed: ConfigureBucket, PutObjectLockConfiguration, bucket=%v, err=%v", bucket, err)
+		}
+	}
+	if o.ExpirationDays > 0 {
+		_, err := s.s.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+			Bucket:                 aws.String(bucket),
+			LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: []*s3.LifecycleRule{o.GetLifecycleRule()}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed: ConfigureBucket, PutBucketLifecycleConfiguration, bucket=%v, err=%v", bucket, err)
+		}
+	}
+	log.Printf("INFO: ConfigureBucket: bucket=%v, versioning=%v, objectLockMode=%v, objectLockRetentionDays=%v, expirationDays=%v",
+		bucket, o.Versioning, o.ObjectLockMode, o.ObjectLockRetentionDays, o.ExpirationDays)
+	return nil
+}
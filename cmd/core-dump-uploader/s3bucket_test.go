@@ -0,0 +1,144 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetLocationConstraint(t *testing.T) {
+	for _, c := range []struct {
+		provider, endpoint, region, expected string
+	}{
+		{"", "https://s3.us-south.cloud-object-storage.appdomain.cloud", "", "us-south-smart"},
+		{"", "https://s3.private.eu-de.cloud-object-storage.appdomain.cloud", "eu-gb", "eu-de-smart"},
+		{S3ProviderIbm, "https://cos.internal.example.com", "jp-tok", "jp-tok-smart"},
+		{"", "https://s3.eu-west-1.amazonaws.com", "", "eu-west-1"},
+		{"", "https://s3-ap-northeast-1.amazonaws.com", "", "ap-northeast-1"},
+		{"", "https://s3.dualstack.us-west-2.amazonaws.com", "", "us-west-2"},
+		{"", "https://s3.amazonaws.com", "", ""},
+		{"", "https://s3.us-east-1.amazonaws.com", "", ""},
+		{"", "https://s3.amazonaws.com", "eu-central-1", "eu-central-1"},
+		{S3ProviderAws, "https://vpce-1.s3.us-east-2.vpce.amazonaws.com", "us-east-2", "us-east-2"},
+		{"", "https://minio.example.com", "", ""},
+		{"", "https://minio.example.com", "us-east-1", "us-east-1"},
+	} {
+		assert.Equal(t, c.expected, GetLocationConstraint(GetS3Provider(c.provider, c.endpoint), c.endpoint, c.region), "c=%v", c)
+	}
+	assert.Equal(t, S3ProviderAws, GetS3Provider("", "https://s3.cn-north-1.amazonaws.com.cn"))
+	assert.Equal(t, S3ProviderMinio, GetS3Provider("", "http://127.0.0.1:9000"))
+}
+
+func TestNewBucketOptions(t *testing.T) {
+	o, err := NewBucketOptions(map[string][]byte{
+		"expirationDays": []byte("90"), "objectLockMode": []byte("COMPLIANCE"), "objectLockRetentionDays": []byte("30"),
+	}, "https://s3.eu-west-1.amazonaws.com", "", "cores/")
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, &BucketOptions{
+			LocationConstraint: "eu-west-1", ExpirationDays: 90, ExpirationPrefix: "cores/", Versioning: true,
+			ObjectLockMode: "COMPLIANCE", ObjectLockRetentionDays: 30,
+		}, o)
+	}
+	o, err = NewBucketOptions(map[string][]byte{"locationConstraint": []byte("us-south-standard"), "versioning": []byte("true")}, "https://s3.us-south.cloud-object-storage.appdomain.cloud", "", "")
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, &BucketOptions{LocationConstraint: "us-south-standard", Versioning: true}, o)
+	}
+	for _, data := range []map[string][]byte{
+		{"provider": []byte("gcs")},
+		{"expirationDays": []byte("0")},
+		{"expirationDays": []byte("1y")},
+		{"versioning": []byte("enabled")},
+		{"objectLockMode": []byte("LEGAL_HOLD"), "objectLockRetentionDays": []byte("1")},
+		{"objectLockMode": []byte("GOVERNANCE")},
+		{"objectLockRetentionDays": []byte("1")},
+	} {
+		_, err := NewBucketOptions(data, "https://minio.example.com", "", "")
+		assert.NotEqual(t, nil, err, "data=%v", data)
+	}
+}
+
+func TestS3ClientCreateBucket(t *testing.T) {
+	server := NewFakeS3Server()
+	defer server.Close()
+	s := NewFakeS3Client(server, MultipartConfig{PartSize: MinPartSize, Concurrency: 1, MaxAttempts: 1})
+	opts := &BucketOptions{
+		LocationConstraint: "eu-west-1", ExpirationDays: 90, ExpirationPrefix: "cores/", Versioning: true,
+		ObjectLockMode: "GOVERNANCE", ObjectLockRetentionDays: 30,
+	}
+	if !assert.Equal(t, nil, s.CreateBucket("bucket", opts)) {
+		return
+	}
+	bucket := server.buckets["bucket"]
+	assert.Contains(t, string(bucket[""]), "<LocationConstraint>eu-west-1</LocationConstraint>")
+	assert.Equal(t, "true", server.headers["bucket"].Get("x-amz-bucket-object-lock-enabled"))
+	assert.Contains(t, string(bucket["versioning"]), "<Status>Enabled</Status>")
+	assert.Contains(t, string(bucket["object-lock"]), "<Mode>GOVERNANCE</Mode>")
+	assert.Contains(t, string(bucket["object-lock"]), "<Days>30</Days>")
+	assert.Contains(t, string(bucket["lifecycle"]), "<ID>core-dump-expiration</ID>")
+	assert.Contains(t, string(bucket["lifecycle"]), "<Prefix>cores/</Prefix>")
+	assert.Contains(t, string(bucket["lifecycle"]), "<NoncurrentDays>90</NoncurrentDays>")
+	assert.NotEqual(t, "", server.headers["bucket?lifecycle"].Get("Content-Md5"))
+
+	// buckets created by others are not changed
+	delete(bucket, "lifecycle")
+	assert.Equal(t, nil, s.CreateBucket("bucket", opts))
+	assert.Equal(t, []byte(nil), server.buckets["bucket"]["lifecycle"])
+
+	// buckets without configurations are deleted to retry
+	server.failSubresource = "lifecycle"
+	assert.NotEqual(t, nil, s.CreateBucket("bucket2", opts))
+	_, ok := server.buckets["bucket2"]
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 1, server.deleteBuckets)
+
+	// bare buckets without location constraints
+	assert.Equal(t, nil, s.CreateBucket("bucket3", &BucketOptions{}))
+	assert.Equal(t, 1, len(server.buckets["bucket3"]))
+	assert.NotContains(t, string(server.buckets["bucket3"][""]), "LocationConstraint")
+	assert.Equal(t, "", server.headers["bucket3"].Get("x-amz-bucket-object-lock-enabled"))
+}
+
+func TestS3DestinationObjectLock(t *testing.T) {
+	server := NewFakeS3Server()
+	defer server.Close()
+	tmpDir := t.TempDir()
+	multipart := MultipartConfig{PartSize: MinPartSize, Concurrency: 1, MaxAttempts: 1, StateDir: filepath.Join(tmpDir, "uploads")}
+	r := NewDestinationRegistry()
+	r.Register(DestinationTypeS3, NewS3DestinationFactory(func() S3Client { return NewS3Client(multipart) }, NewS3CredentialsCache(S3CredentialsConfig{}), nil))
+	d, err := r.NewDestination(DestinationTypeS3, "test", map[string][]byte{
+		"bucket": []byte("bucket"), "keyPrefix": []byte("cores"), "accessKey": []byte("access"), "secretKey": []byte("secret"),
+		"endpoint": []byte(server.server.URL), "forcePathStyle": []byte("true"), "createBucket": []byte("true"),
+		"expirationDays": []byte("7"), "objectLockMode": []byte("COMPLIANCE"), "objectLockRetentionDays": []byte("1"),
+	})
+	if !assert.Equal(t, nil, err) || !assert.Equal(t, nil, d.Prepare()) {
+		return
+	}
+	bucket := server.buckets["bucket"]
+	assert.NotContains(t, string(bucket[""]), "LocationConstraint")
+	assert.Contains(t, string(bucket["object-lock"]), "<Mode>COMPLIANCE</Mode>")
+	assert.Contains(t, string(bucket["lifecycle"]), "<Days>7</Days>")
+
+	// uploads to buckets with object lock require Content-MD5, which the SDK computes for seekable bodies
+	for _, size := range []int{1024, int(MinPartSize) + 1} {
+		filePath := filepath.Join(tmpDir, "a.zip")
+		CreateTestFile(t, filePath, size)
+		f, err := os.Open(filePath)
+		if !assert.Equal(t, nil, err) {
+			return
+		}
+		err = d.Put("cores/a.zip", f, nil)
+		f.Close()
+		if assert.Equal(t, nil, err) && size == 1024 {
+			assert.NotEqual(t, "", server.headers["bucket/cores/a.zip"].Get("Content-Md5"))
+		}
+	}
+	assert.NotEqual(t, "", server.partHeaders[1].Get("Content-Md5"))
+	assert.NotEqual(t, "", server.partHeaders[2].Get("Content-Md5"))
+}
@@ -0,0 +1,260 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	s3DefaultStsRegion = "us-east-1"
+	// s3RoleSessionNamePrefix is followed by namespaces so that trust policies can restrict roles to namespaces with sts:RoleSessionName
+	s3RoleSessionNamePrefix = "core-dump-"
+	s3MaxRoleSessionName    = 64
+	// s3CredentialsExpiryWindow refreshes temporary credentials before S3 rejects requests signed with them
+	s3CredentialsExpiryWindow = time.Minute
+)
+
+// S3CredentialsConfig is configured by operators with uploader flags. Secrets cannot choose credentials of the uploader itself.
+type S3CredentialsConfig struct {
+	// WebIdentityTokenFile is a projected service account token of the uploader for secrets with webIdentity=true. Empty disables webIdentity.
+	WebIdentityTokenFile string
+	// UploaderCredentials assume roleArn of secrets without accessKey and credentialsFile. nil disables it.
+	UploaderCredentials *credentials.Credentials
+	// AllowedRoleArns are patterns of roleArn that secrets can assume with WebIdentityTokenFile or UploaderCredentials.
+	// {namespace} is replaced with the namespace of a secret and * matches characters except /. Empty allows any role.
+	AllowedRoleArns []string
+	// HTTPClient sends STS and IAM requests. Secrets with caBundle, insecureSkipVerify, or proxyUrl use a clone of its transport.
+	HTTPClient *http.Client
+}
+
+type s3CachedCredentials struct {
+	hash        string
+	credentials *credentials.Credentials
+	iamToken    *IamTokenProvider
+	httpClient  *http.Client
+}
+
+// S3CredentialsCache keeps credentials per namespace so that STS and IAM are called only when temporary credentials expire.
+// Credentials are recreated if a secret changes.
+type S3CredentialsCache struct {
+	lock   sync.Mutex
+	config S3CredentialsConfig
+	cache  map[string]s3CachedCredentials
+}
+
+func NewS3CredentialsCache(config S3CredentialsConfig) *S3CredentialsCache {
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	return &S3CredentialsCache{config: config, cache: make(map[string]s3CachedCredentials)}
+}
+
+// IsAllowedRoleArn returns true if roleArn matches one of AllowedRoleArns for namespace
+func (c *S3CredentialsConfig) IsAllowedRoleArn(namespace string, roleArn string) bool {
+	if len(c.AllowedRoleArns) == 0 {
+		return true
+	}
+	for _, pattern := range c.AllowedRoleArns {
+		if ok, err := path.Match(strings.ReplaceAll(pattern, "{namespace}", namespace), roleArn); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRoleSessionName returns core-dump-<namespace>
+func GetRoleSessionName(namespace string) string {
+	name := s3RoleSessionNamePrefix + namespace
+	if len(name) > s3MaxRoleSessionName {
+		name = name[:s3MaxRoleSessionName]
+	}
+	return name
+}
+
+func (s *S3DestinationSecret) GetCredentialsHash() string {
+	h := sha256.New()
+	for _, v := range []string{
+		s.AccessKey, s.SecretKey, s.RoleArn, s.ExternalId, strconv.FormatBool(s.WebIdentity), s.Profile, s.StsEndpoint, string(s.CredentialsFile), s.ApiKey, s.IamEndpoint,
+		s.Region, string(s.CaBundle), strconv.FormatBool(s.InsecureSkipVerify), s.ProxyUrl,
+	} {
+		h.Write([]byte(strconv.Itoa(len(v)) + ":" + v))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *S3CredentialsCache) get(namespace string, s *S3DestinationSecret) (s3CachedCredentials, error) {
+	hash := s.GetCredentialsHash()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if cached, ok := c.cache[namespace]; ok && cached.hash == hash {
+		return cached, nil
+	}
+	cached := s3CachedCredentials{hash: hash}
+	httpClient, err := s.NewHttpClient(c.config.HTTPClient)
+	if err != nil {
+		return cached, err
+	}
+	cached.httpClient = httpClient
+	if s.ApiKey != "" {
+		cached.iamToken = NewIamTokenProvider(s.ApiKey, s.IamEndpoint, httpClient)
+	} else {
+		creds, err := c.newCredentials(namespace, s, httpClient)
+		if err != nil {
+			return cached, err
+		}
+		cached.credentials = creds
+	}
+	c.cache[namespace] = cached
+	return cached, nil
+}
+
+// Get returns credentials for HMAC signatures
+func (c *S3CredentialsCache) Get(namespace string, s *S3DestinationSecret) (*credentials.Credentials, error) {
+	cached, err := c.get(namespace, s)
+	if err != nil {
+		return nil, err
+	}
+	if cached.credentials == nil {
+		return nil, fmt.Errorf("failed: S3CredentialsCache.Get, no HMAC credentials with apiKey")
+	}
+	return cached.credentials, nil
+}
+
+// GetClientConfig returns credentials or an IAM token provider for the endpoint of a secret
+func (c *S3CredentialsCache) GetClientConfig(namespace string, s *S3DestinationSecret) (*S3ClientConfig, error) {
+	cached, err := c.get(namespace, s)
+	if err != nil {
+		return nil, err
+	}
+	return &S3ClientConfig{
+		Credentials: cached.credentials, Endpoint: s.Endpoint, IamToken: cached.iamToken, ServiceInstanceId: s.ServiceInstanceId,
+		Region: s.Region, ForcePathStyle: s.ForcePathStyle, HTTPClient: cached.httpClient, CaBundle: s.CaBundle,
+	}, nil
+}
+
+func newStsClient(s *S3DestinationSecret, creds *credentials.Credentials, httpClient *http.Client) (*sts.STS, error) {
+	region := s.Region
+	if region == "" {
+		region = s3DefaultStsRegion
+	}
+	conf := aws.NewConfig().WithRegion(region).WithCredentials(creds).WithHTTPClient(httpClient)
+	if s.StsEndpoint != "" {
+		conf = conf.WithEndpoint(s.StsEndpoint)
+	}
+	sess, err := NewAwsSession(conf, s.CaBundle)
+	if err != nil {
+		return nil, fmt.Errorf("failed: newStsClient, NewSession, err=%v", err)
+	}
+	return sts.New(sess), nil
+}
+
+// ReadCredentialsFile reads a profile of a shared credentials file in a secret. Keys are parsed in memory and never written to nodes.
+func ReadCredentialsFile(buf []byte, profile string) (*credentials.Credentials, error) {
+	if profile == "" {
+		// ignore AWS_PROFILE of the uploader
+		profile = "default"
+	}
+	section := ""
+	found := false
+	values := make(map[string]string)
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("failed: ReadCredentialsFile, malformed section at line %v", i+1)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			found = found || section == profile
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("failed: ReadCredentialsFile, malformed line %v", i+1)
+		}
+		if section == profile {
+			values[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("failed: ReadCredentialsFile, not found profile=%v", profile)
+	}
+	if values["aws_access_key_id"] == "" || values["aws_secret_access_key"] == "" {
+		return nil, fmt.Errorf("failed: ReadCredentialsFile, profile=%v requires aws_access_key_id and aws_secret_access_key", profile)
+	}
+	return credentials.NewStaticCredentials(values["aws_access_key_id"], values["aws_secret_access_key"], values["aws_session_token"]), nil
+}
+
+func (c *S3CredentialsCache) newCredentials(namespace string, s *S3DestinationSecret, httpClient *http.Client) (*credentials.Credentials, error) {
+	sessionName := GetRoleSessionName(namespace)
+	if s.WebIdentity {
+		if c.config.WebIdentityTokenFile == "" {
+			return nil, fmt.Errorf("failed: S3CredentialsCache.Get, webIdentity is disabled in the uploader (--webIdentityTokenFile)")
+		}
+		if !c.config.IsAllowedRoleArn(namespace, s.RoleArn) {
+			return nil, fmt.Errorf("failed: S3CredentialsCache.Get, roleArn=%v is not allowed for namespace %v (--allowedRoleArns)", s.RoleArn, namespace)
+		}
+		stsClient, err := newStsClient(s, credentials.AnonymousCredentials, httpClient)
+		if err != nil {
+			return nil, err
+		}
+		p := stscreds.NewWebIdentityRoleProviderWithOptions(stsClient, s.RoleArn, sessionName, stscreds.FetchTokenPath(c.config.WebIdentityTokenFile), func(p *stscreds.WebIdentityRoleProvider) {
+			p.ExpiryWindow = s3CredentialsExpiryWindow
+		})
+		return credentials.NewCredentials(p), nil
+	}
+
+	var base *credentials.Credentials = nil
+	if len(s.CredentialsFile) > 0 {
+		var err error
+		if base, err = ReadCredentialsFile(s.CredentialsFile, s.Profile); err != nil {
+			return nil, err
+		}
+	} else if s.AccessKey != "" {
+		base = credentials.NewStaticCredentials(s.AccessKey, s.SecretKey, "")
+	} else if c.config.UploaderCredentials != nil {
+		// secrets never use credentials of the uploader without assuming a role
+		if s.RoleArn == "" {
+			return nil, fmt.Errorf("failed: S3CredentialsCache.Get, roleArn is empty")
+		}
+		if !c.config.IsAllowedRoleArn(namespace, s.RoleArn) {
+			return nil, fmt.Errorf("failed: S3CredentialsCache.Get, roleArn=%v is not allowed for namespace %v (--allowedRoleArns)", s.RoleArn, namespace)
+		}
+		base = c.config.UploaderCredentials
+	} else {
+		return nil, fmt.Errorf("failed: S3CredentialsCache.Get, roleArn without accessKey is disabled in the uploader (--assumeRoleWithUploaderCredentials)")
+	}
+	if s.RoleArn == "" {
+		return base, nil
+	}
+	stsClient, err := newStsClient(s, base, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	return stscreds.NewCredentialsWithClient(stsClient, s.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = sessionName
+		if s.ExternalId != "" {
+			p.ExternalID = aws.String(s.ExternalId)
+		}
+		p.ExpiryWindow = s3CredentialsExpiryWindow
+	}), nil
+}
@@ -0,0 +1,332 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+// FakeStsServer implements AssumeRole and AssumeRoleWithWebIdentity and issues a new access key for each call
+type FakeStsServer struct {
+	lock     sync.Mutex
+	server   *httptest.Server
+	requests []url.Values
+	headers  []http.Header
+	duration time.Duration
+}
+
+func NewFakeStsServer() *FakeStsServer {
+	f := &FakeStsServer{duration: time.Hour}
+	f.server = httptest.NewServer(http.HandlerFunc(f.ServeHTTP))
+	return f
+}
+
+func (f *FakeStsServer) Close() {
+	f.server.Close()
+}
+
+func (f *FakeStsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	action := r.PostForm.Get("Action")
+	if action != "AssumeRole" && action != "AssumeRoleWithWebIdentity" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.requests = append(f.requests, r.PostForm)
+	f.headers = append(f.headers, r.Header.Clone())
+	expiration := time.Now().Add(f.duration).UTC().Format(time.RFC3339)
+	fmt.Fprintf(w, `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><%[1]sResult><Credentials>`+
+		`<AccessKeyId>temp%[2]d</AccessKeyId><SecretAccessKey>secret%[2]d</SecretAccessKey><SessionToken>token%[2]d</SessionToken><Expiration>%[3]s</Expiration>`+
+		`</Credentials></%[1]sResult><ResponseMetadata><RequestId>%[2]d</RequestId></ResponseMetadata></%[1]sResponse>`, action, len(f.requests), expiration)
+}
+
+func NewS3CredentialsTestData(sts *FakeStsServer, data map[string][]byte) map[string][]byte {
+	ret := map[string][]byte{
+		"bucket": []byte("bucket"), "keyPrefix": []byte("cores"), "endpoint": []byte("https://s3.example.com"), "createBucket": []byte("false"),
+		"stsEndpoint": []byte(sts.server.URL),
+	}
+	for key, value := range data {
+		ret[key] = value
+	}
+	return ret
+}
+
+func TestNewS3DestinationSecretCredentials(t *testing.T) {
+	base := map[string][]byte{"bucket": []byte("bucket"), "keyPrefix": []byte("cores"), "endpoint": []byte("https://s3.example.com"), "createBucket": []byte("false")}
+	for _, data := range []map[string][]byte{
+		{"roleArn": []byte("arn:aws:iam::123456789012:role/r"), "externalId": []byte("id")},
+		{"roleArn": []byte("arn:aws:iam::123456789012:role/r"), "webIdentity": []byte("true")},
+		{"credentialsFile": []byte("[default]\n"), "profile": []byte("p")},
+	} {
+		for key, value := range base {
+			data[key] = value
+		}
+		_, err := NewS3DestinationSecret(data)
+		assert.Equal(t, nil, err, "data=%v", data)
+	}
+	for _, data := range []map[string][]byte{
+		{"webIdentity": []byte("true")},
+		{"roleArn": []byte("arn:aws:iam::123456789012:role/r"), "webIdentity": []byte("yes")},
+		{"roleArn": []byte("arn:aws:iam::123456789012:role/r"), "webIdentity": []byte("true"), "accessKey": []byte("a"), "secretKey": []byte("s")},
+		{"credentialsFile": []byte("[default]\n"), "accessKey": []byte("a"), "secretKey": []byte("s")},
+		{"roleArn": []byte("arn:aws:iam::123456789012:role/r"), "accessKey": []byte("a")},
+	} {
+		for key, value := range base {
+			data[key] = value
+		}
+		_, err := NewS3DestinationSecret(data)
+		assert.NotEqual(t, nil, err, "data=%v", data)
+	}
+}
+
+func TestGetRoleSessionName(t *testing.T) {
+	assert.Equal(t, "core-dump-test", GetRoleSessionName("test"))
+	assert.Equal(t, 64, len(GetRoleSessionName(strings.Repeat("a", 63))))
+}
+
+func TestS3CredentialsAssumeRole(t *testing.T) {
+	sts := NewFakeStsServer()
+	defer sts.Close()
+	cache := NewS3CredentialsCache(S3CredentialsConfig{})
+	c, err := NewS3DestinationSecret(NewS3CredentialsTestData(sts, map[string][]byte{
+		"accessKey": []byte("access"), "secretKey": []byte("secret"),
+		"roleArn": []byte("arn:aws:iam::123456789012:role/r"), "externalId": []byte("external"),
+	}))
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	creds, err := cache.Get("test", c)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	value, err := creds.Get()
+	if !assert.Equal(t, nil, err) || !assert.Equal(t, 1, len(sts.requests)) {
+		return
+	}
+	assert.Equal(t, "temp1", value.AccessKeyID)
+	assert.Equal(t, "token1", value.SessionToken)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/r", sts.requests[0].Get("RoleArn"))
+	assert.Equal(t, "external", sts.requests[0].Get("ExternalId"))
+	assert.Equal(t, "core-dump-test", sts.requests[0].Get("RoleSessionName"))
+	assert.Contains(t, sts.headers[0].Get("Authorization"), "Credential=access/")
+
+	// temporary credentials are reused until they expire
+	creds2, err := cache.Get("test", c)
+	if assert.Equal(t, nil, err) {
+		value, err = creds2.Get()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "temp1", value.AccessKeyID)
+		assert.Equal(t, 1, len(sts.requests))
+	}
+	creds.Expire()
+	value, err = creds.Get()
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "temp2", value.AccessKeyID)
+		assert.Equal(t, 2, len(sts.requests))
+	}
+	// credentials that expire within the expiry window are refreshed
+	sts.duration = 30 * time.Second
+	creds.Expire()
+	creds.Get()
+	value, err = creds.Get()
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "temp4", value.AccessKeyID)
+	}
+
+	// changed secrets and other namespaces do not share credentials
+	c.ExternalId = "changed"
+	creds3, err := cache.Get("test", c)
+	if assert.Equal(t, nil, err) {
+		assert.NotEqual(t, creds, creds3)
+	}
+	creds4, err := cache.Get("other", c)
+	if assert.Equal(t, nil, err) {
+		assert.NotEqual(t, creds3, creds4)
+		creds4.Get()
+		assert.Equal(t, "core-dump-other", sts.requests[len(sts.requests)-1].Get("RoleSessionName"))
+	}
+}
+
+func TestS3CredentialsWebIdentity(t *testing.T) {
+	sts := NewFakeStsServer()
+	defer sts.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if !assert.Equal(t, nil, os.WriteFile(tokenFile, []byte("jwt1"), 0600)) {
+		return
+	}
+	data := NewS3CredentialsTestData(sts, map[string][]byte{"roleArn": []byte("arn:aws:iam::123456789012:role/r"), "webIdentity": []byte("true")})
+	c, err := NewS3DestinationSecret(data)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	_, err = NewS3CredentialsCache(S3CredentialsConfig{}).Get("test", c)
+	assert.NotEqual(t, nil, err)
+
+	// roles are restricted per namespace
+	config := S3CredentialsConfig{WebIdentityTokenFile: tokenFile, AllowedRoleArns: []string{"arn:aws:iam::123456789012:role/{namespace}-*"}}
+	_, err = NewS3CredentialsCache(config).Get("test", c)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 0, len(sts.requests))
+
+	config.AllowedRoleArns = append(config.AllowedRoleArns, "arn:aws:iam::123456789012:role/r")
+	creds, err := NewS3CredentialsCache(config).Get("test", c)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	value, err := creds.Get()
+	if !assert.Equal(t, nil, err) || !assert.Equal(t, 1, len(sts.requests)) {
+		return
+	}
+	assert.Equal(t, "temp1", value.AccessKeyID)
+	assert.Equal(t, "AssumeRoleWithWebIdentity", sts.requests[0].Get("Action"))
+	assert.Equal(t, "jwt1", sts.requests[0].Get("WebIdentityToken"))
+	assert.Equal(t, "core-dump-test", sts.requests[0].Get("RoleSessionName"))
+	assert.Equal(t, "", sts.headers[0].Get("Authorization"))
+
+	// rotated tokens are read at refreshes
+	assert.Equal(t, nil, os.WriteFile(tokenFile, []byte("jwt2"), 0600))
+	creds.Expire()
+	value, err = creds.Get()
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "temp2", value.AccessKeyID)
+		assert.Equal(t, "jwt2", sts.requests[1].Get("WebIdentityToken"))
+	}
+}
+
+func TestS3CredentialsFile(t *testing.T) {
+	sts := NewFakeStsServer()
+	defer sts.Close()
+	file := "[default]\naws_access_key_id = default\naws_secret_access_key = s1\n[uploader]\naws_access_key_id = uploader\naws_secret_access_key = s2\n"
+	cache := NewS3CredentialsCache(S3CredentialsConfig{})
+	c, err := NewS3DestinationSecret(NewS3CredentialsTestData(sts, map[string][]byte{"credentialsFile": []byte(file), "profile": []byte("uploader")}))
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	creds, err := cache.Get("test", c)
+	if assert.Equal(t, nil, err) {
+		value, err := creds.Get()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "uploader", value.AccessKeyID)
+		assert.Equal(t, 0, len(sts.requests))
+	}
+	c.Profile = "missing"
+	_, err = cache.Get("test", c)
+	assert.NotEqual(t, nil, err)
+
+	c.Profile = ""
+	c.RoleArn = "arn:aws:iam::123456789012:role/r"
+	creds, err = cache.Get("test", c)
+	if assert.Equal(t, nil, err) {
+		_, err := creds.Get()
+		assert.Equal(t, nil, err)
+		if assert.Equal(t, 1, len(sts.requests)) {
+			assert.Contains(t, sts.headers[0].Get("Authorization"), "Credential=default/")
+		}
+	}
+}
+
+func TestReadCredentialsFile(t *testing.T) {
+	file := "# comment\n[default]\naws_access_key_id = a\n; comment\nAWS_SECRET_ACCESS_KEY=b\naws_session_token = c\n\n[other]\naws_access_key_id = d\n"
+	creds, err := ReadCredentialsFile([]byte(file), "")
+	if assert.Equal(t, nil, err) {
+		value, err := creds.Get()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, credentials.Value{AccessKeyID: "a", SecretAccessKey: "b", SessionToken: "c", ProviderName: credentials.StaticProviderName}, value)
+	}
+	for _, profile := range []string{"other", "missing"} {
+		_, err = ReadCredentialsFile([]byte(file), profile)
+		assert.NotEqual(t, nil, err, "profile=%v", profile)
+	}
+	for _, file := range []string{"[default\naws_access_key_id = a", "[default]\naws_access_key_id"} {
+		_, err = ReadCredentialsFile([]byte(file), "")
+		assert.NotEqual(t, nil, err, "file=%v", file)
+	}
+}
+
+func TestS3CredentialsUploaderCredentials(t *testing.T) {
+	sts := NewFakeStsServer()
+	defer sts.Close()
+	c, err := NewS3DestinationSecret(NewS3CredentialsTestData(sts, map[string][]byte{"roleArn": []byte("arn:aws:iam::123456789012:role/r")}))
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	_, err = NewS3CredentialsCache(S3CredentialsConfig{}).Get("test", c)
+	assert.NotEqual(t, nil, err)
+
+	config := S3CredentialsConfig{UploaderCredentials: credentials.NewStaticCredentials("node", "secret", ""), AllowedRoleArns: []string{"arn:aws:iam::*:role/{namespace}"}}
+	_, err = NewS3CredentialsCache(config).Get("test", c)
+	assert.NotEqual(t, nil, err)
+	// credentials of the uploader are not used without roles
+	c.RoleArn = ""
+	config.AllowedRoleArns = nil
+	_, err = NewS3CredentialsCache(config).Get("test", c)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 0, len(sts.requests))
+
+	c.RoleArn = "arn:aws:iam::123456789012:role/test"
+	config.AllowedRoleArns = []string{"arn:aws:iam::*:role/{namespace}"}
+	creds, err := NewS3CredentialsCache(config).Get("test", c)
+	if assert.Equal(t, nil, err) {
+		_, err := creds.Get()
+		assert.Equal(t, nil, err)
+		if assert.Equal(t, 1, len(sts.requests)) {
+			assert.Contains(t, sts.headers[0].Get("Authorization"), "Credential=node/")
+		}
+	}
+}
+
+func TestS3CredentialsPutObject(t *testing.T) {
+	sts := NewFakeStsServer()
+	defer sts.Close()
+	server := NewFakeS3Server()
+	defer server.Close()
+	c, err := NewS3DestinationSecret(NewS3CredentialsTestData(sts, map[string][]byte{
+		"accessKey": []byte("access"), "secretKey": []byte("secret"), "roleArn": []byte("arn:aws:iam::123456789012:role/r"),
+	}))
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	creds, err := NewS3CredentialsCache(S3CredentialsConfig{}).Get("test", c)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	tmpDir := t.TempDir()
+	s := NewFakeS3ClientWithCredentials(server, MultipartConfig{PartSize: MinPartSize, Concurrency: 1, MaxAttempts: 1, StateDir: filepath.Join(tmpDir, "uploads")}, creds)
+	filePath := filepath.Join(tmpDir, "a.zip")
+	CreateTestFile(t, filePath, 1024)
+	for i, key := range []string{"a.zip", "b.zip"} {
+		f, err := os.Open(filePath)
+		if !assert.Equal(t, nil, err) {
+			return
+		}
+		err = s.PutObject("bucket", key, f, nil)
+		f.Close()
+		if assert.Equal(t, nil, err) {
+			// requests are signed with refreshed credentials
+			header := server.headers["bucket/"+key]
+			assert.Contains(t, header.Get("Authorization"), fmt.Sprintf("Credential=temp%d/", i+1))
+			assert.Equal(t, fmt.Sprintf("token%d", i+1), header.Get("X-Amz-Security-Token"))
+		}
+		creds.Expire()
+	}
+}
@@ -0,0 +1,298 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	DestinationTypeS3          = "s3"
+	s3DefaultCaBundleSecretKey = "ca.crt"
+)
+
+// S3DestinationSecret is configured with entries of core-dump-handler secrets with type=s3 or without type
+type S3DestinationSecret struct {
+	Bucket       string                `yaml:"bucket"`
+	KeyPrefix    string                `yaml:"keyPrefix"`
+	AccessKey    string                `yaml:"accessKey"`
+	SecretKey    string                `yaml:"secretKey"`
+	Endpoint     string                `yaml:"endpoint"`
+	CreateBucket bool                  `yaml:"createBucket"`
+	SSE          *ServerSideEncryption `yaml:"-"`
+	// RoleArn is assumed with accessKey, credentialsFile, webIdentity, or credentials of the uploader
+	RoleArn     string `yaml:"roleArn"`
+	ExternalId  string `yaml:"externalId"`
+	WebIdentity bool   `yaml:"webIdentity"`
+	// CredentialsFile is the content of a shared credentials file in the INI format
+	CredentialsFile []byte `yaml:"-"`
+	Profile         string `yaml:"profile"`
+	StsEndpoint     string `yaml:"stsEndpoint"`
+	// ApiKey is an IBM Cloud API key to sign requests to Cloud Object Storage with IAM tokens
+	ApiKey            string `yaml:"apiKey"`
+	ServiceInstanceId string `yaml:"serviceInstanceId"`
+	IamEndpoint       string `yaml:"iamEndpoint"`
+	// Region is used for signatures and STS. The default is a dummy region for endpoints that ignore regions.
+	Region         string `yaml:"region"`
+	ForcePathStyle bool   `yaml:"forcePathStyle"`
+	// CaBundle is PEM certificates in caBundle or in caBundleSecretKey of caBundleSecret in the same namespace
+	CaBundle           []byte `yaml:"-"`
+	CaBundleSecret     string `yaml:"caBundleSecret"`
+	CaBundleSecretKey  string `yaml:"caBundleSecretKey"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+	ProxyUrl           string `yaml:"proxyUrl"`
+	// BucketOptions are applied if the uploader creates the bucket
+	BucketOptions *BucketOptions `yaml:"-"`
+}
+
+var s3RegionRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*[a-z0-9]$`)
+
+func parseOptionalBool(data map[string][]byte, key string) (bool, error) {
+	buf, ok := data[key]
+	if !ok {
+		return false, nil
+	}
+	ret, err := strconv.ParseBool(string(buf))
+	if err != nil {
+		return false, fmt.Errorf("cannot parse bool %v, %v", key, string(buf))
+	}
+	return ret, nil
+}
+
+// NewCaBundlePool returns a pool of PEM certificates in caBundle
+func NewCaBundlePool(caBundle []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBundle) {
+		return nil, fmt.Errorf("caBundle has no PEM certificates")
+	}
+	return pool, nil
+}
+
+// ValidateProxyUrl accepts proxies that http.Transport supports
+func ValidateProxyUrl(proxyUrl string) error {
+	u, err := url.Parse(proxyUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+		return fmt.Errorf("proxyUrl must be an http, https, or socks5 URL, err=%v", err)
+	}
+	return nil
+}
+
+// validateTransport checks region, CA bundles, and proxies
+func (s *S3DestinationSecret) validateTransport() error {
+	if s.Region != "" && !s3RegionRegexp.MatchString(s.Region) {
+		return fmt.Errorf("invalid region=%v", s.Region)
+	}
+	if len(s.CaBundle) > 0 && s.CaBundleSecret != "" {
+		return fmt.Errorf("caBundle and caBundleSecret are exclusive")
+	}
+	if s.CaBundleSecretKey != "" && s.CaBundleSecret == "" {
+		return fmt.Errorf("caBundleSecretKey requires caBundleSecret")
+	}
+	if (len(s.CaBundle) > 0 || s.CaBundleSecret != "") && s.InsecureSkipVerify {
+		return fmt.Errorf("caBundle and insecureSkipVerify are exclusive")
+	}
+	if len(s.CaBundle) > 0 || s.CaBundleSecret != "" || s.InsecureSkipVerify {
+		if u, err := url.Parse(s.Endpoint); err != nil || u.Scheme != "https" {
+			return fmt.Errorf("caBundle and insecureSkipVerify require an https endpoint")
+		}
+	}
+	if len(s.CaBundle) > 0 {
+		if _, err := NewCaBundlePool(s.CaBundle); err != nil {
+			return err
+		}
+	}
+	if s.ProxyUrl != "" {
+		if err := ValidateProxyUrl(s.ProxyUrl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewHttpClient applies caBundle, insecureSkipVerify, and proxyUrl to a clone of the transport of base
+func (s *S3DestinationSecret) NewHttpClient(base *http.Client) (*http.Client, error) {
+	if len(s.CaBundle) == 0 && !s.InsecureSkipVerify && s.ProxyUrl == "" {
+		return base, nil
+	}
+	transport, ok := base.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+	if len(s.CaBundle) > 0 || s.InsecureSkipVerify {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: s.InsecureSkipVerify}
+		if len(s.CaBundle) > 0 {
+			pool, err := NewCaBundlePool(s.CaBundle)
+			if err != nil {
+				return nil, fmt.Errorf("failed: NewHttpClient, %v", err)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if s.ProxyUrl != "" {
+		u, err := url.Parse(s.ProxyUrl)
+		if err != nil {
+			return nil, fmt.Errorf("failed: NewHttpClient, Parse proxyUrl, err=%v", err)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	return &http.Client{Transport: transport, Timeout: base.Timeout}, nil
+}
+
+func NewS3DestinationSecret(data map[string][]byte) (*S3DestinationSecret, error) {
+	noEnt := make([]string, 0)
+	required := []string{"bucket", "keyPrefix", "endpoint", "createBucket"}
+	_, hasRole := data["roleArn"]
+	_, hasFile := data["credentialsFile"]
+	_, hasKey := data["accessKey"]
+	_, hasApiKey := data["apiKey"]
+	if hasKey || !(hasRole || hasFile || hasApiKey) {
+		required = append(required, "accessKey", "secretKey")
+	}
+	for _, ent := range required {
+		if _, ok := data[ent]; !ok {
+			noEnt = append(noEnt, ent)
+		}
+	}
+	if len(noEnt) > 0 {
+		return nil, fmt.Errorf("failed: NewS3DestinationSecret, malformed core-dump-handler secret, missing entries=%v", strings.Join(noEnt, ","))
+	}
+	createBucket, err := strconv.ParseBool(string(data["createBucket"]))
+	if err != nil {
+		return nil, fmt.Errorf("failed: NewS3DestinationSecret, malformed core-dump-handler secret, cannot parse bool createBucket, %v", data["createBucket"])
+	}
+	bools := make(map[string]bool)
+	for _, key := range []string{"webIdentity", "forcePathStyle", "insecureSkipVerify"} {
+		if bools[key], err = parseOptionalBool(data, key); err != nil {
+			return nil, fmt.Errorf("failed: NewS3DestinationSecret, malformed core-dump-handler secret, %v", err)
+		}
+	}
+	if bools["webIdentity"] && (!hasRole || hasFile || hasKey) {
+		return nil, fmt.Errorf("failed: NewS3DestinationSecret, malformed core-dump-handler secret, webIdentity requires roleArn without accessKey and credentialsFile")
+	}
+	if hasFile && hasKey {
+		return nil, fmt.Errorf("failed: NewS3DestinationSecret, malformed core-dump-handler secret, accessKey and credentialsFile are exclusive")
+	}
+	if hasApiKey {
+		if hasKey || hasRole || hasFile {
+			return nil, fmt.Errorf("failed: NewS3DestinationSecret, malformed core-dump-handler secret, apiKey cannot be used with accessKey, roleArn, or credentialsFile")
+		}
+		if buf, ok := data["iamEndpoint"]; ok {
+			if err := ValidateIamEndpoint(string(buf)); err != nil {
+				return nil, fmt.Errorf("failed: NewS3DestinationSecret, malformed core-dump-handler secret, %v", err)
+			}
+		}
+	}
+	sse, err := NewServerSideEncryption(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed: NewS3DestinationSecret, malformed core-dump-handler secret, %v", err)
+	}
+	ret := &S3DestinationSecret{
+		Bucket: string(data["bucket"]), KeyPrefix: string(data["keyPrefix"]),
+		AccessKey: string(data["accessKey"]), SecretKey: string(data["secretKey"]), Endpoint: string(data["endpoint"]),
+		CreateBucket: createBucket, SSE: sse,
+		RoleArn: string(data["roleArn"]), ExternalId: string(data["externalId"]), WebIdentity: bools["webIdentity"],
+		CredentialsFile: data["credentialsFile"], Profile: string(data["profile"]), StsEndpoint: string(data["stsEndpoint"]),
+		ApiKey: string(data["apiKey"]), ServiceInstanceId: string(data["serviceInstanceId"]), IamEndpoint: string(data["iamEndpoint"]),
+		Region: string(data["region"]), ForcePathStyle: bools["forcePathStyle"], CaBundle: data["caBundle"],
+		CaBundleSecret: string(data["caBundleSecret"]), CaBundleSecretKey: string(data["caBundleSecretKey"]),
+		InsecureSkipVerify: bools["insecureSkipVerify"], ProxyUrl: string(data["proxyUrl"]),
+	}
+	if err := ret.validateTransport(); err != nil {
+		return nil, fmt.Errorf("failed: NewS3DestinationSecret, malformed core-dump-handler secret, %v", err)
+	}
+	if ret.BucketOptions, err = NewBucketOptions(data, ret.Endpoint, ret.Region, ret.KeyPrefix); err != nil {
+		return nil, fmt.Errorf("failed: NewS3DestinationSecret, malformed core-dump-handler secret, %v", err)
+	}
+	return ret, nil
+}
+
+type S3Destination struct {
+	client S3Client
+	c      *S3DestinationSecret
+}
+
+// ResolveCaBundle reads caBundleSecret into CaBundle
+func (s *S3DestinationSecret) ResolveCaBundle(namespace string, getSecret SecretGetter) error {
+	if s.CaBundleSecret == "" {
+		return nil
+	}
+	key := s.CaBundleSecretKey
+	if key == "" {
+		key = s3DefaultCaBundleSecretKey
+	}
+	data, err := getSecret(namespace, s.CaBundleSecret)
+	if err != nil {
+		return fmt.Errorf("failed: ResolveCaBundle, caBundleSecret=%v, err=%v", s.CaBundleSecret, err)
+	}
+	caBundle, ok := data[key]
+	if !ok {
+		return fmt.Errorf("failed: ResolveCaBundle, caBundleSecret=%v has no key=%v", s.CaBundleSecret, key)
+	}
+	if _, err := NewCaBundlePool(caBundle); err != nil {
+		return fmt.Errorf("failed: ResolveCaBundle, caBundleSecret=%v, key=%v, err=%v", s.CaBundleSecret, key, err)
+	}
+	s.CaBundle = caBundle
+	return nil
+}
+
+// NewS3DestinationFactory creates an S3Client per destination since ResetClient changes credentials per namespace.
+// Credentials are shared among destinations of a namespace in credsCache to reuse temporary credentials.
+// getSecret reads caBundleSecret.
+func NewS3DestinationFactory(newS3Client S3ClientFactory, credsCache *S3CredentialsCache, getSecret SecretGetter) DestinationFactory {
+	return func(namespace string, data map[string][]byte) (Destination, error) {
+		c, err := NewS3DestinationSecret(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.ResolveCaBundle(namespace, getSecret); err != nil {
+			return nil, err
+		}
+		if c.InsecureSkipVerify {
+			log.Printf("WARN: NewS3Destination, insecureSkipVerify disables TLS verification of %v for namespace %v", c.Endpoint, namespace)
+		}
+		config, err := credsCache.GetClientConfig(namespace, c)
+		if err != nil {
+			return nil, err
+		}
+		client := newS3Client()
+		if err := client.ResetClient(config); err != nil {
+			return nil, err
+		}
+		return &S3Destination{client: client, c: c}, nil
+	}
+}
+
+func (d *S3Destination) Prepare() error {
+	if err := d.client.IsBucketExist(d.c.Bucket); err != nil {
+		if !d.c.CreateBucket {
+			return err
+		}
+		if err := d.client.CreateBucket(d.c.Bucket, d.c.BucketOptions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put applies server-side encryption in the secret to opts
+func (d *S3Destination) Put(key string, f *os.File, opts *ObjectOptions) error {
+	s3Opts := &ObjectOptions{SSE: d.c.SSE}
+	if opts != nil {
+		s3Opts.Metadata, s3Opts.Tags = opts.Metadata, opts.Tags
+	}
+	return d.client.PutObject(d.c.Bucket, key, f, s3Opts)
+}
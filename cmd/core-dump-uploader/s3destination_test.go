@@ -0,0 +1,226 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// NewMockDestinations registers s for the s3 type
+func NewMockDestinations(s *MockS3Client) *DestinationRegistry {
+	r := NewDestinationRegistry()
+	r.Register(DestinationTypeS3, NewS3DestinationFactory(NewMockS3ClientFactory(s), NewS3CredentialsCache(S3CredentialsConfig{}), NewMockK8sClient(nil, nil, nil, false, false).GetSecretData))
+	return r
+}
+
+func TestNewS3DestinationSecret(t *testing.T) {
+	expected := map[string][]byte{
+		"bucket":       []byte("bucket"),
+		"keyPrefix":    []byte("a/b/c"),
+		"accessKey":    []byte("ABCDEF"),
+		"secretKey":    []byte("12345"),
+		"endpoint":     []byte("https://endpoint.io"),
+		"createBucket": []byte("true"),
+	}
+	c, err := NewS3DestinationSecret(expected)
+	if err != nil {
+		t.Errorf("Failed: NewS3DestinationSecret, expected=%v, err=%v", expected, err)
+		return
+	}
+	assert.Equal(t, string(expected["accessKey"]), c.AccessKey)
+	assert.Equal(t, string(expected["secretKey"]), c.SecretKey)
+	assert.Equal(t, string(expected["bucket"]), c.Bucket)
+	assert.Equal(t, string(expected["endpoint"]), c.Endpoint)
+	assert.Equal(t, string(expected["keyPrefix"]), c.KeyPrefix)
+	assert.Equal(t, (*ServerSideEncryption)(nil), c.SSE)
+
+	expected["sse"] = []byte("SSE-KMS")
+	expected["sseKmsKeyId"] = []byte("key")
+	c, err = NewS3DestinationSecret(expected)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &ServerSideEncryption{Type: SSETypeKMS, KmsKeyId: "key"}, c.SSE)
+	expected["sse"] = []byte("SSE-X")
+	_, err = NewS3DestinationSecret(expected)
+	assert.NotEqual(t, nil, err)
+
+	malformed := map[string][]byte{
+		"bucket":       []byte("bucket"),
+		"keyPrefix":    []byte("a/b/c"),
+		"accessKey":    []byte("ABCDEF"),
+		"secretKey":    []byte("12345"),
+		"endPoint":     []byte("https://endpoint.io"),
+		"createBucket": []byte("createBucket"),
+	}
+	_, err = NewS3DestinationSecret(malformed)
+	assert.NotEqual(t, nil, err)
+	malformed = map[string][]byte{
+		"bucket":       []byte("bucket"),
+		"keyPrefix":    []byte("a/b/c"),
+		"secretKey":    []byte("12345"),
+		"endPoint":     []byte("https://endpoint.io"),
+		"createBucket": []byte("true"),
+	}
+	_, err = NewS3DestinationSecret(malformed)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDestinationRegistry(t *testing.T) {
+	data := map[string][]byte{
+		"bucket": []byte("bucket"), "keyPrefix": []byte("a/b/c"), "accessKey": []byte("ABCDEF"),
+		"secretKey": []byte("12345"), "endpoint": []byte("https://endpoint.io"), "createBucket": []byte("false"),
+	}
+	r := NewMockDestinations(NewMockS3Client(nil, nil, nil, nil))
+	assert.Equal(t, []string{DestinationTypeS3}, r.GetTypes())
+	d, err := r.NewDestination(DestinationTypeS3, "test", data)
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, nil, d.Prepare())
+	}
+	_, err = r.NewDestination("unknown", "test", data)
+	if assert.NotEqual(t, nil, err) {
+		assert.Contains(t, err.Error(), "unknown type=unknown")
+	}
+	_, err = r.NewDestination(DestinationTypeS3, "test", map[string][]byte{})
+	assert.NotEqual(t, nil, err)
+
+	r = NewMockDestinations(NewMockS3Client(unix.EINVAL, nil, nil, nil))
+	_, err = r.NewDestination(DestinationTypeS3, "test", data)
+	assert.Equal(t, unix.EINVAL, err)
+	r = NewMockDestinations(NewMockS3Client(nil, nil, unix.ENOENT, nil))
+	d, err = r.NewDestination(DestinationTypeS3, "test", data)
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, unix.ENOENT, d.Prepare())
+	}
+}
+
+func NewS3TransportTestData(endpoint string, data map[string][]byte) map[string][]byte {
+	ret := map[string][]byte{
+		"bucket": []byte("bucket"), "keyPrefix": []byte("cores"), "accessKey": []byte("access"), "secretKey": []byte("secret"),
+		"endpoint": []byte(endpoint), "createBucket": []byte("false"),
+	}
+	for key, value := range data {
+		ret[key] = value
+	}
+	return ret
+}
+
+func TestNewS3DestinationSecretTransport(t *testing.T) {
+	server := NewFakeS3TLSServer()
+	defer server.Close()
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.server.Certificate().Raw})
+	c, err := NewS3DestinationSecret(NewS3TransportTestData("https://minio.example.com", map[string][]byte{
+		"region": []byte("eu-de"), "forcePathStyle": []byte("true"), "caBundle": caBundle, "proxyUrl": []byte("http://proxy.example.com:3128"),
+	}))
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "eu-de", c.Region)
+		assert.Equal(t, true, c.ForcePathStyle)
+		assert.Equal(t, caBundle, c.CaBundle)
+		assert.Equal(t, "http://proxy.example.com:3128", c.ProxyUrl)
+	}
+	for _, data := range []map[string][]byte{
+		{"region": []byte("EU DE")},
+		{"forcePathStyle": []byte("yes")},
+		{"insecureSkipVerify": []byte("1x")},
+		{"caBundle": []byte("not a certificate")},
+		{"caBundle": caBundle, "insecureSkipVerify": []byte("true")},
+		{"caBundle": caBundle, "caBundleSecret": []byte("ca")},
+		{"caBundleSecretKey": []byte("ca.crt")},
+		{"proxyUrl": []byte("proxy.example.com:3128")},
+		{"proxyUrl": []byte("ftp://proxy.example.com")},
+	} {
+		_, err := NewS3DestinationSecret(NewS3TransportTestData("https://minio.example.com", data))
+		assert.NotEqual(t, nil, err, "data=%v", data)
+	}
+	_, err = NewS3DestinationSecret(NewS3TransportTestData("http://minio.example.com", map[string][]byte{"insecureSkipVerify": []byte("true")}))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestS3DestinationTransport(t *testing.T) {
+	server := NewFakeS3TLSServer()
+	defer server.Close()
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.server.Certificate().Raw})
+	k8s := NewMockK8sClient(nil, nil, nil, false, false)
+	k8s.secretData = map[string]map[string][]byte{"internal-ca": {"ca.crt": caBundle}, "other-ca": {"ca.pem": caBundle}}
+	tmpDir := t.TempDir()
+	multipart := MultipartConfig{PartSize: MinPartSize, Concurrency: 1, MaxAttempts: 1, StateDir: filepath.Join(tmpDir, "uploads")}
+	r := NewDestinationRegistry()
+	r.Register(DestinationTypeS3, NewS3DestinationFactory(func() S3Client { return NewS3Client(multipart) }, NewS3CredentialsCache(S3CredentialsConfig{}), k8s.GetSecretData))
+	filePath := filepath.Join(tmpDir, "a.zip")
+	CreateTestFile(t, filePath, 1024)
+	f, err := os.Open(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+
+	for i, data := range []map[string][]byte{
+		{"caBundle": caBundle}, {"caBundleSecret": []byte("internal-ca")},
+		{"caBundleSecret": []byte("other-ca"), "caBundleSecretKey": []byte("ca.pem")}, {"insecureSkipVerify": []byte("true")},
+	} {
+		data["forcePathStyle"] = []byte("true")
+		data["region"] = []byte("eu-de")
+		d, err := r.NewDestination(DestinationTypeS3, "test", NewS3TransportTestData(server.server.URL, data))
+		if !assert.Equal(t, nil, err, "data=%v", data) {
+			continue
+		}
+		key := fmt.Sprintf("%d.zip", i)
+		if assert.Equal(t, nil, d.Put(key, f, nil), "data=%v", data) {
+			assert.Contains(t, server.headers["bucket/"+key].Get("Authorization"), "/eu-de/s3/aws4_request")
+		}
+	}
+	// the default transport does not trust the test CA
+	d, err := r.NewDestination(DestinationTypeS3, "test", NewS3TransportTestData(server.server.URL, map[string][]byte{"forcePathStyle": []byte("true")}))
+	if assert.Equal(t, nil, err) {
+		assert.NotEqual(t, nil, d.Put("untrusted.zip", f, nil))
+	}
+	for _, data := range []map[string][]byte{
+		{"caBundleSecret": []byte("missing")}, {"caBundleSecret": []byte("internal-ca"), "caBundleSecretKey": []byte("ca.pem")},
+	} {
+		_, err := r.NewDestination(DestinationTypeS3, "test", NewS3TransportTestData(server.server.URL, data))
+		assert.NotEqual(t, nil, err, "data=%v", data)
+	}
+}
+
+func TestS3DestinationProxy(t *testing.T) {
+	server := NewFakeS3Server()
+	defer server.Close()
+	proxied := make([]string, 0)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		server.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+	tmpDir := t.TempDir()
+	multipart := MultipartConfig{PartSize: MinPartSize, Concurrency: 1, MaxAttempts: 1, StateDir: filepath.Join(tmpDir, "uploads")}
+	r := NewDestinationRegistry()
+	r.Register(DestinationTypeS3, NewS3DestinationFactory(func() S3Client { return NewS3Client(multipart) }, NewS3CredentialsCache(S3CredentialsConfig{}), nil))
+	// the endpoint does not need to be resolvable since requests go through the proxy
+	d, err := r.NewDestination(DestinationTypeS3, "test", NewS3TransportTestData("http://s3.internal.example.com", map[string][]byte{
+		"forcePathStyle": []byte("true"), "proxyUrl": []byte(proxy.URL),
+	}))
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	filePath := filepath.Join(tmpDir, "a.zip")
+	expected := CreateTestFile(t, filePath, 1024)
+	f, err := os.Open(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer f.Close()
+	if assert.Equal(t, nil, d.Put("a.zip", f, nil)) {
+		assert.Equal(t, []string{"http://s3.internal.example.com/bucket/a.zip"}, proxied)
+		assert.Equal(t, expected, server.objects["bucket/a.zip"])
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	SSETypeS3  = "SSE-S3"
+	SSETypeKMS = "SSE-KMS"
+	SSETypeC   = "SSE-C"
+)
+
+// ServerSideEncryption is configured with sse, sseKmsKeyId, sseKmsEncryptionContext, and sseCustomerKey in core-dump-handler secrets
+type ServerSideEncryption struct {
+	Type string
+	// KmsKeyId is optional for SSE-KMS. Endpoints use their default key if it is empty.
+	KmsKeyId string
+	// KmsEncryptionContext is a base64-encoded JSON object
+	KmsEncryptionContext string
+	// CustomerKey is a 256-bit key for SSE-C
+	CustomerKey []byte
+}
+
+// NewServerSideEncryption returns nil if data does not configure sse
+func NewServerSideEncryption(data map[string][]byte) (*ServerSideEncryption, error) {
+	sseType, ok := data["sse"]
+	if !ok || len(sseType) == 0 {
+		for _, ent := range []string{"sseKmsKeyId", "sseKmsEncryptionContext", "sseCustomerKey"} {
+			if _, ok := data[ent]; ok {
+				return nil, fmt.Errorf("failed: NewServerSideEncryption, %v requires sse", ent)
+			}
+		}
+		return nil, nil
+	}
+	e := &ServerSideEncryption{}
+	switch string(sseType) {
+	case SSETypeS3, s3.ServerSideEncryptionAes256:
+		e.Type = SSETypeS3
+	case SSETypeKMS, s3.ServerSideEncryptionAwsKms:
+		e.Type = SSETypeKMS
+		e.KmsKeyId = string(data["sseKmsKeyId"])
+		if context, ok := data["sseKmsEncryptionContext"]; ok && len(context) > 0 {
+			var v map[string]string
+			if err := json.Unmarshal(context, &v); err != nil {
+				return nil, fmt.Errorf("failed: NewServerSideEncryption, sseKmsEncryptionContext must be a JSON object of strings, err=%v", err)
+			}
+			e.KmsEncryptionContext = base64.StdEncoding.EncodeToString(context)
+		}
+	case SSETypeC:
+		e.Type = SSETypeC
+		key, err := base64.StdEncoding.DecodeString(string(data["sseCustomerKey"]))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("failed: NewServerSideEncryption, sseCustomerKey must be a base64-encoded 256-bit key")
+		}
+		e.CustomerKey = key
+	default:
+		return nil, fmt.Errorf("failed: NewServerSideEncryption, unknown sse=%v (valid: %v, %v, %v)", string(sseType), SSETypeS3, SSETypeKMS, SSETypeC)
+	}
+	if e.Type != SSETypeKMS {
+		for _, ent := range []string{"sseKmsKeyId", "sseKmsEncryptionContext"} {
+			if _, ok := data[ent]; ok {
+				return nil, fmt.Errorf("failed: NewServerSideEncryption, %v requires sse=%v", ent, SSETypeKMS)
+			}
+		}
+	}
+	if _, ok := data["sseCustomerKey"]; ok && e.Type != SSETypeC {
+		return nil, fmt.Errorf("failed: NewServerSideEncryption, sseCustomerKey requires sse=%v", SSETypeC)
+	}
+	return e, nil
+}
+
+// String does not contain key material. It identifies settings that a multipart upload was started with.
+func (e *ServerSideEncryption) String() string {
+	if e == nil {
+		return ""
+	}
+	switch e.Type {
+	case SSETypeKMS:
+		return fmt.Sprintf("%v:%v:%v", e.Type, e.KmsKeyId, e.KmsEncryptionContext)
+	case SSETypeC:
+		sum := md5.Sum(e.CustomerKey)
+		return fmt.Sprintf("%v:%v", e.Type, base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	return e.Type
+}
+
+func (e *ServerSideEncryption) ApplyPutObject(in *s3.PutObjectInput) {
+	if e == nil {
+		return
+	}
+	switch e.Type {
+	case SSETypeS3:
+		in.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAes256)
+	case SSETypeKMS:
+		in.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		if e.KmsKeyId != "" {
+			in.SSEKMSKeyId = aws.String(e.KmsKeyId)
+		}
+		if e.KmsEncryptionContext != "" {
+			in.SSEKMSEncryptionContext = aws.String(e.KmsEncryptionContext)
+		}
+	case SSETypeC:
+		in.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		in.SSECustomerKey = aws.String(string(e.CustomerKey))
+	}
+}
+
+func (e *ServerSideEncryption) ApplyCreateMultipartUpload(in *s3.CreateMultipartUploadInput) {
+	if e == nil {
+		return
+	}
+	switch e.Type {
+	case SSETypeS3:
+		in.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAes256)
+	case SSETypeKMS:
+		in.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		if e.KmsKeyId != "" {
+			in.SSEKMSKeyId = aws.String(e.KmsKeyId)
+		}
+		if e.KmsEncryptionContext != "" {
+			in.SSEKMSEncryptionContext = aws.String(e.KmsEncryptionContext)
+		}
+	case SSETypeC:
+		in.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		in.SSECustomerKey = aws.String(string(e.CustomerKey))
+	}
+}
+
+// ApplyUploadPart sets SSE-C keys. Other types are inherited from CreateMultipartUpload.
+func (e *ServerSideEncryption) ApplyUploadPart(in *s3.UploadPartInput) {
+	if e == nil || e.Type != SSETypeC {
+		return
+	}
+	in.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+	in.SSECustomerKey = aws.String(string(e.CustomerKey))
+}
+
+// WrapError explains errors that endpoints return for unsupported or misconfigured encryption
+func (e *ServerSideEncryption) WrapError(err error) error {
+	if e == nil || err == nil {
+		return err
+	}
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	switch awsErr.Code() {
+	case "InvalidArgument", "InvalidRequest", "NotImplemented", "InvalidEncryptionAlgorithmError", "AccessDenied",
+		"KMS.NotFoundException", "KMS.DisabledException", "KMS.KMSInvalidStateException", "KMS.AccessDeniedException":
+		return fmt.Errorf("endpoint rejected server-side encryption (sse=%v, sseKmsKeyId=%v): %v", e.Type, e.KmsKeyId, err)
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2023- IBM Inc. All rights reserved
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewServerSideEncryption(t *testing.T) {
+	e, err := NewServerSideEncryption(map[string][]byte{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, (*ServerSideEncryption)(nil), e)
+
+	for _, sse := range []string{"SSE-S3", "AES256"} {
+		e, err = NewServerSideEncryption(map[string][]byte{"sse": []byte(sse)})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, &ServerSideEncryption{Type: SSETypeS3}, e)
+	}
+
+	e, err = NewServerSideEncryption(map[string][]byte{
+		"sse": []byte("aws:kms"), "sseKmsKeyId": []byte("key"), "sseKmsEncryptionContext": []byte(`{"team":"a"}`),
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &ServerSideEncryption{
+		Type: SSETypeKMS, KmsKeyId: "key", KmsEncryptionContext: base64.StdEncoding.EncodeToString([]byte(`{"team":"a"}`)),
+	}, e)
+
+	key := make([]byte, 32)
+	e, err = NewServerSideEncryption(map[string][]byte{"sse": []byte("SSE-C"), "sseCustomerKey": []byte(base64.StdEncoding.EncodeToString(key))})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &ServerSideEncryption{Type: SSETypeC, CustomerKey: key}, e)
+	assert.Equal(t, false, strings.Contains(e.String(), string(key)))
+
+	for _, data := range []map[string][]byte{
+		{"sse": []byte("unknown")},
+		{"sseKmsKeyId": []byte("key")},
+		{"sse": []byte("SSE-S3"), "sseKmsKeyId": []byte("key")},
+		{"sse": []byte("SSE-KMS"), "sseKmsEncryptionContext": []byte("a=b")},
+		{"sse": []byte("SSE-KMS"), "sseCustomerKey": []byte(base64.StdEncoding.EncodeToString(key))},
+		{"sse": []byte("SSE-C")},
+		{"sse": []byte("SSE-C"), "sseCustomerKey": []byte(base64.StdEncoding.EncodeToString(key[:16]))},
+	} {
+		_, err = NewServerSideEncryption(data)
+		assert.NotEqual(t, nil, err, "data=%v", data)
+	}
+}
+
+func TestPutObjectWithServerSideEncryption(t *testing.T) {
+	// AWS_CA_BUNDLE replaces the transport that trusts the test server
+	t.Setenv("AWS_CA_BUNDLE", "")
+	server := NewFakeS3TLSServer()
+	defer server.Close()
+	tmpDir := t.TempDir()
+	s := NewFakeS3Client(server, MultipartConfig{PartSize: MinPartSize, Concurrency: 2, MaxAttempts: 1, StateDir: filepath.Join(tmpDir, "uploads")})
+
+	smallPath := filepath.Join(tmpDir, "small.zip")
+	CreateTestFile(t, smallPath, 1024)
+	largePath := filepath.Join(tmpDir, "large.zip")
+	CreateTestFile(t, largePath, int(MinPartSize*2))
+	small, err := os.Open(smallPath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer small.Close()
+	large, err := os.Open(largePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	defer large.Close()
+
+	kms := &ServerSideEncryption{Type: SSETypeKMS, KmsKeyId: "key"}
+	for _, f := range []*os.File{small, large} {
+		assert.Equal(t, nil, s.PutObject("bucket", "kms/"+filepath.Base(f.Name()), f, &ObjectOptions{SSE: kms}))
+		h := server.headers["bucket/kms/"+filepath.Base(f.Name())]
+		assert.Equal(t, "aws:kms", h.Get("x-amz-server-side-encryption"))
+		assert.Equal(t, "key", h.Get("x-amz-server-side-encryption-aws-kms-key-id"))
+	}
+
+	customer := &ServerSideEncryption{Type: SSETypeC, CustomerKey: make([]byte, 32)}
+	for _, f := range []*os.File{small, large} {
+		assert.Equal(t, nil, s.PutObject("bucket", "c/"+filepath.Base(f.Name()), f, &ObjectOptions{SSE: customer}))
+		h := server.headers["bucket/c/"+filepath.Base(f.Name())]
+		assert.Equal(t, "AES256", h.Get("x-amz-server-side-encryption-customer-algorithm"))
+		assert.NotEqual(t, "", h.Get("x-amz-server-side-encryption-customer-key-md5"))
+	}
+	for partNumber, h := range server.partHeaders {
+		assert.Equal(t, "AES256", h.Get("x-amz-server-side-encryption-customer-algorithm"), "partNumber=%v", partNumber)
+	}
+
+	server.rejectSSE = true
+	for _, f := range []*os.File{small, large} {
+		err = s.PutObject("bucket", "rejected/"+filepath.Base(f.Name()), f, &ObjectOptions{SSE: kms})
+		if assert.NotEqual(t, nil, err) {
+			assert.Contains(t, err.Error(), "endpoint rejected server-side encryption")
+		}
+	}
+	assert.Equal(t, nil, s.PutObject("bucket", "rejected/small.zip", small, nil))
+}
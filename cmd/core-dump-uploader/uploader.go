@@ -6,74 +6,138 @@
 package main
 
 import (
+	"bufio"
+	"crypto/ecdh"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"runtime/debug"
-	"strconv"
 	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws/defaults"
 	"golang.org/x/sys/unix"
 	"gopkg.in/fsnotify.v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
+// CoreDumpUploaderSecret has entries of core-dump-handler secrets for every destination type
 type CoreDumpUploaderSecret struct {
-	Bucket       string `yaml:"bucket"`
-	KeyPrefix    string `yaml:"keyPrefix"`
-	AccessKey    string `yaml:"accessKey"`
-	SecretKey    string `yaml:"secretKey"`
-	Endpoint     string `yaml:"endpoint"`
-	CreateBucket bool   `yaml:"createBucket"`
+	// Type selects a Destination (default: s3)
+	Type      string
+	KeyPrefix string
+	// EncryptionPublicKey enables client-side encryption. Only owners of its private key can decrypt uploaded core dumps.
+	EncryptionPublicKey *ecdh.PublicKey
+	// KeyTemplate generates object keys under KeyPrefix (default: {namespace}/{file})
+	KeyTemplate *KeyTemplate
 }
 
 func NewCoreDumpUploaderSecret(data map[string][]byte) (*CoreDumpUploaderSecret, error) {
-	noEnt := make([]string, 0)
-	for _, ent := range []string{"bucket", "keyPrefix", "accessKey", "secretKey", "endpoint", "createBucket"} {
-		if _, ok := data[ent]; !ok {
-			noEnt = append(noEnt, ent)
-		}
+	destType := DestinationTypeS3
+	if v, ok := data["type"]; ok && len(v) > 0 {
+		destType = string(v)
 	}
-	if len(noEnt) == 0 {
-		createBucket, err := strconv.ParseBool(string(data["createBucket"]))
-		if err != nil {
-			return nil, fmt.Errorf("failed: NewCoreDumpUploaderSecret, malformed core-dump-handler secret, cannot parse bool createBucket, %v", data["createBucket"])
+	var publicKey *ecdh.PublicKey = nil
+	if v, ok := data["encryptionPublicKey"]; ok {
+		var err error
+		if publicKey, err = ParsePublicKey(string(v)); err != nil {
+			return nil, fmt.Errorf("failed: NewCoreDumpUploaderSecret, malformed core-dump-handler secret, %v", err)
 		}
-		return &CoreDumpUploaderSecret{
-			Bucket: string(data["bucket"]), KeyPrefix: string(data["keyPrefix"]),
-			AccessKey: string(data["accessKey"]), SecretKey: string(data["secretKey"]), Endpoint: string(data["endpoint"]),
-			CreateBucket: createBucket,
-		}, nil
 	}
-	return nil, fmt.Errorf("failed: NewCoreDumpUploaderSecret, malformed core-dump-handler secret, missing entries=%v", strings.Join(noEnt, ","))
+	keyTemplate, err := NewKeyTemplate(string(data["keyTemplate"]))
+	if err != nil {
+		return nil, fmt.Errorf("failed: NewCoreDumpUploaderSecret, malformed core-dump-handler secret, %v", err)
+	}
+	return &CoreDumpUploaderSecret{
+		Type: destType, KeyPrefix: string(data["keyPrefix"]), EncryptionPublicKey: publicKey, KeyTemplate: keyTemplate,
+	}, nil
 }
 
 type Uploader struct {
-	zip       ZippedCoreDump
-	k8sClient K8sClient
-	s3Client  S3Client
+	zip          ZippedCoreDump
+	k8sClient    K8sClient
+	destinations *DestinationRegistry
+	queue        RetryQueue
+	pool         *WorkerPool
+	// workDir keeps encrypted files during uploads
+	workDir string
+	// nodeName is used for {node} if zip files do not record it
+	nodeName string
 }
 
-func NewUploader(zip ZippedCoreDump, k8sClient K8sClient, s3Client S3Client) *Uploader {
-	return &Uploader{zip: zip, k8sClient: k8sClient, s3Client: s3Client}
+func NewUploader(zip ZippedCoreDump, k8sClient K8sClient, destinations *DestinationRegistry, queue RetryQueue, concurrency int, workDir string, nodeName string) *Uploader {
+	u := &Uploader{zip: zip, k8sClient: k8sClient, destinations: destinations, queue: queue, workDir: workDir, nodeName: nodeName}
+	u.pool = NewWorkerPool(concurrency, u.GetNamespaceHint, func(filePath string) {
+		if err := u.ProcessSingleFile(filePath); err != nil {
+			log.Printf("%v", err)
+		}
+	})
+	return u
+}
+
+// GetNamespaceHint reads filePath without lock to schedule uploads per namespace. It returns "" for incomplete files.
+func (u *Uploader) GetNamespaceHint(filePath string) string {
+	buf, err := u.zip.ExtractRuntimeJson(filePath)
+	if err != nil {
+		return ""
+	}
+	namespace, err := u.zip.ParseRuntimeJsonBuf(buf)
+	if err != nil {
+		return ""
+	}
+	return namespace
 }
 
+// ProcessSingleFile removes filePath after a successful upload or a permanent error. Otherwise, it moves filePath into the retry queue.
 func (u *Uploader) ProcessSingleFile(filePath string) error {
 	if !u.zip.IsValidFile(filePath) {
 		return nil
 	}
-	if err := u.zip.Begin(filePath); err != nil {
+	h, err := u.zip.Begin(filePath)
+	if err != nil {
+		return err
+	}
+	err = u.upload(h)
+	h.End()
+	if err != nil && IsPermanentError(err) {
+		u.queue.Discard(filePath, err)
+		u.RemoveEncryptedFile(filePath)
 		return err
 	}
-	defer u.zip.End()
-
-	err := u.k8sClient.ResetClient()
 	if err != nil {
+		deadLettered, err2 := u.queue.Fail(filePath, err)
+		if err2 != nil {
+			log.Printf("%v", err2)
+		} else if deadLettered {
+			u.RemoveEncryptedFile(filePath)
+		}
 		return err
 	}
-	namespace := u.zip.GetNamespace()
+	u.queue.Succeed(filePath)
+	u.RemoveEncryptedFile(filePath)
+	return nil
+}
+
+// RemoveEncryptedFile removes the encrypted file of filePath after filePath left the retry queue.
+// Retries reuse the file since resumed multipart uploads keep parts of the same ciphertext.
+func (u *Uploader) RemoveEncryptedFile(filePath string) {
+	encPath := filepath.Join(u.workDir, filepath.Base(filePath)+cseSuffix)
+	if err := os.Remove(encPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("WARN: RemoveEncryptedFile, could not remove %v, err=%v", encPath, err)
+	}
+}
+
+func (u *Uploader) upload(h ZippedCoreDumpHandle) error {
+	if err := u.k8sClient.Start(); err != nil {
+		return err
+	}
+	namespace := h.GetNamespace()
 	if err := u.k8sClient.CheckNamespace(namespace); err != nil {
 		return err
 	}
@@ -81,30 +145,68 @@ func (u *Uploader) ProcessSingleFile(filePath string) error {
 	if err != nil {
 		return err
 	}
+	// malformed secrets are retried until tenants fix them or files are moved into the dead-letter dir
 	c, err := NewCoreDumpUploaderSecret(secretData)
 	if err != nil {
 		return err
 	}
-	err = u.s3Client.ResetClient(c.AccessKey, c.SecretKey, c.Endpoint)
+	dest, err := u.destinations.NewDestination(c.Type, namespace, secretData)
 	if err != nil {
 		return err
 	}
-	if err := u.s3Client.IsBucketExist(c.Bucket); err != nil {
-		if c.CreateBucket {
-			if err := u.s3Client.CreateBucket(c.Bucket); err != nil {
-				return err
-			}
-		} else {
+	if err := dest.Prepare(); err != nil {
+		return err
+	}
+	f := h.GetFile()
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed: upload, Stat, f.Name()=%v, err=%v", f.Name(), err)
+	}
+	modTime := stat.ModTime()
+	if c.EncryptionPublicKey != nil {
+		ef, err := EncryptFile(f, c.EncryptionPublicKey, u.workDir)
+		if err != nil {
 			return err
 		}
+		// ProcessSingleFile removes the encrypted file after the last attempt
+		defer ef.Close()
+		f = ef
 	}
-	if err := u.s3Client.PutObject(c.Bucket, filepath.Join(c.KeyPrefix, namespace)+"/", u.zip.GetFile()); err != nil {
+	info := h.GetRuntimeInfo()
+	key := GetObjectKey(c.KeyPrefix, c.KeyTemplate, GetKeyValues(info, filepath.Base(f.Name()), u.nodeName, modTime))
+	opts := &ObjectOptions{Metadata: info.GetMetadata(), Tags: info.GetTags()}
+	if err := dest.Put(key, f, opts); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (u *Uploader) ProcessRetries() {
+	for _, filePath := range u.queue.Due() {
+		u.pool.Submit(filePath)
+	}
+}
+
+// ProcessDir uploads zip files in watchDir that were written while the uploader was not running or whose events were dropped
+func (u *Uploader) ProcessDir(watchDir string) {
+	entries, err := os.ReadDir(watchDir)
+	if err != nil {
+		log.Printf("WARN: ProcessDir, ReadDir, watchDir=%v, err=%v", watchDir, err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		filePath := filepath.Join(watchDir, entry.Name())
+		if u.zip.IsValidFile(filePath) {
+			u.pool.Submit(filePath)
+		}
+	}
+}
+
 func (u *Uploader) Run(watchDir string) error {
+	defer u.pool.Stop()
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt, unix.SIGTERM, unix.SIGINT)
 
@@ -113,16 +215,29 @@ func (u *Uploader) Run(watchDir string) error {
 		return fmt.Errorf("NewWatcher, err=%v", err)
 	}
 	defer watcher.Close()
-	watcher.Add(watchDir)
+	if err := watcher.Add(watchDir); err != nil {
+		return fmt.Errorf("watcher.Add, watchDir=%v, err=%v", watchDir, err)
+	}
+
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	sweepTicker := time.NewTicker(sweepInterval)
+	defer sweepTicker.Stop()
+	u.ProcessDir(watchDir)
+	u.ProcessRetries()
 
 	var stopped = false
 	for !stopped {
 		select {
+		case <-ticker.C:
+			u.ProcessRetries()
+		case <-sweepTicker.C:
+			u.ProcessDir(watchDir)
 		case event := <-watcher.Events:
 			switch event.Op {
 			case fsnotify.Write:
-				if err := u.ProcessSingleFile(event.Name); err != nil {
-					log.Printf("%v", err)
+				if u.zip.IsValidFile(event.Name) {
+					u.pool.Submit(event.Name)
 				}
 			default:
 				// ignore other events
@@ -131,7 +246,11 @@ func (u *Uploader) Run(watchDir string) error {
 			log.Printf("Received Signal: %v", signal.String())
 			stopped = true
 		case err := <-watcher.Errors:
-			return fmt.Errorf("watcher.Errors, watchDir=%v, err=%v", watchDir, err)
+			if err != fsnotify.ErrEventOverflow {
+				return fmt.Errorf("watcher.Errors, watchDir=%v, err=%v", watchDir, err)
+			}
+			log.Printf("WARN: watcher.Errors, watchDir=%v, err=%v, sweep watchDir", watchDir, err)
+			u.ProcessDir(watchDir)
 		}
 	}
 	return nil
@@ -158,19 +277,168 @@ func GetVersion() (ret string) {
 	return ret
 }
 
-var watchDir, defaultNamespace, namespaceLabelSelector string
+var watchDir, defaultNamespace, namespaceLabelSelector, namespaceSelector string
+var retryDir, deadLetterDir string
+var maxAttempts, concurrency, partConcurrency, partMaxAttempts, httpMaxAttempts int
+var partSize int64
+var uploadStateDir, nodeName, fsRoot, fsQuota, webIdentityTokenFile, allowedRoleArns string
+var assumeRoleWithUploaderCredentials bool
+var retryInterval, retryInitialBackoff, retryMaxBackoff, sweepInterval, httpTimeout time.Duration
 
 func init() {
 	flag.StringVar(&watchDir, "watchDir", "/mnt/core-dump-handler/", "Directory path to be watched")
 	flag.StringVar(&defaultNamespace, "defaultNamespace", "core-dump-handler", "Default namespace for upload")
-	flag.StringVar(&namespaceLabelSelector, "namespaceLabelSelector", "kubernetes.io/metadata.name=core-dump-handler", "Label selector to enable uploads (format: key1=value1,key2=value2)")
+	flag.StringVar(&namespaceLabelSelector, "namespaceLabelSelector", "kubernetes.io/metadata.name=core-dump-handler", "Deprecated: label selector to enable uploads (format: key1=value1,key2=value2). All labels must match")
+	flag.StringVar(&namespaceSelector, "namespaceSelector", "", "JSON-encoded metav1.LabelSelector to enable uploads. Overrides namespaceLabelSelector")
+	flag.StringVar(&nodeName, "nodeName", os.Getenv("NODE_NAME"), "Node name for {node} in keyTemplate if zip files do not record it (default: $NODE_NAME)")
+	flag.StringVar(&fsRoot, "fsRoot", "", "Directory path such as an NFS mount under which secrets with type=fs can write files. The fs type is disabled if empty")
+	flag.StringVar(&fsQuota, "fsQuota", "", "Maximum total size of files that each namespace can write under fsRoot, e.g., 10Gi. Unlimited if empty or 0")
+	flag.StringVar(&webIdentityTokenFile, "webIdentityTokenFile", os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), "Projected service account token for S3 secrets with webIdentity=true. webIdentity is disabled if empty (default: $AWS_WEB_IDENTITY_TOKEN_FILE)")
+	flag.StringVar(&allowedRoleArns, "allowedRoleArns", "", "Comma-separated patterns of roleArn that S3 secrets can assume with webIdentity or uploader credentials, e.g., arn:aws:iam::123456789012:role/core-dump-{namespace}. * matches characters except /. Any role is allowed if empty")
+	flag.BoolVar(&assumeRoleWithUploaderCredentials, "assumeRoleWithUploaderCredentials", false, "Allow S3 secrets with roleArn and without accessKey to assume roles with AWS credentials of the uploader (environment variables or instance profiles)")
+	flag.IntVar(&concurrency, "concurrency", 4, "Number of concurrent uploads")
+	flag.Int64Var(&partSize, "partSize", 64*1024*1024, "Part size in bytes of multipart uploads. Files larger than a part are uploaded with multipart uploads")
+	flag.IntVar(&partConcurrency, "partConcurrency", 4, "Number of concurrent part uploads per file")
+	flag.IntVar(&partMaxAttempts, "partMaxAttempts", 3, "Number of attempts to upload a part")
+	flag.IntVar(&httpMaxAttempts, "httpMaxAttempts", 3, "Number of attempts to send a file to destinations with type=http or presigned")
+	flag.DurationVar(&httpTimeout, "httpTimeout", 30*time.Minute, "Timeout of each request to destinations with type=azure, gcs, http, or presigned, including the upload of its body")
+	flag.StringVar(&uploadStateDir, "uploadStateDir", "", "Directory path to keep multipart upload IDs and encrypted files to resume after restarts (default: <parent of watchDir>/uploads)")
+	flag.StringVar(&retryDir, "retryDir", "", "Directory path to keep failed uploads (default: <parent of watchDir>/retry)")
+	flag.StringVar(&deadLetterDir, "deadLetterDir", "", "Directory path to keep uploads that exceeded maxAttempts (default: <parent of watchDir>/dead-letter)")
+	flag.IntVar(&maxAttempts, "maxAttempts", 10, "Number of upload attempts before a file is moved to deadLetterDir")
+	flag.DurationVar(&retryInterval, "retryInterval", 10*time.Second, "Interval to check retryDir")
+	flag.DurationVar(&sweepInterval, "sweepInterval", 5*time.Minute, "Interval to upload zip files in watchDir that were not notified")
+	flag.DurationVar(&retryInitialBackoff, "retryInitialBackoff", 30*time.Second, "Backoff after the first failed upload. Doubled for every failure")
+	flag.DurationVar(&retryMaxBackoff, "retryMaxBackoff", time.Hour, "Maximum backoff between upload attempts")
+}
+
+// RunDecrypt decrypts a core dump that was uploaded with encryptionPublicKey
+func RunDecrypt(args []string) error {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	identityPath := fs.String("identity", "", "File path of a private key generated by the keygen command")
+	inPath := fs.String("in", "", "Encrypted file path (default: stdin)")
+	outPath := fs.String("out", "", "Decrypted file path (default: stdout)")
+	fs.Parse(args)
+	if *identityPath == "" {
+		return fmt.Errorf("failed: RunDecrypt, --identity is required")
+	}
+	idf, err := os.Open(*identityPath)
+	if err != nil {
+		return fmt.Errorf("failed: RunDecrypt, Open, identity=%v, err=%v", *identityPath, err)
+	}
+	identity, err := ParseIdentity(idf)
+	idf.Close()
+	if err != nil {
+		return err
+	}
+	var in io.Reader = os.Stdin
+	if *inPath != "" {
+		f, err := os.Open(*inPath)
+		if err != nil {
+			return fmt.Errorf("failed: RunDecrypt, Open, in=%v, err=%v", *inPath, err)
+		}
+		defer f.Close()
+		in = f
+	}
+	if *outPath == "" {
+		return Decrypt(os.Stdout, bufio.NewReader(in), identity)
+	}
+	tmpPath := *outPath + ".tmp"
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed: RunDecrypt, OpenFile, out=%v, err=%v", tmpPath, err)
+	}
+	err = Decrypt(out, bufio.NewReader(in), identity)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, *outPath)
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "decrypt":
+			if err := RunDecrypt(os.Args[2:]); err != nil {
+				log.Fatalf("%v", err)
+			}
+			return
+		case "keygen":
+			if _, err := WriteIdentity(os.Stdout); err != nil {
+				log.Fatalf("%v", err)
+			}
+			return
+		}
+	}
 	log.Print(GetVersion())
 	flag.Parse()
-	k8s := NewK8sClient("", namespaceLabelSelector)
-	s3 := NewS3Client()
+	selector, err := GetNamespaceSelector(namespaceSelector, namespaceLabelSelector)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	k8s := NewK8sClient("", selector)
+	// warm caches before the first core dump. upload retries Start if this fails.
+	if err := k8s.Start(); err != nil {
+		log.Printf("WARN: %v", err)
+	}
 	zip := NewZippedCoreDump(defaultNamespace)
-	NewUploader(zip, k8s, s3).Run(watchDir)
+	hostDir := filepath.Dir(filepath.Clean(watchDir))
+	if retryDir == "" {
+		retryDir = filepath.Join(hostDir, "retry")
+	}
+	if deadLetterDir == "" {
+		deadLetterDir = filepath.Join(hostDir, "dead-letter")
+	}
+	if uploadStateDir == "" {
+		uploadStateDir = filepath.Join(hostDir, "uploads")
+	}
+	if partSize < MinPartSize {
+		log.Fatalf("partSize must be larger than or equal to %v", MinPartSize)
+	}
+	multipart := MultipartConfig{PartSize: partSize, Concurrency: partConcurrency, MaxAttempts: partMaxAttempts, StateDir: uploadStateDir}
+	destinations := NewDestinationRegistry()
+	credsConfig := S3CredentialsConfig{WebIdentityTokenFile: webIdentityTokenFile}
+	for _, pattern := range strings.Split(allowedRoleArns, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("allowedRoleArns has a malformed pattern, pattern=%v, err=%v", pattern, err)
+		}
+		credsConfig.AllowedRoleArns = append(credsConfig.AllowedRoleArns, pattern)
+	}
+	if len(credsConfig.AllowedRoleArns) == 0 && (webIdentityTokenFile != "" || assumeRoleWithUploaderCredentials) {
+		log.Printf("WARN: any namespace can assume any role that trusts the uploader. Set --allowedRoleArns or scope trust policies with sts:RoleSessionName")
+	}
+	if assumeRoleWithUploaderCredentials {
+		credsConfig.UploaderCredentials = defaults.CredChain(defaults.Config(), defaults.Handlers())
+	}
+	destinations.Register(DestinationTypeS3, NewS3DestinationFactory(func() S3Client { return NewS3Client(multipart) }, NewS3CredentialsCache(credsConfig), k8s.GetSecretData))
+	// http.DefaultClient waits forever for stalled servers
+	httpClient := &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone(), Timeout: httpTimeout}
+	destinations.Register(DestinationTypeAzure, NewAzureDestinationFactory(multipart, httpClient))
+	destinations.Register(DestinationTypeGcs, NewGcsDestinationFactory(multipart, httpClient))
+	destinations.Register(DestinationTypeHttp, NewHttpDestinationFactory(httpMaxAttempts, httpClient))
+	// the controller runs uploaders in defaultNamespace, where their service account can update ConfigMaps
+	destinations.Register(DestinationTypePresigned, NewPresignedDestinationFactory(NewConfigMapClaimStore(k8s, defaultNamespace), httpMaxAttempts, httpClient))
+	if fsRoot != "" {
+		quota := int64(0)
+		if fsQuota != "" {
+			q, err := resource.ParseQuantity(fsQuota)
+			if err != nil || q.Sign() < 0 {
+				log.Fatalf("fsQuota must be a non-negative quantity, fsQuota=%v, err=%v", fsQuota, err)
+			}
+			quota = q.Value()
+		}
+		destinations.Register(DestinationTypeFs, NewFsDestinationFactory(fsRoot, quota))
+	}
+	queue, err := NewRetryQueue(retryDir, deadLetterDir, maxAttempts, retryInitialBackoff, retryMaxBackoff)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	NewUploader(zip, k8s, destinations, queue, concurrency, uploadStateDir, nodeName).Run(watchDir)
 }
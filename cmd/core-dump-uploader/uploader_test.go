@@ -6,8 +6,13 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -29,30 +34,34 @@ func TestNewCoreDumpUploaderSecret(t *testing.T) {
 		t.Errorf("Failed: NewCoreDumpUploaderSecret, expected=%v, err=%v", expected, err)
 		return
 	}
-	assert.Equal(t, string(expected["accessKey"]), c.AccessKey)
-	assert.Equal(t, string(expected["secretKey"]), c.SecretKey)
-	assert.Equal(t, string(expected["bucket"]), c.Bucket)
-	assert.Equal(t, string(expected["endpoint"]), c.Endpoint)
+	assert.Equal(t, DestinationTypeS3, c.Type)
 	assert.Equal(t, string(expected["keyPrefix"]), c.KeyPrefix)
+	expected["type"] = []byte("fs")
+	c, err = NewCoreDumpUploaderSecret(expected)
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "fs", c.Type)
+	}
+	delete(expected, "type")
 
-	malformed := map[string][]byte{
-		"bucket":       []byte("bucket"),
-		"keyPrefix":    []byte("a/b/c"),
-		"accessKey":    []byte("ABCDEF"),
-		"secretKey":    []byte("12345"),
-		"endPoint":     []byte("https://endpoint.io"),
-		"createBucket": []byte("createBucket"),
+	_, publicKey := NewTestIdentity(t)
+	expected["encryptionPublicKey"] = []byte(publicKey)
+	c, err = NewCoreDumpUploaderSecret(expected)
+	if assert.Equal(t, nil, err) && assert.NotEqual(t, nil, c.EncryptionPublicKey) {
+		assert.Equal(t, publicKey, base64.StdEncoding.EncodeToString(c.EncryptionPublicKey.Bytes()))
 	}
-	_, err = NewCoreDumpUploaderSecret(malformed)
+	expected["encryptionPublicKey"] = []byte("invalid")
+	_, err = NewCoreDumpUploaderSecret(expected)
 	assert.NotEqual(t, nil, err)
-	malformed = map[string][]byte{
-		"bucket":       []byte("bucket"),
-		"keyPrefix":    []byte("a/b/c"),
-		"secretKey":    []byte("12345"),
-		"endPoint":     []byte("https://endpoint.io"),
-		"createBucket": []byte("true"),
+	delete(expected, "encryptionPublicKey")
+
+	assert.Equal(t, DefaultKeyTemplate, c.KeyTemplate.String())
+	expected["keyTemplate"] = []byte("{date}/{namespace}/{file}")
+	c, err = NewCoreDumpUploaderSecret(expected)
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, "{date}/{namespace}/{file}", c.KeyTemplate.String())
 	}
-	_, err = NewCoreDumpUploaderSecret(malformed)
+	expected["keyTemplate"] = []byte("../{file}")
+	_, err = NewCoreDumpUploaderSecret(expected)
 	assert.NotEqual(t, nil, err)
 }
 
@@ -68,35 +77,103 @@ func TestProcessSingleFile(t *testing.T) {
 	if err != nil {
 		return
 	}
-	zip := NewZippedCoreDumpNoDelete("default")
+	zip := NewZippedCoreDump("default")
+	queue := NewMockRetryQueue()
 	s3 := NewMockS3Client(nil, nil, nil, nil)
 	k8s := NewMockK8sClient(unix.EINVAL, nil, nil, false, false)
-	assert.Equal(t, unix.EINVAL, NewUploader(zip, k8s, s3).ProcessSingleFile(filePath))
+	assert.Equal(t, unix.EINVAL, NewUploader(zip, k8s, NewMockDestinations(s3), queue, 1, "", "node").ProcessSingleFile(filePath))
 	k8s = NewMockK8sClient(nil, nil, unix.ENOENT, false, false)
-	assert.Equal(t, unix.ENOENT, NewUploader(zip, k8s, s3).ProcessSingleFile(filePath))
+	assert.Equal(t, unix.ENOENT, NewUploader(zip, k8s, NewMockDestinations(s3), queue, 1, "", "node").ProcessSingleFile(filePath))
+	// malformed secrets are retried since tenants can fix them
 	k8s = NewMockK8sClient(nil, nil, nil, true, false)
-	assert.NotEqual(t, nil, NewUploader(zip, k8s, s3).ProcessSingleFile(filePath))
+	assert.Equal(t, false, IsPermanentError(NewUploader(zip, k8s, NewMockDestinations(s3), queue, 1, "", "node").ProcessSingleFile(filePath)))
+	k8s = NewMockK8sClient(nil, NewPermanentError(unix.EPERM), nil, false, false)
+	assert.Equal(t, true, IsPermanentError(NewUploader(zip, k8s, NewMockDestinations(s3), queue, 1, "", "node").ProcessSingleFile(filePath)))
+	assert.Equal(t, 1, queue.discarded[filePath])
 	k8s = NewMockK8sClient(nil, nil, nil, false, false)
 
 	s3 = NewMockS3Client(unix.EINVAL, nil, nil, nil)
-	assert.NotEqual(t, nil, NewUploader(zip, k8s, s3).ProcessSingleFile(filePath))
+	assert.NotEqual(t, nil, NewUploader(zip, k8s, NewMockDestinations(s3), queue, 1, "", "node").ProcessSingleFile(filePath))
 	s3 = NewMockS3Client(nil, nil, unix.EIO, nil)
-	assert.NotEqual(t, nil, NewUploader(zip, k8s, s3).ProcessSingleFile(filePath))
+	assert.NotEqual(t, nil, NewUploader(zip, k8s, NewMockDestinations(s3), queue, 1, "", "node").ProcessSingleFile(filePath))
 	s3 = NewMockS3Client(nil, nil, nil, unix.EACCES)
-	assert.NotEqual(t, nil, NewUploader(zip, k8s, s3).ProcessSingleFile(filePath))
+	assert.NotEqual(t, nil, NewUploader(zip, k8s, NewMockDestinations(s3), queue, 1, "", "node").ProcessSingleFile(filePath))
 
 	k8s = NewMockK8sClient(nil, nil, nil, false, true)
 	s3 = NewMockS3Client(nil, os.ErrNotExist, os.ErrNotExist, nil)
-	assert.NotEqual(t, nil, NewUploader(zip, k8s, s3).ProcessSingleFile(filePath))
+	assert.NotEqual(t, nil, NewUploader(zip, k8s, NewMockDestinations(s3), queue, 1, "", "node").ProcessSingleFile(filePath))
 
 	s3 = NewMockS3Client(nil, nil, nil, nil)
-	u := NewUploader(zip, k8s, s3)
+	u := NewUploader(zip, k8s, NewMockDestinations(s3), queue, 1, "", "node")
 	assert.Equal(t, nil, u.ProcessSingleFile(filePath))
+	assert.Equal(t, 7, queue.failed[filePath])
+	assert.Equal(t, 1, queue.succeeded[filePath])
 	assert.Equal(t, nil, u.ProcessSingleFile(filePath2))
 	assert.Equal(t, nil, u.ProcessSingleFile(filepath.Join(tmpDir, "b.zip")))
 
 	k8s = NewMockK8sClient(nil, unix.EIO, nil, false, false)
-	assert.Equal(t, unix.EIO, NewUploader(zip, k8s, s3).ProcessSingleFile(filePath))
+	assert.Equal(t, unix.EIO, NewUploader(zip, k8s, NewMockDestinations(s3), queue, 1, "", "node").ProcessSingleFile(filePath))
+}
+
+func TestProcessSingleFileWithEncryption(t *testing.T) {
+	server := NewFakeS3Server()
+	defer server.Close()
+	server.buckets["bucket"] = map[string][]byte{}
+	tmpDir := t.TempDir()
+	workDir := filepath.Join(tmpDir, "uploads")
+	queue, err := NewRetryQueue(filepath.Join(tmpDir, "retry"), filepath.Join(tmpDir, "dead-letter"), 3, 0, 0)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	identity, publicKey := NewTestIdentity(t)
+	k8s := NewMockK8sClient(nil, nil, nil, false, false)
+	k8s.secret = map[string][]byte{
+		"bucket": []byte("bucket"), "keyPrefix": []byte("cores"), "createBucket": []byte("false"),
+		"accessKey": []byte("access"), "secretKey": []byte("secret"), "endpoint": []byte(server.server.URL),
+		"forcePathStyle": []byte("true"), "encryptionPublicKey": []byte(publicKey),
+	}
+	multipart := MultipartConfig{PartSize: MinPartSize, Concurrency: 1, MaxAttempts: 1, StateDir: workDir}
+	r := NewDestinationRegistry()
+	r.Register(DestinationTypeS3, NewS3DestinationFactory(func() S3Client { return NewS3Client(multipart) }, NewS3CredentialsCache(S3CredentialsConfig{}), k8s.GetSecretData))
+	u := NewUploader(NewZippedCoreDump("default"), k8s, r, queue, 1, workDir, "node")
+
+	// a zip file with a stored core larger than a part
+	filePath := filepath.Join(tmpDir, "a.zip")
+	f, err := os.Create(filePath)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	zw := zip.NewWriter(f)
+	buf, _ := GetRuntimeJsonBuf(t, "default", -1)
+	w, _ := zw.Create("abcdefg-runtime-info.json")
+	w.Write(buf)
+	w, _ = zw.CreateHeader(&zip.FileHeader{Name: "core", Method: zip.Store})
+	w.Write(make([]byte, MinPartSize+1024))
+	assert.Equal(t, nil, zw.Close())
+	assert.Equal(t, nil, f.Close())
+	plain, _ := os.ReadFile(filePath)
+
+	// the second part fails with a retryable error and the retry resumes the upload
+	server.failParts[2] = true
+	server.failStatus = http.StatusServiceUnavailable
+	assert.NotEqual(t, nil, u.ProcessSingleFile(filePath))
+	_, err = os.Stat(filepath.Join(workDir, "a.zip.enc"))
+	assert.Equal(t, nil, err)
+	delete(server.failParts, 2)
+	assert.Equal(t, nil, u.ProcessSingleFile(filepath.Join(tmpDir, "retry", "a.zip")))
+	assert.Equal(t, 1, server.partCalls[1])
+	_, err = os.Stat(filepath.Join(workDir, "a.zip.enc"))
+	assert.Equal(t, true, os.IsNotExist(err))
+
+	if !assert.Equal(t, 1, len(server.objects)) {
+		return
+	}
+	key, _ := ParseIdentity(strings.NewReader(identity))
+	for _, obj := range server.objects {
+		var dec bytes.Buffer
+		assert.Equal(t, nil, Decrypt(&dec, bytes.NewReader(obj), key))
+		assert.Equal(t, true, bytes.Equal(plain, dec.Bytes()))
+	}
 }
 
 func TestRun(t *testing.T) {
@@ -113,7 +190,13 @@ func TestRun(t *testing.T) {
 		zip := NewZippedCoreDump("default")
 		k8s := NewMockK8sClient(nil, nil, nil, false, false)
 		s3 := NewMockS3Client(nil, nil, nil, nil)
-		NewUploader(zip, k8s, s3).Run(tmpDir)
+		queueDir := t.TempDir()
+		queue, err := NewRetryQueue(filepath.Join(queueDir, "retry"), filepath.Join(queueDir, "dead-letter"), 3, time.Second, time.Second)
+		if err != nil {
+			t.Errorf("Failed: TestRun, NewRetryQueue, queueDir=%v, err=%v", queueDir, err)
+			return
+		}
+		NewUploader(zip, k8s, NewMockDestinations(s3), queue, 1, "", "node").Run(tmpDir)
 	}()
 	time.Sleep(time.Second)
 	var ok = false
@@ -132,6 +215,57 @@ func TestRun(t *testing.T) {
 	assert.Equal(t, true, ok)
 }
 
+func TestProcessDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	filePaths := []string{filepath.Join(tmpDir, "a.zip"), filepath.Join(tmpDir, "b.zip")}
+	for _, filePath := range filePaths {
+		if err := CreateZipFile(t, filePath, "default", -1); err != nil {
+			return
+		}
+	}
+	if err := CreateRandomFile(t, filepath.Join(tmpDir, "c.txt"), 4); err != nil {
+		return
+	}
+	if err := os.Mkdir(filepath.Join(tmpDir, "d.zip"), 0755); err != nil {
+		t.Errorf("Failed: TestProcessDir, Mkdir, err=%v", err)
+		return
+	}
+	zip := NewZippedCoreDump("default")
+	k8s := NewMockK8sClient(nil, nil, nil, false, false)
+	s3 := NewMockS3Client(nil, nil, nil, nil)
+	queue := NewMockRetryQueue()
+	u := NewUploader(zip, k8s, NewMockDestinations(s3), queue, 2, "", "node")
+	u.ProcessDir(tmpDir)
+	u.pool.Wait()
+	assert.Equal(t, map[string]int{filePaths[0]: 1, filePaths[1]: 1}, queue.succeeded)
+	assert.Equal(t, 0, len(queue.failed))
+
+	u.ProcessDir(filepath.Join(tmpDir, "notfound"))
+	u.pool.Wait()
+	assert.Equal(t, 2, len(queue.succeeded))
+}
+
+func TestRunWithExistingFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	filePath := filepath.Join(tmpDir, "a.zip")
+	if err := CreateZipFile(t, filePath, "default", -1); err != nil {
+		return
+	}
+	queueDir := t.TempDir()
+	queue, err := NewRetryQueue(filepath.Join(queueDir, "retry"), filepath.Join(queueDir, "dead-letter"), 3, time.Second, time.Second)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	zip := NewZippedCoreDump("default")
+	k8s := NewMockK8sClient(nil, nil, nil, false, false)
+	s3 := NewMockS3Client(nil, nil, nil, nil)
+	go NewUploader(zip, k8s, NewMockDestinations(s3), queue, 1, "", "node").Run(tmpDir)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filePath)
+		return os.IsNotExist(err)
+	}, 3*time.Second, 100*time.Millisecond)
+}
+
 func TestGetVersion(t *testing.T) {
 	verStr := GetVersion()
 	assert.NotEqual(t, "", verStr)
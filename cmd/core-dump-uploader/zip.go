@@ -7,31 +7,42 @@ package main
 
 import (
 	"archive/zip"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
 type ZippedCoreDump interface {
 	IsValidFile(filePath string) bool
-	Begin(filePath string) error
-	End()
+	Begin(filePath string) (ZippedCoreDumpHandle, error)
 	ParseRuntimeJsonBuf(buf []byte) (namespace string, err error)
 	ExtractRuntimeJson(filePath string) ([]byte, error)
+	GetNamespace(filePath string) (namespace string)
+	GetRuntimeInfo(filePath string) *RuntimeInfo
+}
+
+// ZippedCoreDumpHandle is a zip file locked by Begin. Each handle is used by a single goroutine.
+type ZippedCoreDumpHandle interface {
 	GetNamespace() (namespace string)
+	GetRuntimeInfo() *RuntimeInfo
 	GetFile() *os.File
+	End()
 }
 
 type ZippedCoreDumpImpl struct {
 	defaultNamespace string
-	f                *os.File
-	flocked          bool
+}
+
+type ZippedCoreDumpHandleImpl struct {
+	z       ZippedCoreDump
+	f       *os.File
+	flocked bool
 }
 
 func NewZippedCoreDump(defaultNamespace string) ZippedCoreDump {
@@ -48,111 +59,154 @@ func (z *ZippedCoreDumpImpl) IsValidFile(filePath string) bool {
 	return true
 }
 
-func (z *ZippedCoreDumpImpl) Begin(filePath string) error {
+func (z *ZippedCoreDumpImpl) Begin(filePath string) (ZippedCoreDumpHandle, error) {
 	f, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("failed: Open, filePath=%v, err=%v", filePath, err)
+		return nil, fmt.Errorf("failed: Open, filePath=%v, err=%v", filePath, err)
 	}
-	z.f = f
 
 	// wait until core-dump-composer fills the file
 	if err = unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
-		return fmt.Errorf("failed: Flock, filePath=%v, err=%v", filePath, err)
+		f.Close()
+		return nil, fmt.Errorf("failed: Flock, filePath=%v, err=%v", filePath, err)
 	}
-	z.flocked = true
-	return nil
+	return &ZippedCoreDumpHandleImpl{z: z, f: f, flocked: true}, nil
 }
 
-func (z *ZippedCoreDumpImpl) End() {
-	if z.flocked && z.f != nil {
-		if err := unix.Flock(int(z.f.Fd()), unix.LOCK_UN); err != nil {
-			log.Printf("WARN: Flock (LOCK_UN), filePath=%v, err=%v", z.f.Name(), err)
+func (h *ZippedCoreDumpHandleImpl) End() {
+	if h.flocked && h.f != nil {
+		if err := unix.Flock(int(h.f.Fd()), unix.LOCK_UN); err != nil {
+			log.Printf("WARN: Flock (LOCK_UN), filePath=%v, err=%v", h.f.Name(), err)
 		}
-		z.flocked = false
+		h.flocked = false
 	}
-	if z.f != nil {
-		if err := os.Remove(z.f.Name()); err != nil {
-			if !os.IsNotExist(err) {
-				log.Printf("Failed: coult not remove file %v, err=%v", z.f.Name(), err)
-			}
-		}
-		if err := z.f.Close(); err != nil {
-			log.Printf("WARN: Close, filePath=%v, err=%v", z.f.Name(), err)
+	if h.f != nil {
+		if err := h.f.Close(); err != nil {
+			log.Printf("WARN: Close, filePath=%v, err=%v", h.f.Name(), err)
 		}
-		z.f = nil
+		h.f = nil
 	}
 }
 
-func (z *ZippedCoreDumpImpl) ParseRuntimeJsonBuf(buf []byte) (namespace string, err error) {
-	var v map[string]interface{}
-	if err = json.Unmarshal(buf, &v); err != nil {
-		return "", fmt.Errorf("failed: json.Unmarshal, err=%v", err)
-	}
-	var ok = false
-	status, ok1 := v["status"]
-	if ok1 {
-		if v2, ok2 := status.(map[string]interface{}); ok2 {
-			if metadata, ok3 := v2["metadata"]; ok3 {
-				if v4, ok4 := metadata.(map[string]interface{}); ok4 {
-					if v5, ok5 := v4["namespace"]; ok5 {
-						namespace, ok = v5.(string)
-					}
-				}
-			}
-		}
+func (h *ZippedCoreDumpHandleImpl) GetNamespace() (namespace string) {
+	if h.f == nil {
+		return h.z.GetNamespace("")
 	}
-	if !ok {
-		return "", fmt.Errorf("failed: ParseRuntimeJsonBuf, no entry for status.metadata.namespace")
+	return h.z.GetNamespace(h.f.Name())
+}
+
+func (h *ZippedCoreDumpHandleImpl) GetRuntimeInfo() *RuntimeInfo {
+	if h.f == nil {
+		return h.z.GetRuntimeInfo("")
 	}
-	return
+	return h.z.GetRuntimeInfo(h.f.Name())
 }
 
-func (z *ZippedCoreDumpImpl) ExtractRuntimeJson(filePath string) ([]byte, error) {
+func (h *ZippedCoreDumpHandleImpl) GetFile() *os.File {
+	return h.f
+}
+
+func (z *ZippedCoreDumpImpl) ParseRuntimeJsonBuf(buf []byte) (namespace string, err error) {
+	info, err := ParseRuntimeInfo(buf)
+	if err != nil {
+		return "", err
+	}
+	return info.Namespace, nil
+}
+
+// ExtractJson returns the first file in a zip file whose name ends with suffix
+func (z *ZippedCoreDumpImpl) ExtractJson(filePath string, suffix string) ([]byte, error) {
 	f, err := zip.OpenReader(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed: ExtractRuntimeJson, OpenReader, filePath=%v, err=%v", filePath, err)
+		return nil, fmt.Errorf("failed: ExtractJson, OpenReader, filePath=%v, err=%v", filePath, err)
 	}
+	defer f.Close()
 	var buf []byte = nil
 	for _, file := range f.File {
-		if !strings.HasSuffix(filepath.Base(file.Name), "-runtime-info.json") {
+		if !strings.HasSuffix(filepath.Base(file.Name), suffix) {
 			continue
 		}
 		var f2 io.ReadCloser = nil
 		f2, err = file.Open()
 		if err != nil {
-			return nil, fmt.Errorf("failed: ExtractRuntimeJson, Open, filePath=%v, file.Name=%v, err=%v", filePath, file.Name, err)
+			return nil, fmt.Errorf("failed: ExtractJson, Open, filePath=%v, file.Name=%v, err=%v", filePath, file.Name, err)
 		}
 		buf, err = io.ReadAll(f2)
 		f2.Close()
 		if err != nil {
-			return nil, fmt.Errorf("failed: ExtractRuntimeJson, ReadAll, filePath=%v, file.Name=%v, err=%v", filePath, file.Name, err)
+			return nil, fmt.Errorf("failed: ExtractJson, ReadAll, filePath=%v, file.Name=%v, err=%v", filePath, file.Name, err)
 		}
 		break
 	}
 	if buf == nil {
-		return nil, fmt.Errorf("failed: ExtractRuntimeJson, file does not containe -runtime-info.json, filePath=%v", filePath)
+		return nil, fmt.Errorf("failed: ExtractJson, file does not contain %v, filePath=%v", suffix, filePath)
 	}
 	return buf, nil
 }
 
-func (z *ZippedCoreDumpImpl) GetNamespace() (namespace string) {
-	if z.f == nil {
-		log.Printf("WARN: GetNamespace, closed, use default namespace (%v)", z.defaultNamespace)
-		return z.defaultNamespace
+func (z *ZippedCoreDumpImpl) ExtractRuntimeJson(filePath string) ([]byte, error) {
+	return z.ExtractJson(filePath, "-runtime-info.json")
+}
+
+// GetRuntimeInfo returns the runtime info of filePath. It uses the default namespace if filePath does not have a valid runtime info.
+func (z *ZippedCoreDumpImpl) GetRuntimeInfo(filePath string) *RuntimeInfo {
+	if filePath == "" {
+		log.Printf("WARN: GetRuntimeInfo, closed, use default namespace (%v)", z.defaultNamespace)
+		return &RuntimeInfo{Namespace: z.defaultNamespace}
 	}
-	buf, err := z.ExtractRuntimeJson(z.f.Name())
+	buf, err := z.ExtractRuntimeJson(filePath)
 	if err != nil {
-		log.Printf("WARN: GetNamespace, ExtractRuntimeJson, use default namespace (%v), z.f.Name()=%v, err=%v", z.defaultNamespace, z.f.Name(), err)
-		return z.defaultNamespace
+		log.Printf("WARN: GetRuntimeInfo, ExtractRuntimeJson, use default namespace (%v), filePath=%v, err=%v", z.defaultNamespace, filePath, err)
+		return &RuntimeInfo{Namespace: z.defaultNamespace}
 	}
-	namespace, err = z.ParseRuntimeJsonBuf(buf)
+	info, err := ParseRuntimeInfo(buf)
 	if err != nil {
-		log.Printf("WARN: GetNamespace, ParseRuntimeJsonBuf, use default namespace (%v), err=%v", z.defaultNamespace, err)
-		return z.defaultNamespace
+		log.Printf("WARN: GetRuntimeInfo, ParseRuntimeInfo, use default namespace (%v), err=%v", z.defaultNamespace, err)
+		return &RuntimeInfo{Namespace: z.defaultNamespace}
+	}
+	// -dump-info.json identifies the crashing container in -ps-info.json
+	if buf, err := z.ExtractJson(filePath, "-dump-info.json"); err == nil {
+		if err := info.ParseDumpInfo(buf); err != nil {
+			log.Printf("WARN: GetRuntimeInfo, %v, filePath=%v", err, filePath)
+		}
+	}
+	if buf, err := z.ExtractJson(filePath, "-ps-info.json"); err == nil {
+		if err := info.ParsePsInfo(buf); err != nil {
+			log.Printf("WARN: GetRuntimeInfo, %v, filePath=%v", err, filePath)
+		}
+	}
+	if buf, err := z.ExtractJson(filePath, "-image-info.json"); err == nil {
+		if err := info.ParseImageInfo(buf); err != nil {
+			log.Printf("WARN: GetRuntimeInfo, %v, filePath=%v", err, filePath)
+		}
+	}
+	if info.Timestamp.IsZero() {
+		info.Timestamp = z.GetZipTimestamp(filePath)
+	}
+	return info
+}
+
+// GetZipTimestamp returns the modification time that core-dump-composer recorded for the first file in filePath.
+// Unlike the mtime of filePath, it does not change if the retry queue copies the file. It returns zero time if unknown.
+func (z *ZippedCoreDumpImpl) GetZipTimestamp(filePath string) time.Time {
+	f, err := zip.OpenReader(filePath)
+	if err != nil || len(f.File) == 0 {
+		if err == nil {
+			f.Close()
+		}
+		return time.Time{}
+	}
+	defer f.Close()
+	modified := f.File[0].Modified
+	// writers without timestamps leave the MS-DOS epoch
+	if modified.Year() <= 1980 {
+		return time.Time{}
 	}
-	return namespace
+	return modified.UTC()
 }
 
-func (z *ZippedCoreDumpImpl) GetFile() *os.File {
-	return z.f
+// GetNamespace returns the namespace in the runtime info of filePath or the default namespace.
+// filePath may be incomplete if the caller does not lock it with Begin.
+func (z *ZippedCoreDumpImpl) GetNamespace(filePath string) (namespace string) {
+	return z.GetRuntimeInfo(filePath).Namespace
 }
@@ -15,9 +15,9 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
-	"golang.org/x/sys/unix"
 )
 
 func randString(size int) []byte {
@@ -195,17 +195,21 @@ func TestIsValidSuffix(t *testing.T) {
 }
 
 func TestBegin(t *testing.T) {
-	testFileName := "a.zip"
+	testFileName := filepath.Join(t.TempDir(), "a.zip")
 	err := CreateRandomFile(t, testFileName, 4)
 	if err != nil {
 		return
 	}
 	z := NewZippedCoreDump("default")
-	assert.Equal(t, nil, z.Begin(testFileName))
-	z.End()
+	h, err := z.Begin(testFileName)
+	if !assert.Equal(t, nil, err) {
+		return
+	}
+	h.End()
 	_, err = os.Stat(testFileName)
-	assert.Equal(t, true, os.IsNotExist(err), "File must be deleted after completion, testFileName=%v", testFileName)
-	assert.NotEqual(t, nil, z.Begin("b.zip"))
+	assert.Equal(t, nil, err, "File must be kept until the uploader completes, testFileName=%v", testFileName)
+	_, err = z.Begin("b.zip")
+	assert.NotEqual(t, nil, err)
 }
 
 func TestParseRuntimeJsonBuf(t *testing.T) {
@@ -287,58 +291,55 @@ func TestGetNamespace(t *testing.T) {
 		malforms = append(malforms, malformedFilePath)
 	}
 	z := NewZippedCoreDump(defaultNamespace)
-	assert.Equal(t, defaultNamespace, z.GetNamespace())
-	err = z.Begin(testFilePath)
+	assert.Equal(t, defaultNamespace, z.GetNamespace(""))
+	assert.Equal(t, testNamespace, z.GetNamespace(testFilePath))
+	h, err := z.Begin(testFilePath)
 	if err != nil {
 		t.Errorf("Failed: TestGetNamespace, Begin, testFilePath=%v, err=%v", testFilePath, err)
 		return
 	}
-	assert.Equal(t, testNamespace, z.GetNamespace())
-	z.End()
+	assert.Equal(t, testNamespace, h.GetNamespace())
+	h.End()
+	assert.Equal(t, defaultNamespace, h.GetNamespace())
 	for _, malformedFilePath := range malforms {
-		err = z.Begin(malformedFilePath)
+		h, err = z.Begin(malformedFilePath)
 		if err != nil {
 			t.Errorf("Failed: TestGetNamespace, Begin, malformedFilePath=%v, err=%v", malformedFilePath, err)
 			return
 		}
-		assert.NotEqual(t, testNamespace, z.GetNamespace())
-		z.End()
+		assert.NotEqual(t, testNamespace, h.GetNamespace())
+		h.End()
 	}
 }
 
-type ZippedCoreDumpNoDelete struct {
-	z ZippedCoreDump
-}
+func TestGetZipTimestamp(t *testing.T) {
+	tmpDir := t.TempDir()
+	z := NewZippedCoreDump("default").(*ZippedCoreDumpImpl)
+	filePath := filepath.Join(tmpDir, "a.zip")
+	if err := CreateZipFile(t, filePath, "default", -1); err != nil {
+		return
+	}
+	// zip files without timestamps fall back to mtime
+	assert.Equal(t, time.Time{}, z.GetZipTimestamp(filePath))
+	assert.Equal(t, time.Time{}, z.GetRuntimeInfo(filePath).Timestamp)
 
-func NewZippedCoreDumpNoDelete(defaultNamespace string) *ZippedCoreDumpNoDelete {
-	return &ZippedCoreDumpNoDelete{z: NewZippedCoreDump(defaultNamespace)}
-}
-func (z *ZippedCoreDumpNoDelete) IsValidFile(filePath string) bool {
-	return z.z.IsValidFile(filePath)
-}
-func (z *ZippedCoreDumpNoDelete) Begin(filePath string) error {
-	return z.z.Begin(filePath)
-}
-func (z *ZippedCoreDumpNoDelete) End() {
-	f := z.GetFile()
-	if f != nil {
-		if err := unix.Flock(int(f.Fd()), unix.LOCK_UN); err != nil {
-			log.Printf("WARN: Flock (LOCK_UN), filePath=%v, err=%v", f.Name(), err)
-		}
-		if err := f.Close(); err != nil {
-			log.Printf("WARN: Close, filePath=%v, err=%v", f.Name(), err)
-		}
+	filePath2 := filepath.Join(tmpDir, "b.zip")
+	f, err := os.Create(filePath2)
+	if !assert.Equal(t, nil, err) {
+		return
 	}
-}
-func (z *ZippedCoreDumpNoDelete) ParseRuntimeJsonBuf(buf []byte) (namespace string, err error) {
-	return z.z.ParseRuntimeJsonBuf(buf)
-}
-func (z *ZippedCoreDumpNoDelete) ExtractRuntimeJson(filePath string) ([]byte, error) {
-	return z.z.ExtractRuntimeJson(filePath)
-}
-func (z *ZippedCoreDumpNoDelete) GetNamespace() (namespace string) {
-	return z.z.GetNamespace()
-}
-func (z *ZippedCoreDumpNoDelete) GetFile() *os.File {
-	return z.z.GetFile()
+	zw := zip.NewWriter(f)
+	modified := time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "abcdefg-runtime-info.json", Method: zip.Deflate, Modified: modified})
+	if assert.Equal(t, nil, err) {
+		buf, _ := GetRuntimeJsonBuf(t, "default", -1)
+		w.Write(buf)
+	}
+	zw.Close()
+	f.Close()
+	// copies of zip files keep the timestamp
+	os.Chtimes(filePath2, time.Now(), time.Now())
+	assert.Equal(t, modified, z.GetZipTimestamp(filePath2))
+	assert.Equal(t, modified, z.GetRuntimeInfo(filePath2).Timestamp)
+	assert.Equal(t, time.Time{}, z.GetZipTimestamp(filepath.Join(tmpDir, "notfound.zip")))
 }
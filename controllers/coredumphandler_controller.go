@@ -7,8 +7,10 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,18 +22,27 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	appsv1apply "k8s.io/client-go/applyconfigurations/apps/v1"
 	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
 	metav1apply "k8s.io/client-go/applyconfigurations/meta/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	chartsv1alpha1 "github.com/IBM/core-dump-operator/api/v1alpha1"
 )
@@ -39,10 +50,21 @@ import (
 const coredumpHandlerFinalizer = "charts.ibm.com/finalizer"
 const fieldManager = "core-dump-operator"
 
+// SecurityContextConstraints are cluster-scoped and cannot have an ownerReference to a namespaced CoreDumpHandler.
+// We track the owner with the labels and annotations below and clean them up only at the finalizer.
+const managedByLabel = "app.kubernetes.io/managed-by"
+const ownerNamespaceAnnotation = "charts.ibm.com/owner-namespace"
+const ownerNameAnnotation = "charts.ibm.com/owner-name"
+
+// maxDiffLines and maxEventMessageLength bound the size of drift summaries recorded as events
+const maxDiffLines = 5
+const maxEventMessageLength = 1024
+
 // CoreDumpHandlerReconciler reconciles a CoreDumpHandler object
 type CoreDumpHandlerReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
 }
 
 //+kubebuilder:rbac:groups=charts.ibm.com,resources=coredumphandlers,verbs=get;list;watch;create;update;patch;delete
@@ -51,6 +73,7 @@ type CoreDumpHandlerReconciler struct {
 
 //+kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=security.openshift.io,resources=securitycontextconstraints,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -80,6 +103,7 @@ func (r *CoreDumpHandlerReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		controllerutil.AddFinalizer(cdu, coredumpHandlerFinalizer)
 		err = r.Update(ctx, cdu)
 		if err != nil {
+			r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "FinalizerUpdateFailed", "Failed to add finalizer: %v", err)
 			return ctrl.Result{RequeueAfter: 100 * time.Millisecond}, err
 		}
 	}
@@ -95,25 +119,135 @@ func (r *CoreDumpHandlerReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 			err = r.Update(ctx, cdu)
 			if err != nil {
 				l.Error(err, "Reconcile, Update")
+				r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "FinalizerUpdateFailed", "Failed to remove finalizer: %v", err)
 			}
 		}
 	} else {
 		if requeue, err = r.UpdateScc(ctx, cdu, l); requeue || err != nil {
+			_ = r.UpdateStatus(ctx, cdu, chartsv1alpha1.ConditionSccReady, err, l)
 			return ctrl.Result{Requeue: requeue, RequeueAfter: 100 * time.Millisecond}, err
 		}
 		if requeue, err = r.UpdateCluster(ctx, cdu, l); requeue || err != nil {
+			_ = r.UpdateStatus(ctx, cdu, chartsv1alpha1.ConditionDaemonSetAvailable, err, l)
 			return ctrl.Result{Requeue: requeue, RequeueAfter: 100 * time.Millisecond}, err
 		}
+		if err = r.UpdateStatus(ctx, cdu, "", nil, l); err != nil {
+			return ctrl.Result{RequeueAfter: 100 * time.Millisecond}, err
+		}
 	}
 	return ctrl.Result{Requeue: requeue}, err
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *CoreDumpHandlerReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&chartsv1alpha1.CoreDumpHandler{}).
-		Owns(&appsv1.DaemonSet{}).
-		Complete(r)
+		Owns(&appsv1.DaemonSet{}, builder.WithPredicates(daemonSetChangedPredicate))
+	// watching SecurityContextConstraints fails to start the controller if the cluster is not OpenShift
+	sccGvk := securityv1.GroupVersion.WithKind("SecurityContextConstraints")
+	if _, err := mgr.GetRESTMapper().RESTMapping(sccGvk.GroupKind(), sccGvk.Version); err == nil {
+		b = b.Watches(&securityv1.SecurityContextConstraints{}, handler.EnqueueRequestsFromMapFunc(MapSccToCoreDumpHandler),
+			builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+				return obj.GetLabels()[managedByLabel] == fieldManager
+			})))
+	} else if !meta.IsNoMatchError(err) {
+		return err
+	}
+	return b.Complete(r)
+}
+
+// MapSccToCoreDumpHandler enqueues the CoreDumpHandler that owns a SecurityContextConstraints
+func MapSccToCoreDumpHandler(ctx context.Context, obj client.Object) []reconcile.Request {
+	annotations := obj.GetAnnotations()
+	namespace, ok := annotations[ownerNamespaceAnnotation]
+	if !ok {
+		return nil
+	}
+	name, ok := annotations[ownerNameAnnotation]
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: namespace, Name: name}}}
+}
+
+// GetSccName returns the name of SecurityContextConstraints for a CoreDumpHandler.
+// Namespace names cannot contain dots, so the name is unique across namespaces.
+func GetSccName(namespace string, name string) string {
+	return fmt.Sprintf("%s.%s", namespace, name)
+}
+
+// IsOwnedScc returns true if the SecurityContextConstraints is managed for the CoreDumpHandler
+func IsOwnedScc(scc *securityv1.SecurityContextConstraints, cdu *chartsv1alpha1.CoreDumpHandler) bool {
+	annotations := scc.GetAnnotations()
+	return scc.GetLabels()[managedByLabel] == fieldManager &&
+		annotations[ownerNamespaceAnnotation] == cdu.Namespace && annotations[ownerNameAnnotation] == cdu.Name
+}
+
+// daemonSetChangedPredicate triggers reconciles at spec and rollout status changes of owned daemonsets
+var daemonSetChangedPredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldDs, ok := e.ObjectOld.(*appsv1.DaemonSet)
+		if !ok {
+			return true
+		}
+		newDs, ok := e.ObjectNew.(*appsv1.DaemonSet)
+		if !ok {
+			return true
+		}
+		return oldDs.GetGeneration() != newDs.GetGeneration() || !equality.Semantic.DeepEqual(oldDs.Status, newDs.Status)
+	},
+}
+
+// GetEnvVarApplyConfiguration converts an EnvVar to its apply configuration
+func GetEnvVarApplyConfiguration(env corev1.EnvVar) *corev1apply.EnvVarApplyConfiguration {
+	ret := corev1apply.EnvVar().WithName(env.Name)
+	if env.ValueFrom == nil {
+		return ret.WithValue(env.Value)
+	}
+	valueFrom := corev1apply.EnvVarSource()
+	if ref := env.ValueFrom.FieldRef; ref != nil {
+		valueFrom.WithFieldRef(corev1apply.ObjectFieldSelector().WithAPIVersion(ref.APIVersion).WithFieldPath(ref.FieldPath))
+	}
+	if ref := env.ValueFrom.ResourceFieldRef; ref != nil {
+		valueFrom.WithResourceFieldRef(corev1apply.ResourceFieldSelector().WithContainerName(ref.ContainerName).
+			WithResource(ref.Resource).WithDivisor(ref.Divisor))
+	}
+	if ref := env.ValueFrom.ConfigMapKeyRef; ref != nil {
+		selector := corev1apply.ConfigMapKeySelector().WithName(ref.Name).WithKey(ref.Key)
+		if ref.Optional != nil {
+			selector.WithOptional(*ref.Optional)
+		}
+		valueFrom.WithConfigMapKeyRef(selector)
+	}
+	if ref := env.ValueFrom.SecretKeyRef; ref != nil {
+		selector := corev1apply.SecretKeySelector().WithName(ref.Name).WithKey(ref.Key)
+		if ref.Optional != nil {
+			selector.WithOptional(*ref.Optional)
+		}
+		valueFrom.WithSecretKeyRef(selector)
+	}
+	return ret.WithValueFrom(valueFrom)
+}
+
+// SummarizeDiff shortens a cmp.Diff output to changed lines so that it fits in an event message
+func SummarizeDiff(diff string) string {
+	changed := make([]string, 0)
+	for _, line := range strings.Split(diff, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "-") || strings.HasPrefix(trimmed, "+") {
+			changed = append(changed, strings.Join(strings.Fields(trimmed), " "))
+		}
+	}
+	var summary string
+	if len(changed) <= maxDiffLines {
+		summary = fmt.Sprintf("%d lines changed: %s", len(changed), strings.Join(changed, "; "))
+	} else {
+		summary = fmt.Sprintf("%d lines changed: %s; ...", len(changed), strings.Join(changed[:maxDiffLines], "; "))
+	}
+	if len(summary) > maxEventMessageLength {
+		summary = summary[:maxEventMessageLength-3] + "..."
+	}
+	return summary
 }
 
 func GetLabels(cdu *chartsv1alpha1.CoreDumpHandler) map[string]string {
@@ -122,18 +256,22 @@ func GetLabels(cdu *chartsv1alpha1.CoreDumpHandler) map[string]string {
 
 func (r *CoreDumpHandlerReconciler) UpdateScc(ctx context.Context, cdu *chartsv1alpha1.CoreDumpHandler, l logr.Logger) (requeue bool, err error) {
 	if !cdu.Spec.OpenShift {
-		return false, nil
+		// clean up SecurityContextConstraints if openShift is turned off
+		return r.DeleteScc(ctx, cdu, l)
 	}
+	sccName := GetSccName(cdu.Namespace, cdu.Name)
 	var scc, origApplyConfig *securityv1apply.SecurityContextConstraintsApplyConfiguration
 	var orig securityv1.SecurityContextConstraints
-	err = r.Get(ctx, client.ObjectKey{Name: cdu.Name}, &orig)
+	err = r.Get(ctx, client.ObjectKey{Name: sccName}, &orig)
 	if err != nil && !errors.IsNotFound(err) {
 		l.Error(err, "Failed: UpdateScc, Get")
+		r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "SccUpdateFailed", "Failed to get SecurityContextConstraints %v: %v", sccName, err)
 		return false, err
 	} else if err == nil {
 		origApplyConfig, err = securityv1apply.ExtractSecurityContextConstraints(&orig, fieldManager)
 		if err != nil {
 			l.Error(err, "Failed: UpdateNodes, ExtractSecurityContextConstraints")
+			r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "SccUpdateFailed", "Failed to extract SecurityContextConstraints %v: %v", sccName, err)
 			return false, err
 		}
 		copied := *origApplyConfig
@@ -144,8 +282,10 @@ func (r *CoreDumpHandlerReconciler) UpdateScc(ctx context.Context, cdu *chartsv1
 		scc.Users = nil
 		scc.OwnerReferences = nil
 	} else {
-		scc = securityv1apply.SecurityContextConstraints(cdu.Name)
+		scc = securityv1apply.SecurityContextConstraints(sccName)
 	}
+	scc.WithLabels(map[string]string{managedByLabel: fieldManager}).
+		WithAnnotations(map[string]string{ownerNamespaceAnnotation: cdu.Namespace, ownerNameAnnotation: cdu.Name})
 	scc.WithAllowHostDirVolumePlugin(true).WithAllowPrivilegeEscalation(true).WithAllowPrivilegedContainer(true).
 		WithAllowHostIPC(false).WithAllowHostNetwork(false).WithAllowHostPID(false).WithAllowHostPorts(false).
 		WithAllowedCapabilities("").WithForbiddenSysctls("*").WithDefaultAllowPrivilegeEscalation(true).
@@ -157,18 +297,9 @@ func (r *CoreDumpHandlerReconciler) UpdateScc(ctx context.Context, cdu *chartsv1
 		WithVolumes(securityv1.FSTypeSecret, securityv1.FSTypePersistentVolumeClaim).
 		WithPriority(10).WithUsers(fmt.Sprintf("system:serviceaccount:%s:%s", cdu.Namespace, cdu.Spec.ServiceAccount))
 
-	gvk, err := apiutil.GVKForObject(cdu, r.Scheme)
-	if err != nil {
-		l.Error(err, "Failed: UpdateScc, GVKForObject")
-		return false, err
+	if requeue, err = r.DeleteLegacyScc(ctx, cdu, l); requeue || err != nil {
+		return requeue, err
 	}
-	scc.WithOwnerReferences(metav1apply.OwnerReference().
-		WithAPIVersion(gvk.GroupVersion().String()).
-		WithKind(gvk.Kind).
-		WithName(cdu.Name).
-		WithUID(cdu.GetUID()).
-		WithBlockOwnerDeletion(true).
-		WithController(true))
 
 	firstApply := origApplyConfig == nil
 	if !firstApply {
@@ -178,20 +309,24 @@ func (r *CoreDumpHandlerReconciler) UpdateScc(ctx context.Context, cdu *chartsv1
 		diff := cmp.Diff(*origApplyConfig, *scc)
 		if len(diff) > 0 {
 			l.Info("UpdateScc, Patch", "diff", diff)
+			r.Recorder.Eventf(cdu, corev1.EventTypeNormal, "SccDriftCorrected", "Reverted SecurityContextConstraints %v: %v", *scc.Name, SummarizeDiff(diff))
 		}
 	}
 	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(scc)
 	if err != nil {
 		l.Error(err, "Failed: UpdateScc, ToUnstructured")
+		r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "SccUpdateFailed", "Failed to convert SecurityContextConstraints %v: %v", *scc.Name, err)
 		return false, err
 	}
 	patch := &unstructured.Unstructured{Object: obj}
 	if err = r.Patch(ctx, patch, client.Apply, &client.PatchOptions{FieldManager: fieldManager, Force: pointer.Bool(true)}); err != nil {
 		l.Error(err, "Failed: UpdateScc, Patch", "name", *scc.Name)
+		r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "SccUpdateFailed", "Failed to apply SecurityContextConstraints %v: %v", *scc.Name, err)
 		return false, err
 	}
 	if firstApply {
 		l.Info("Success: UpdateScc, Patch (first)", "name", *scc.Name)
+		r.Recorder.Eventf(cdu, corev1.EventTypeNormal, "SccCreated", "Created SecurityContextConstraints %v", *scc.Name)
 	}
 	return false, nil
 }
@@ -202,11 +337,13 @@ func (r *CoreDumpHandlerReconciler) UpdateCluster(ctx context.Context, cdu *char
 	err = r.Get(ctx, client.ObjectKey{Name: cdu.Name, Namespace: cdu.Namespace}, &orig)
 	if err != nil && !errors.IsNotFound(err) {
 		l.Error(err, "Failed: UpdateCluster, Get")
+		r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "DaemonSetUpdateFailed", "Failed to get DaemonSet %v: %v", cdu.Name, err)
 		return false, err
 	} else if err == nil {
 		origApplyConfig, err = appsv1apply.ExtractDaemonSet(&orig, fieldManager)
 		if err != nil {
 			l.Error(err, "Failed: UpdateNodes, ExtractDaemonSet")
+			r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "DaemonSetUpdateFailed", "Failed to extract DaemonSet %v: %v", cdu.Name, err)
 			return false, err
 		}
 		copied := *origApplyConfig
@@ -233,24 +370,29 @@ func (r *CoreDumpHandlerReconciler) UpdateCluster(ctx context.Context, cdu *char
 		}
 	}
 
+	composer := cdu.Spec.Composer.DeepCopy()
+	composer.Default()
 	envs := []*corev1apply.EnvVarApplyConfiguration{
-		corev1apply.EnvVar().WithName("COMP_FILENAME_TEMPLATE").WithValue("{uuid}-dump-{timestamp}-{hostname}-{exe_name}-{pid}-{signal}"),
-		corev1apply.EnvVar().WithName("COMP_LOG_LENGTH").WithValue("500"),
-		corev1apply.EnvVar().WithName("COMP_LOG_LEVEL").WithValue("Warn"),
-		corev1apply.EnvVar().WithName("COMP_IGNORE_CRIO").WithValue("false"),
-		corev1apply.EnvVar().WithName("COMP_CRIO_IMAGE_CMD").WithValue("images"),
-		corev1apply.EnvVar().WithName("COMP_TIMEOUT").WithValue("600"),
-		corev1apply.EnvVar().WithName("COMP_COMPRESSION").WithValue("true"),
-		corev1apply.EnvVar().WithName("COMP_CORE_EVENTS").WithValue("false"),
+		corev1apply.EnvVar().WithName("COMP_FILENAME_TEMPLATE").WithValue(composer.FilenameTemplate),
+		corev1apply.EnvVar().WithName("COMP_LOG_LENGTH").WithValue(strconv.Itoa(int(*composer.LogLength))),
+		corev1apply.EnvVar().WithName("COMP_LOG_LEVEL").WithValue(composer.LogLevel),
+		corev1apply.EnvVar().WithName("COMP_IGNORE_CRIO").WithValue(strconv.FormatBool(composer.IgnoreCrio)),
+		corev1apply.EnvVar().WithName("COMP_CRIO_IMAGE_CMD").WithValue(composer.CrioImageCmd),
+		corev1apply.EnvVar().WithName("COMP_TIMEOUT").WithValue(strconv.Itoa(int(*composer.Timeout))),
+		corev1apply.EnvVar().WithName("COMP_COMPRESSION").WithValue(strconv.FormatBool(*composer.Compression)),
+		corev1apply.EnvVar().WithName("COMP_CORE_EVENTS").WithValue(strconv.FormatBool(composer.CoreEvents)),
 		corev1apply.EnvVar().WithName("COMP_CORE_EVENT_DIR").WithValue(filepath.Join(cdu.Spec.HostDir, "events")),
-		corev1apply.EnvVar().WithName("DEPLOY_CRIO_CONFIG").WithValue("false"),
+		corev1apply.EnvVar().WithName("DEPLOY_CRIO_CONFIG").WithValue(strconv.FormatBool(composer.DeployCrioConfig)),
 		corev1apply.EnvVar().WithName("CRIO_ENDPOINT").WithValue(cdu.Spec.CrioEndPoint),
 		corev1apply.EnvVar().WithName("HOST_DIR").WithValue(cdu.Spec.HostDir),
 		corev1apply.EnvVar().WithName("CORE_DIR").WithValue(filepath.Join(cdu.Spec.HostDir, "cores")),
 		corev1apply.EnvVar().WithName("EVENT_DIR").WithValue(filepath.Join(cdu.Spec.HostDir, "events")),
-		corev1apply.EnvVar().WithName("SUID_DUMPABLE").WithValue("2"),
-		corev1apply.EnvVar().WithName("DEPLOY_CRIO_EXE").WithValue("false"),
-		corev1apply.EnvVar().WithName("USE_INOTIFY").WithValue("false"),
+		corev1apply.EnvVar().WithName("SUID_DUMPABLE").WithValue(strconv.Itoa(int(*composer.SuidDumpable))),
+		corev1apply.EnvVar().WithName("DEPLOY_CRIO_EXE").WithValue(strconv.FormatBool(composer.DeployCrioExe)),
+		corev1apply.EnvVar().WithName("USE_INOTIFY").WithValue(strconv.FormatBool(composer.UseInotify)),
+	}
+	for _, env := range composer.ExtraEnv {
+		envs = append(envs, GetEnvVarApplyConfiguration(env))
 	}
 	container1 := corev1apply.Container().WithName("agent").
 		WithImage(cdu.Spec.HandlerImage).WithImagePullPolicy(corev1.PullIfNotPresent).WithCommand("/app/core-dump-agent").
@@ -262,21 +404,35 @@ func (r *CoreDumpHandlerReconciler) UpdateCluster(ctx context.Context, cdu *char
 	command := []string{
 		"/core-dump-uploader", fmt.Sprintf("--defaultNamespace=%v", cdu.Namespace), fmt.Sprintf("--watchDir=%v", filepath.Join(cdu.Spec.HostDir, "cores")),
 	}
-	if len(cdu.Spec.NamespaceLabelSelector) > 0 {
-		// NOTE: label characters must be [a-z0-9A-Z/._-]. So, "=" and "," are available as delimiters
-		selectorStrs := []string{}
-		for key, value := range cdu.Spec.NamespaceLabelSelector {
-			selectorStrs = append(selectorStrs, fmt.Sprintf("%s=%v", key, value))
+	if selector := cdu.Spec.GetNamespaceSelector(); selector != nil {
+		// NOTE: pass the selector as JSON to keep matchExpressions without loss
+		selectorJson, err := json.Marshal(selector)
+		if err != nil {
+			l.Error(err, "Failed: UpdateCluster, Marshal namespaceSelector")
+			r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "DaemonSetUpdateFailed", "Failed to marshal namespaceSelector: %v", err)
+			return false, err
+		}
+		command = append(command, fmt.Sprintf("--namespaceSelector=%s", selectorJson))
+	}
+	if cdu.Spec.ArchiveDir != "" {
+		command = append(command, fmt.Sprintf("--fsRoot=%v", cdu.Spec.ArchiveDir))
+		if cdu.Spec.ArchiveQuota != nil {
+			command = append(command, fmt.Sprintf("--fsQuota=%v", cdu.Spec.ArchiveQuota.Value()))
 		}
-		command = append(command, fmt.Sprintf("--namespaceLabelSelector=%s", strings.Join(selectorStrs, ",")))
 	}
 	container2 := corev1apply.Container().WithName("uploader").
 		WithImage(cdu.Spec.UploaderImage).WithImagePullPolicy(corev1.PullAlways).WithCommand(command...).
+		WithEnv(corev1apply.EnvVar().WithName("NODE_NAME").WithValueFrom(corev1apply.EnvVarSource().
+			WithFieldRef(corev1apply.ObjectFieldSelector().WithFieldPath("spec.nodeName")))).
 		WithVolumeMounts(corev1apply.VolumeMount().WithName("host-volume").WithMountPath(cdu.Spec.HostDir),
 			corev1apply.VolumeMount().WithName("cores-volume").WithMountPath(filepath.Join(cdu.Spec.HostDir, "cores")),
 			corev1apply.VolumeMount().WithName("events-volume").WithMountPath(filepath.Join(cdu.Spec.HostDir, "events"))).
 		WithSecurityContext(corev1apply.SecurityContext().WithPrivileged(true)).
 		WithResources(corev1apply.ResourceRequirements().WithLimits(limits).WithRequests(requests))
+	if cdu.Spec.ArchiveDir != "" {
+		container2.WithVolumeMounts(corev1apply.VolumeMount().WithName("archive-volume").WithMountPath(cdu.Spec.ArchiveDir).
+			WithMountPropagation(corev1.MountPropagationHostToContainer))
+	}
 
 	pod.Spec.WithContainers(container1, container2).WithVolumes(
 		corev1apply.Volume().WithName("host-volume").WithHostPath(corev1apply.HostPathVolumeSource().
@@ -286,6 +442,11 @@ func (r *CoreDumpHandlerReconciler) UpdateCluster(ctx context.Context, cdu *char
 		corev1apply.Volume().WithName("events-volume").WithHostPath(corev1apply.HostPathVolumeSource().
 			WithPath(filepath.Join(cdu.Spec.HostDir, "events")).WithType(corev1.HostPathDirectoryOrCreate)),
 	)
+	if cdu.Spec.ArchiveDir != "" {
+		// NOTE: HostPathDirectory does not create archiveDir on nodes where the share is not mounted
+		pod.Spec.WithVolumes(corev1apply.Volume().WithName("archive-volume").WithHostPath(corev1apply.HostPathVolumeSource().
+			WithPath(cdu.Spec.ArchiveDir).WithType(corev1.HostPathDirectory)))
+	}
 
 	if cdu.Spec.ImagePullSecret != "" {
 		pod.Spec.WithImagePullSecrets(corev1apply.LocalObjectReference().WithName(cdu.Spec.ImagePullSecret))
@@ -309,6 +470,7 @@ func (r *CoreDumpHandlerReconciler) UpdateCluster(ctx context.Context, cdu *char
 	gvk, err := apiutil.GVKForObject(cdu, r.Scheme)
 	if err != nil {
 		l.Error(err, "Failed: UpdateCluster, GVKForObject")
+		r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "DaemonSetUpdateFailed", "Failed to resolve GroupVersionKind: %v", err)
 		return false, err
 	}
 	ds.WithOwnerReferences(metav1apply.OwnerReference().
@@ -327,20 +489,24 @@ func (r *CoreDumpHandlerReconciler) UpdateCluster(ctx context.Context, cdu *char
 		diff := cmp.Diff(*origApplyConfig, *ds)
 		if len(diff) > 0 {
 			l.Info("UpdateCluster, Patch", "diff", diff)
+			r.Recorder.Eventf(cdu, corev1.EventTypeNormal, "DaemonSetDriftCorrected", "Reverted DaemonSet %v: %v", *ds.Name, SummarizeDiff(diff))
 		}
 	}
 	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(ds)
 	if err != nil {
 		l.Error(err, "Failed: UpdateCluster, ToUnstructured")
+		r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "DaemonSetUpdateFailed", "Failed to convert DaemonSet %v: %v", *ds.Name, err)
 		return false, err
 	}
 	patch := &unstructured.Unstructured{Object: obj}
 	if err = r.Patch(ctx, patch, client.Apply, &client.PatchOptions{FieldManager: fieldManager, Force: pointer.Bool(true)}); err != nil {
 		l.Error(err, "Failed: UpdateCluster, Patch", "namespace", *ds.Namespace, "name", *ds.Name)
+		r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "DaemonSetUpdateFailed", "Failed to apply DaemonSet %v: %v", *ds.Name, err)
 		return false, err
 	}
 	if firstApply {
 		l.Info("Success: UpdateCluster, Patch (first)", "namespace", *ds.Namespace, "name", *ds.Name)
+		r.Recorder.Eventf(cdu, corev1.EventTypeNormal, "DaemonSetCreated", "Created DaemonSet %v", *ds.Name)
 	}
 	return false, nil
 }
@@ -354,36 +520,179 @@ func (r *CoreDumpHandlerReconciler) DeleteCluster(ctx context.Context, cdu *char
 			return false, nil
 		}
 		l.Error(err, "Failed: DeleteCluster, Get")
+		r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "DaemonSetDeleteFailed", "Failed to get DaemonSet %v: %v", key.Name, err)
 		return false, err
 	}
 
 	if err := r.Delete(ctx, found); err != nil {
 		l.Error(err, "Failed: DeleteCluster, Delete", "namespace", found.Namespace, "name", found.Name)
+		r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "DaemonSetDeleteFailed", "Failed to delete DaemonSet %v: %v", found.Name, err)
 		return false, err
 	}
 	l.Info("Success: DeleteCluster", "namespace", found.Namespace, "name", found.Name)
+	r.Recorder.Eventf(cdu, corev1.EventTypeNormal, "DaemonSetDeleted", "Deleted DaemonSet %v", found.Name)
 	return false, nil
 }
 
 func (r *CoreDumpHandlerReconciler) DeleteScc(ctx context.Context, cdu *chartsv1alpha1.CoreDumpHandler, l logr.Logger) (requeue bool, err error) {
-	if !cdu.Spec.OpenShift {
-		return false, nil
+	if requeue, err = r.DeleteLegacyScc(ctx, cdu, l); requeue || err != nil {
+		return requeue, err
 	}
 	found := &securityv1.SecurityContextConstraints{}
-	key := client.ObjectKey{Name: cdu.Name}
+	key := client.ObjectKey{Name: GetSccName(cdu.Namespace, cdu.Name)}
 	err = r.Get(ctx, key, found)
 	if err != nil {
-		if errors.IsNotFound(err) {
+		if errors.IsNotFound(err) || meta.IsNoMatchError(err) {
 			return false, nil
 		}
 		l.Error(err, "Failed: DeleteScc, Get")
+		r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "SccDeleteFailed", "Failed to get SecurityContextConstraints %v: %v", key.Name, err)
 		return false, err
 	}
+	if !IsOwnedScc(found, cdu) {
+		l.Info("DeleteScc, skip SecurityContextConstraints not managed by the operator", "name", found.Name)
+		return false, nil
+	}
 
-	if err := r.Delete(ctx, found); err != nil {
+	if err := r.Delete(ctx, found); err != nil && !errors.IsNotFound(err) {
 		l.Error(err, "Failed: DeleteScc, Delete", "name", found.Name)
+		r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "SccDeleteFailed", "Failed to delete SecurityContextConstraints %v: %v", found.Name, err)
 		return false, err
 	}
 	l.Info("Success: DeleteScc", "name", found.Name)
+	r.Recorder.Eventf(cdu, corev1.EventTypeNormal, "SccDeleted", "Deleted SecurityContextConstraints %v", found.Name)
+	return false, nil
+}
+
+// DeleteLegacyScc deletes SecurityContextConstraints that older operators named after the CoreDumpHandler with an ownerReference
+func (r *CoreDumpHandlerReconciler) DeleteLegacyScc(ctx context.Context, cdu *chartsv1alpha1.CoreDumpHandler, l logr.Logger) (requeue bool, err error) {
+	found := &securityv1.SecurityContextConstraints{}
+	err = r.Get(ctx, client.ObjectKey{Name: cdu.Name}, found)
+	if err != nil {
+		if errors.IsNotFound(err) || meta.IsNoMatchError(err) {
+			return false, nil
+		}
+		l.Error(err, "Failed: DeleteLegacyScc, Get")
+		return false, err
+	}
+	var owned = false
+	for _, ref := range found.GetOwnerReferences() {
+		if ref.UID == cdu.GetUID() {
+			owned = true
+			break
+		}
+	}
+	if !owned {
+		return false, nil
+	}
+	if err := r.Delete(ctx, found); err != nil && !errors.IsNotFound(err) {
+		l.Error(err, "Failed: DeleteLegacyScc, Delete", "name", found.Name)
+		r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "SccDeleteFailed", "Failed to delete legacy SecurityContextConstraints %v: %v", found.Name, err)
+		return false, err
+	}
+	l.Info("Success: DeleteLegacyScc", "name", found.Name)
+	r.Recorder.Eventf(cdu, corev1.EventTypeNormal, "SccDeleted", "Deleted legacy SecurityContextConstraints %v", found.Name)
 	return false, nil
 }
+
+// UpdateStatus publishes conditions and daemonset rollout state. failedType and failure report an error from UpdateScc or UpdateCluster.
+func (r *CoreDumpHandlerReconciler) UpdateStatus(ctx context.Context, cdu *chartsv1alpha1.CoreDumpHandler, failedType string, failure error, l logr.Logger) error {
+	orig := cdu.Status.DeepCopy()
+	status := &cdu.Status
+	status.ObservedGeneration = cdu.Generation
+
+	dsAvailable := metav1.Condition{Type: chartsv1alpha1.ConditionDaemonSetAvailable, ObservedGeneration: cdu.Generation}
+	var ds appsv1.DaemonSet
+	err := r.Get(ctx, client.ObjectKey{Name: cdu.Name, Namespace: cdu.Namespace}, &ds)
+	if err != nil && !errors.IsNotFound(err) {
+		l.Error(err, "Failed: UpdateStatus, Get DaemonSet")
+		r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "StatusUpdateFailed", "Failed to get DaemonSet %v: %v", cdu.Name, err)
+		return err
+	} else if err != nil {
+		status.DesiredNumberScheduled, status.NumberReady, status.UpdatedNumberScheduled = 0, 0, 0
+		status.HandlerImage, status.UploaderImage = "", ""
+		dsAvailable.Status, dsAvailable.Reason, dsAvailable.Message = metav1.ConditionFalse, "NotFound", "daemonset is not created yet"
+	} else {
+		status.DesiredNumberScheduled = ds.Status.DesiredNumberScheduled
+		status.NumberReady = ds.Status.NumberReady
+		status.UpdatedNumberScheduled = ds.Status.UpdatedNumberScheduled
+		status.HandlerImage, status.UploaderImage = "", ""
+		for _, c := range ds.Spec.Template.Spec.Containers {
+			switch c.Name {
+			case "agent":
+				status.HandlerImage = c.Image
+			case "uploader":
+				status.UploaderImage = c.Image
+			}
+		}
+		if ds.Status.ObservedGeneration < ds.Generation {
+			dsAvailable.Status, dsAvailable.Reason, dsAvailable.Message = metav1.ConditionFalse, "RollingOut", "daemonset controller has not observed the latest spec"
+		} else if ds.Status.DesiredNumberScheduled == 0 {
+			dsAvailable.Status, dsAvailable.Reason, dsAvailable.Message = metav1.ConditionFalse, "NoNodesScheduled", "no nodes match the daemonset scheduling constraints"
+		} else if ds.Status.UpdatedNumberScheduled < ds.Status.DesiredNumberScheduled || ds.Status.NumberAvailable < ds.Status.DesiredNumberScheduled {
+			dsAvailable.Status, dsAvailable.Reason = metav1.ConditionFalse, "RollingOut"
+			dsAvailable.Message = fmt.Sprintf("%d of %d nodes are updated, %d are available",
+				ds.Status.UpdatedNumberScheduled, ds.Status.DesiredNumberScheduled, ds.Status.NumberAvailable)
+		} else {
+			dsAvailable.Status, dsAvailable.Reason = metav1.ConditionTrue, "RolloutComplete"
+			dsAvailable.Message = fmt.Sprintf("%d nodes are available", ds.Status.NumberAvailable)
+		}
+	}
+
+	sccReady := metav1.Condition{Type: chartsv1alpha1.ConditionSccReady, ObservedGeneration: cdu.Generation}
+	if !cdu.Spec.OpenShift {
+		sccReady.Status, sccReady.Reason, sccReady.Message = metav1.ConditionTrue, "NotRequired", "openShift is disabled"
+	} else {
+		var scc securityv1.SecurityContextConstraints
+		err = r.Get(ctx, client.ObjectKey{Name: GetSccName(cdu.Namespace, cdu.Name)}, &scc)
+		if err != nil && !errors.IsNotFound(err) {
+			l.Error(err, "Failed: UpdateStatus, Get SecurityContextConstraints")
+			r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "StatusUpdateFailed", "Failed to get SecurityContextConstraints %v: %v", GetSccName(cdu.Namespace, cdu.Name), err)
+			return err
+		} else if err != nil {
+			sccReady.Status, sccReady.Reason, sccReady.Message = metav1.ConditionFalse, "NotFound", "securityContextConstraints is not created yet"
+		} else {
+			sccReady.Status, sccReady.Reason, sccReady.Message = metav1.ConditionTrue, "Created", fmt.Sprintf("securityContextConstraints %v exists", scc.Name)
+		}
+	}
+
+	degraded := metav1.Condition{Type: chartsv1alpha1.ConditionDegraded, ObservedGeneration: cdu.Generation}
+	if failure != nil {
+		failed := metav1.Condition{
+			Type: failedType, Status: metav1.ConditionFalse, ObservedGeneration: cdu.Generation,
+			Reason: "ReconcileFailed", Message: failure.Error(),
+		}
+		if failedType == chartsv1alpha1.ConditionSccReady {
+			sccReady = failed
+		} else {
+			dsAvailable = failed
+		}
+		degraded.Status, degraded.Reason, degraded.Message = metav1.ConditionTrue, "ReconcileFailed", failure.Error()
+	} else {
+		degraded.Status, degraded.Reason, degraded.Message = metav1.ConditionFalse, "ReconcileSucceeded", "last reconcile succeeded"
+	}
+
+	ready := metav1.Condition{Type: chartsv1alpha1.ConditionReady, ObservedGeneration: cdu.Generation}
+	if dsAvailable.Status == metav1.ConditionTrue && sccReady.Status == metav1.ConditionTrue && degraded.Status == metav1.ConditionFalse {
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionTrue, "Ready", "core dump collection is running on all scheduled nodes"
+	} else if degraded.Status == metav1.ConditionTrue {
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, degraded.Reason, degraded.Message
+	} else if sccReady.Status != metav1.ConditionTrue {
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, "SccNotReady", sccReady.Message
+	} else {
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, "DaemonSetNotAvailable", dsAvailable.Message
+	}
+
+	for _, c := range []metav1.Condition{ready, dsAvailable, sccReady, degraded} {
+		meta.SetStatusCondition(&status.Conditions, c)
+	}
+	if equality.Semantic.DeepEqual(orig, status) {
+		return nil
+	}
+	if err = r.Status().Update(ctx, cdu); err != nil {
+		l.Error(err, "Failed: UpdateStatus, Update")
+		r.Recorder.Eventf(cdu, corev1.EventTypeWarning, "StatusUpdateFailed", "Failed to update status: %v", err)
+		return err
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	chartsv1alpha1 "github.com/IBM/core-dump-operator/api/v1alpha1"
@@ -11,9 +12,11 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
@@ -29,17 +32,25 @@ func createCoreDumpHandler(ctx context.Context, cdhName string, namespaceName st
 				Namespace: typedNamespaceName.Namespace,
 			},
 			Spec: chartsv1alpha1.CoreDumpHandlerSpec{
-				OpenShift:              openShift,
-				ImagePullSecret:        "secret",
-				ServiceAccount:         "sa",
-				NodeSelector:           map[string]string{"node": "selector"},
-				Tolerations:            []corev1.Toleration{{Key: "key", Operator: "Exists", Effect: "NoSchedule"}},
-				Affinity:               &chartsv1alpha1.AffinityApplyConfiguration{},
-				NamespaceLabelSelector: map[string]string{"cdh": "enabled"},
+				OpenShift:       openShift,
+				ImagePullSecret: "secret",
+				ServiceAccount:  "sa",
+				NodeSelector:    map[string]string{"node": "selector"},
+				Tolerations:     []corev1.Toleration{{Key: "key", Operator: "Exists", Effect: "NoSchedule"}},
+				Affinity:        &chartsv1alpha1.AffinityApplyConfiguration{},
+				NamespaceSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"cdh": "enabled"},
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "tier", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"prod"}},
+					},
+				},
 				Resource: &corev1.ResourceRequirements{
 					Limits:   corev1.ResourceList{"cpu": *resource.NewQuantity(1, resource.DecimalSI)},
 					Requests: corev1.ResourceList{"cpu": *resource.NewQuantity(1, resource.DecimalSI)},
 				},
+				Composer: chartsv1alpha1.ComposerSpec{
+					ExtraEnv: []corev1.EnvVar{{Name: "RUST_BACKTRACE", Value: "1"}},
+				},
 			},
 		}
 
@@ -68,6 +79,7 @@ func testCreateDeleteCoreDumpHandler(cdhName string, namespaceName string, openS
 		By("Creating the custom resource for the Kind CoreDumpHandler")
 		ctx := context.Background()
 		typedNamespaceName := types.NamespacedName{Name: cdhName, Namespace: namespaceName}
+		sccKey := types.NamespacedName{Name: GetSccName(namespaceName, cdhName)}
 		err := createCoreDumpHandler(ctx, cdhName, namespaceName, openShift)
 		Expect(err).To(Not(HaveOccurred()))
 
@@ -78,28 +90,60 @@ func testCreateDeleteCoreDumpHandler(cdhName string, namespaceName string, openS
 		}, time.Minute, time.Second).Should(Succeed())
 
 		By("Reconciling the custom resource created")
+		recorder := record.NewFakeRecorder(100)
 		cdhReconciler := &CoreDumpHandlerReconciler{
-			Client: k8sClient, Scheme: k8sClient.Scheme(),
+			Client: k8sClient, Scheme: k8sClient.Scheme(), Recorder: recorder,
 		}
 		_, err = cdhReconciler.Reconcile(ctx, reconcile.Request{
 			NamespacedName: typedNamespaceName,
 		})
 		Expect(err).To(Not(HaveOccurred()))
 
+		By("Checking if events were recorded in the reconciliation")
+		Eventually(recorder.Events).Should(Receive(ContainSubstring("DaemonSetCreated")))
+
 		By("Checking if DaemonSet was successfully created in the reconciliation")
+		ds := &appsv1.DaemonSet{}
 		Eventually(func() error {
-			found := &appsv1.DaemonSet{}
-			return k8sClient.Get(ctx, typedNamespaceName, found)
+			return k8sClient.Get(ctx, typedNamespaceName, ds)
 		}, time.Minute, time.Second).Should(Succeed())
 
+		By("Checking if composer settings were passed to the agent container")
+		Expect(ds.Spec.Template.Spec.Containers[0].Env).To(ContainElements(
+			corev1.EnvVar{Name: "COMP_LOG_LENGTH", Value: "500"},
+			corev1.EnvVar{Name: "COMP_COMPRESSION", Value: "true"},
+			corev1.EnvVar{Name: "RUST_BACKTRACE", Value: "1"},
+		))
+
+		By("Checking if namespaceSelector was passed to the uploader container")
+		Expect(ds.Spec.Template.Spec.Containers[1].Command).To(ContainElement(
+			`--namespaceSelector={"matchLabels":{"cdh":"enabled"},"matchExpressions":[{"key":"tier","operator":"NotIn","values":["prod"]}]}`,
+		))
+
 		if openShift {
 			By("Checking if SCC was successfully created in the reconciliation")
+			scc := &securityv1.SecurityContextConstraints{}
 			Eventually(func() error {
-				found := &securityv1.SecurityContextConstraints{}
-				return k8sClient.Get(ctx, typedNamespaceName, found)
+				return k8sClient.Get(ctx, sccKey, scc)
 			}, time.Minute, time.Second).Should(Succeed())
+
+			By("Checking if SCC is owned by labels and annotations instead of ownerReferences")
+			Expect(scc.GetOwnerReferences()).To(BeEmpty())
+			Expect(MapSccToCoreDumpHandler(ctx, scc)).To(Equal([]reconcile.Request{{NamespacedName: typedNamespaceName}}))
 		}
 
+		By("Checking if status was successfully updated in the reconciliation")
+		found := &chartsv1alpha1.CoreDumpHandler{}
+		Expect(k8sClient.Get(ctx, typedNamespaceName, found)).To(Succeed())
+		Expect(found.Status.ObservedGeneration).To(Equal(found.Generation))
+		Expect(found.Status.HandlerImage).To(Equal(found.Spec.HandlerImage))
+		Expect(found.Status.UploaderImage).To(Equal(found.Spec.UploaderImage))
+		Expect(meta.IsStatusConditionTrue(found.Status.Conditions, chartsv1alpha1.ConditionSccReady)).To(BeTrue())
+		Expect(meta.IsStatusConditionFalse(found.Status.Conditions, chartsv1alpha1.ConditionDegraded)).To(BeTrue())
+		// no daemonset controller runs in envtest, so the rollout never completes
+		Expect(meta.IsStatusConditionFalse(found.Status.Conditions, chartsv1alpha1.ConditionDaemonSetAvailable)).To(BeTrue())
+		Expect(meta.IsStatusConditionFalse(found.Status.Conditions, chartsv1alpha1.ConditionReady)).To(BeTrue())
+
 		By("Removing the custom ressource for the Kind CoreDumpHandler")
 		Eventually(func() error {
 			return deleteCoreDumpHandler(ctx, cdhName, namespaceName)
@@ -120,7 +164,7 @@ func testCreateDeleteCoreDumpHandler(cdhName string, namespaceName string, openS
 		By("Checking if SCC was successfully deleted in the reconciliation")
 		Eventually(func() error {
 			found := &securityv1.SecurityContextConstraints{}
-			return k8sClient.Get(ctx, typedNamespaceName, found)
+			return k8sClient.Get(ctx, sccKey, found)
 		}, time.Minute, time.Second).ShouldNot(Succeed())
 	})
 }
@@ -130,12 +174,13 @@ func testDeleteAfterOperatorRestart() {
 		By("Creating the custom resource for the Kind CoreDumpHandler")
 		ctx := context.Background()
 		typedNamespaceName := types.NamespacedName{Name: cdhName, Namespace: namespaceName}
+		sccKey := types.NamespacedName{Name: GetSccName(namespaceName, cdhName)}
 		err := createCoreDumpHandler(ctx, cdhName, namespaceName, true)
 		Expect(err).To(Not(HaveOccurred()))
 
 		By("Reconciling the custom resource created")
 		cdhReconciler := &CoreDumpHandlerReconciler{
-			Client: k8sClient, Scheme: k8sClient.Scheme(),
+			Client: k8sClient, Scheme: k8sClient.Scheme(), Recorder: record.NewFakeRecorder(100),
 		}
 		_, err = cdhReconciler.Reconcile(ctx, reconcile.Request{
 			NamespacedName: typedNamespaceName,
@@ -155,7 +200,7 @@ func testDeleteAfterOperatorRestart() {
 
 		By("Removing the SCC manually")
 		Eventually(func() error {
-			return k8sClient.Delete(ctx, &securityv1.SecurityContextConstraints{ObjectMeta: metav1.ObjectMeta{Name: cdhName, Namespace: namespaceName}})
+			return k8sClient.Delete(ctx, &securityv1.SecurityContextConstraints{ObjectMeta: metav1.ObjectMeta{Name: sccKey.Name}})
 		}, time.Minute, time.Second).Should(Succeed())
 
 		By("Removing the custom ressource for the Kind CoreDumpHandler")
@@ -178,7 +223,7 @@ func testDeleteAfterOperatorRestart() {
 		By("Checking if SCC was successfully deleted in the reconciliation")
 		Eventually(func() error {
 			found := &securityv1.SecurityContextConstraints{}
-			return k8sClient.Get(ctx, typedNamespaceName, found)
+			return k8sClient.Get(ctx, sccKey, found)
 		}, time.Minute, time.Second).ShouldNot(Succeed())
 	})
 }
@@ -188,12 +233,13 @@ func testCreateOnUserDelete() {
 		By("Creating the custom resource for the Kind CoreDumpHandler")
 		ctx := context.Background()
 		typedNamespaceName := types.NamespacedName{Name: cdhName, Namespace: namespaceName}
+		sccKey := types.NamespacedName{Name: GetSccName(namespaceName, cdhName)}
 		err := createCoreDumpHandler(ctx, cdhName, namespaceName, true)
 		Expect(err).To(Not(HaveOccurred()))
 
 		By("Reconciling the custom resource created")
 		cdhReconciler := &CoreDumpHandlerReconciler{
-			Client: k8sClient, Scheme: k8sClient.Scheme(),
+			Client: k8sClient, Scheme: k8sClient.Scheme(), Recorder: record.NewFakeRecorder(100),
 		}
 		_, err = cdhReconciler.Reconcile(ctx, reconcile.Request{
 			NamespacedName: typedNamespaceName,
@@ -217,10 +263,10 @@ func testCreateOnUserDelete() {
 		By("Checking if SCC was successfully created in the reconciliation")
 		Eventually(func() error {
 			found := &securityv1.SecurityContextConstraints{}
-			return k8sClient.Get(ctx, typedNamespaceName, found)
+			return k8sClient.Get(ctx, sccKey, found)
 		}, time.Minute, time.Second).Should(Succeed())
 
-		err = k8sClient.Delete(ctx, &securityv1.SecurityContextConstraints{ObjectMeta: metav1.ObjectMeta{Name: cdhName, Namespace: namespaceName}})
+		err = k8sClient.Delete(ctx, &securityv1.SecurityContextConstraints{ObjectMeta: metav1.ObjectMeta{Name: sccKey.Name}})
 		Expect(err).To(Not(HaveOccurred()))
 
 		_, err = cdhReconciler.Reconcile(ctx, reconcile.Request{
@@ -237,7 +283,7 @@ func testCreateOnUserDelete() {
 		By("Checking if SCC was successfully created in the reconciliation")
 		Eventually(func() error {
 			found := &securityv1.SecurityContextConstraints{}
-			return k8sClient.Get(ctx, typedNamespaceName, found)
+			return k8sClient.Get(ctx, sccKey, found)
 		}, time.Minute, time.Second).Should(Succeed())
 
 		By("Removing the custom ressource for the Kind CoreDumpHandler")
@@ -257,6 +303,7 @@ func testCreateOnUserModify() {
 	It("should successfully reconcile creating a custom resource for CoreDumpHandler at random user modify", func() {
 		ctx := context.Background()
 		typedNamespaceName := types.NamespacedName{Name: cdhName, Namespace: namespaceName}
+		sccKey := types.NamespacedName{Name: GetSccName(namespaceName, cdhName)}
 
 		By("Creating the Daemonset manually")
 		err := k8sClient.Create(ctx, &appsv1.DaemonSet{
@@ -275,7 +322,7 @@ func testCreateOnUserModify() {
 
 		By("Creating the SCC manually")
 		err = k8sClient.Create(ctx, &securityv1.SecurityContextConstraints{
-			ObjectMeta: metav1.ObjectMeta{Name: cdhName, Namespace: namespaceName},
+			ObjectMeta: metav1.ObjectMeta{Name: sccKey.Name},
 		})
 		Expect(err).To(Not(HaveOccurred()))
 
@@ -285,7 +332,7 @@ func testCreateOnUserModify() {
 
 		By("Reconciling the custom resource created")
 		cdhReconciler := &CoreDumpHandlerReconciler{
-			Client: k8sClient, Scheme: k8sClient.Scheme(),
+			Client: k8sClient, Scheme: k8sClient.Scheme(), Recorder: record.NewFakeRecorder(100),
 		}
 		_, err = cdhReconciler.Reconcile(ctx, reconcile.Request{
 			NamespacedName: typedNamespaceName,
@@ -309,7 +356,7 @@ func testCreateOnUserModify() {
 		By("Checking if SCC was successfully created in the reconciliation")
 		Eventually(func() error {
 			found := &securityv1.SecurityContextConstraints{}
-			return k8sClient.Get(ctx, typedNamespaceName, found)
+			return k8sClient.Get(ctx, sccKey, found)
 		}, time.Minute, time.Second).Should(Succeed())
 
 		By("Removing the custom ressource for the Kind CoreDumpHandler")
@@ -325,6 +372,20 @@ func testCreateOnUserModify() {
 	})
 }
 
+func testSummarizeDiff() {
+	It("should summarize diffs into bounded event messages", func() {
+		Expect(SummarizeDiff("")).To(Equal("0 lines changed: "))
+		Expect(SummarizeDiff("  v1.Foo{\n-\tName: \"a\",\n+\tName: \"b\",\n  }")).To(Equal(`2 lines changed: - Name: "a",; + Name: "b",`))
+		diff := ""
+		for i := 0; i < 100; i++ {
+			diff += "+\t" + strings.Repeat("x", 300) + "\n"
+		}
+		summary := SummarizeDiff(diff)
+		Expect(summary).To(HavePrefix("100 lines changed: "))
+		Expect(len(summary)).To(BeNumerically("<=", maxEventMessageLength))
+	})
+}
+
 func testEmptyRequest() {
 	It("should successfully reconcile empty requests by ignoring them", func() {
 		ctx := context.Background()
@@ -332,7 +393,7 @@ func testEmptyRequest() {
 
 		By("Reconciling the custom resource for empty (race condition?)")
 		cdhReconciler := &CoreDumpHandlerReconciler{
-			Client: k8sClient, Scheme: k8sClient.Scheme(),
+			Client: k8sClient, Scheme: k8sClient.Scheme(), Recorder: record.NewFakeRecorder(100),
 		}
 
 		_, err := cdhReconciler.Reconcile(ctx, reconcile.Request{
@@ -350,5 +411,6 @@ var _ = Describe("CoreDumpHandler controller", func() {
 		testDeleteAfterOperatorRestart()
 		testCreateOnUserModify()
 		testEmptyRequest()
+		testSummarizeDiff()
 	})
 })
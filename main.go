@@ -86,12 +86,19 @@ func main() {
 		os.Exit(1)
 	}
 	if err = (&controllers.CoreDumpHandlerReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgrScheme,
+		Client:   mgr.GetClient(),
+		Scheme:   mgrScheme,
+		Recorder: mgr.GetEventRecorderFor("core-dump-operator"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "CoreDumpHandler")
 		os.Exit(1)
 	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&chartsv1alpha1.CoreDumpHandler{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "CoreDumpHandler")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {